@@ -5,8 +5,11 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/xntrik/go209/pkg/go209"
 )
 
 // loadDotEnv loads your config from the .env file
@@ -43,14 +46,9 @@ func getSlackSigningSecret() (string, error) {
 }
 
 // getRedisAddr fetches the address (host:port) to connect to redis
-func getRedisAddr() (string, error) {
-	value := os.Getenv("REDIS_ADDR")
-
-	if len(value) == 0 {
-		return "", fmt.Errorf("Missing REDIS_ADDR ENV variable. Check --help for options")
-	}
-
-	return value, nil
+// This is only required when using the redis state backend
+func getRedisAddr() string {
+	return os.Getenv("REDIS_ADDR")
 }
 
 // getRedisPwd fetches the password used to connect to redis (defaults to "")
@@ -72,6 +70,122 @@ func getRedisDB() int {
 	return i
 }
 
+// getJobWorkers fetches how many module runs are processed at once (defaults to
+// go209.DefaultJobWorkers)
+func getJobWorkers() int {
+	value := os.Getenv("JOB_WORKERS")
+
+	if len(value) == 0 {
+		return go209.DefaultJobWorkers
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil || i < 1 {
+		return go209.DefaultJobWorkers
+	}
+	return i
+}
+
+// getModuleTimeout fetches how long modules are given to run (defaults to
+// go209.DefaultModuleTimeout)
+func getModuleTimeout() (time.Duration, error) {
+	value := os.Getenv("MODULE_TIMEOUT")
+
+	if len(value) == 0 {
+		return go209.DefaultModuleTimeout, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("Error parsing MODULE_TIMEOUT: %s", err)
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("MODULE_TIMEOUT must be more than 0")
+	}
+	return timeout, nil
+}
+
+// getBotWorkers fetches how many DMs the slack bot handles at once (defaults to
+// go209.DefaultBotWorkers)
+func getBotWorkers() int {
+	value := os.Getenv("BOT_WORKERS")
+
+	if len(value) == 0 {
+		return go209.DefaultBotWorkers
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil || i < 1 {
+		return go209.DefaultBotWorkers
+	}
+	return i
+}
+
+// getStateBackend fetches which state backend to use (defaults to redis)
+func getStateBackend() string {
+	value := os.Getenv("STATE_BACKEND")
+
+	if len(value) == 0 {
+		return go209.StateBackendRedis
+	}
+
+	return value
+}
+
+// getStatePath fetches where the bolt state backend keeps its database
+func getStatePath() string {
+	value := os.Getenv("STATE_PATH")
+
+	if len(value) == 0 {
+		return go209.DefaultStatePath
+	}
+
+	return value
+}
+
+// getSubmissionsFile fetches where completed interactions are kept
+func getSubmissionsFile() string {
+	value := os.Getenv("SUBMISSIONS_FILE")
+
+	if len(value) == 0 {
+		return go209.DefaultSubmissionsFile
+	}
+
+	return value
+}
+
+// getSubmissionsKeepCancelled fetches whether cancelled interactions are kept
+// as submissions too (defaults to false)
+func getSubmissionsKeepCancelled() bool {
+	value, err := strconv.ParseBool(os.Getenv("SAVE_CANCELLED"))
+	if err != nil {
+		return false
+	}
+	return value
+}
+
+// getAdminUsers fetches the slack user IDs of the admins, who can ask the bot
+// for reports (separate with ",")
+func getAdminUsers() []string {
+	var admins []string
+	for _, admin := range strings.Split(os.Getenv("ADMIN_USERS"), ",") {
+		admin = strings.TrimSpace(admin)
+		if len(admin) > 0 {
+			admins = append(admins, admin)
+		}
+	}
+	return admins
+}
+
+// getDynamicModules fetches the .so plugins to load modules from, separated
+// with ":"
+func getDynamicModules() string {
+	return os.Getenv("DYNAMIC_MODULES")
+}
+
+// getAnonymousSalt fetches the secret salt used to hash the users of
+// anonymous rules. This is only required if a rule is anonymous
+func getAnonymousSalt() string {
+	return os.Getenv("ANONYMOUS_SALT")
+}
+
 // getRulesFileLocation fetches the address of the rules.json to load
 func getRulesFileLocation() string {
 	value := os.Getenv("JSON_RULES")
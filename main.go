@@ -6,12 +6,18 @@ import (
 	"strings"
 
 	"github.com/xntrik/go209/pkg/go209"
+	"github.com/xntrik/go209/pkg/go209/modules/email"
+	"github.com/xntrik/go209/pkg/go209/modules/exec"
+	"github.com/xntrik/go209/pkg/go209/modules/sink"
+	"github.com/xntrik/go209/pkg/go209/modules/slackwebhook"
+	"github.com/xntrik/go209/pkg/go209/modules/webhook"
 
 	"github.com/urfave/cli"
 )
 
 func main() {
 	loadDotEnv()
+	registerModules()
 
 	app := NewApp()
 	err := app.Run(os.Args)
@@ -21,6 +27,18 @@ func main() {
 	}
 }
 
+// registerModules registers the modules compiled into go209. To add your own,
+// register it here too
+func registerModules() {
+	go209.Register(email.Module)
+	go209.Register(slackwebhook.Module)
+	go209.RegisterV2(webhook.Module)
+	go209.RegisterV2(exec.Module)
+	go209.RegisterV2(sink.JSONLModule)
+	go209.RegisterV2(sink.CSVModule)
+	go209.RegisterV2(sink.DirModule)
+}
+
 // NewApp is the cli.App which bootstraps everything
 func NewApp() *cli.App {
 	app := cli.NewApp()
@@ -32,14 +50,24 @@ func NewApp() *cli.App {
 ENV VARIABLES:
 	SLACK_TOKEN          Slack Bot User OAuth Access Token (required)
 	SLACK_SIGNING_SECRET Slack Bot Signing Secret (required)
-	REDIS_ADDR           REDIS address (required)
+	STATE_BACKEND        Where to keep state: redis, memory or bolt (default: "redis")
+	STATE_PATH           The bolt state database file (default: "go209.db")
+	REDIS_ADDR           REDIS address (required for the redis state backend)
 	REDIS_PWD            REDIS password (default: "")
 	REDIS_DB             REDIS DB (default: 0)
 	JSON_RULES           The rule file (default: "rules.json")
 	WEB_ADDR             The web listener address (default: "localhost:8000")
-	DYNAMIC_MODULES      Optional .so plugins you want to load (separate with ":") `, cli.AppHelpTemplate)
+	BOT_WORKERS          How many DMs the slack bot handles at once (default: 8)
+	JOB_WORKERS          How many module runs are processed at once (default: 2)
+	MODULE_TIMEOUT       How long modules are given to run (default: "30s")
+	SUBMISSIONS_FILE     Where completed interactions are kept (default: "submissions.jsonl")
+	SAVE_CANCELLED       Keep cancelled interactions as submissions too (default: false)
+	ADMIN_USERS          Slack user IDs who can DM the bot for reports (separate with ",")
+	ANONYMOUS_SALT       Secret used to hash the users of anonymous rules (required for anonymous rules)
+	DYNAMIC_MODULES      Optional .so plugins you want to load, by name or path (separate with ":") `, cli.AppHelpTemplate)
 
-	// Check for additional app help for module ENV VARS
+	// Check for additional app help for module ENV VARS. Only the modules
+	// compiled in are known here, plugins aren't loaded until go209 starts
 	tmpMods := go209.FetchMods()
 
 	modEnvVarHelp := ""
@@ -90,69 +118,298 @@ ENV VARIABLES:
 					return err
 				}
 
-				redisAddr, err := getRedisAddr()
+				moduleTimeout, err := getModuleTimeout()
 				if err != nil {
 					return err
 				}
 
 				cfg := go209.BotConfig{
-					SlackToken:         slackToken,
-					SlackSigningSecret: slackSigningSecret,
-					Debug:              c.GlobalBool("debug"),
-					RulesFileLocation:  getRulesFileLocation(),
-					RedisAddr:          redisAddr,
-					RedisPwd:           getRedisPwd(),
-					RedisDB:            getRedisDB(),
+					SlackToken:               slackToken,
+					SlackSigningSecret:       slackSigningSecret,
+					Debug:                    c.GlobalBool("debug"),
+					RulesFileLocation:        getRulesFileLocation(),
+					RedisAddr:                getRedisAddr(),
+					RedisPwd:                 getRedisPwd(),
+					RedisDB:                  getRedisDB(),
+					StateBackend:             getStateBackend(),
+					StatePath:                getStatePath(),
+					BotWorkers:               getBotWorkers(),
+					SubmissionsFile:          getSubmissionsFile(),
+					SubmissionsKeepCancelled: getSubmissionsKeepCancelled(),
+					AnonymousSalt:            getAnonymousSalt(),
+					DynamicModules:           getDynamicModules(),
+					JobWorkers:               getJobWorkers(),
+					ModuleTimeout:            moduleTimeout,
+					AdminUsers:               getAdminUsers(),
 				}
 
 				err = go209.StartBot(&cfg)
 				return err
 			},
 		},
+		{
+			Name:    "run",
+			Aliases: []string{"r"},
+			Usage:   "Start the slack bot and the web app in one process.",
+			Action: func(c *cli.Context) error {
+				// Fetch required env vars
+				slackToken, err := getSlackToken()
+				if err != nil {
+					return err
+				}
+
+				slackSigningSecret, err := getSlackSigningSecret()
+				if err != nil {
+					return err
+				}
+
+				moduleTimeout, err := getModuleTimeout()
+				if err != nil {
+					return err
+				}
+
+				cfg := go209.BotConfig{
+					SlackToken:               slackToken,
+					SlackSigningSecret:       slackSigningSecret,
+					Debug:                    c.GlobalBool("debug"),
+					RulesFileLocation:        getRulesFileLocation(),
+					RedisAddr:                getRedisAddr(),
+					RedisPwd:                 getRedisPwd(),
+					RedisDB:                  getRedisDB(),
+					StateBackend:             getStateBackend(),
+					StatePath:                getStatePath(),
+					WebListen:                getWebListen(),
+					BotWorkers:               getBotWorkers(),
+					SubmissionsFile:          getSubmissionsFile(),
+					SubmissionsKeepCancelled: getSubmissionsKeepCancelled(),
+					AnonymousSalt:            getAnonymousSalt(),
+					DynamicModules:           getDynamicModules(),
+					JobWorkers:               getJobWorkers(),
+					ModuleTimeout:            moduleTimeout,
+					AdminUsers:               getAdminUsers(),
+				}
+
+				err = go209.StartAll(&cfg)
+				return err
+			},
+		},
 		{
 			Name:  "modules",
 			Usage: "Display the loaded modules",
 			Action: func(c *cli.Context) error {
-				err := go209.DumpMods()
+				cfg := go209.BotConfig{
+					DynamicModules: getDynamicModules(),
+				}
+
+				err := go209.DumpMods(&cfg)
 				return err
 			},
 		},
 		{
 			Name:  "dump",
-			Usage: "Dump the rules json file, makes sure it parses too",
+			Usage: "Dump the rules json file, makes sure it parses and its modules are configured properly too",
 			Action: func(c *cli.Context) error {
 				cfg := go209.BotConfig{
 					RulesFileLocation: getRulesFileLocation(),
+					DynamicModules:    getDynamicModules(),
 				}
 
 				err := go209.DumpRules(&cfg)
 				return err
 			},
 		},
+		{
+			Name:      "classify",
+			Usage:     "Show which rule would fire for a message, and the intent scores",
+			ArgsUsage: "\"text\"",
+			Action: func(c *cli.Context) error {
+				if c.NArg() == 0 {
+					return fmt.Errorf("Missing text to classify. Check --help for options")
+				}
+
+				cfg := go209.BotConfig{
+					RulesFileLocation: getRulesFileLocation(),
+				}
+
+				err := go209.ClassifyText(&cfg, strings.Join(c.Args(), " "))
+				return err
+			},
+		},
+		{
+			Name:  "export",
+			Usage: "Export submissions as csv, json or jsonl",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "rule, r",
+					Usage: "only export submissions for this rule (its name or a search term)",
+				},
+				cli.StringFlag{
+					Name:  "since, s",
+					Usage: "only export submissions finished since this date (YYYY-MM-DD or RFC3339)",
+				},
+				cli.StringFlag{
+					Name:  "status",
+					Usage: "only export \"completed\" or \"cancelled\" submissions",
+				},
+				cli.StringFlag{
+					Name:  "format, f",
+					Value: "csv",
+					Usage: "csv, json or jsonl",
+				},
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "write to this file, instead of stdout",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				cfg := submissionsConfig()
+
+				opts := go209.ExportOptions{
+					Rule:   c.String("rule"),
+					Since:  c.String("since"),
+					Status: c.String("status"),
+					Format: c.String("format"),
+				}
+
+				out := os.Stdout
+				if len(c.String("output")) > 0 {
+					f, err := os.Create(c.String("output"))
+					if err != nil {
+						return fmt.Errorf("Error creating %s: %s", c.String("output"), err)
+					}
+					defer f.Close()
+					out = f
+				}
+
+				err := go209.ExportSubmissions(&cfg, opts, out)
+				return err
+			},
+		},
+		{
+			Name:  "report",
+			Usage: "Summarise the answers in the submissions for each rule",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "rule, r",
+					Usage: "only report on this rule (its name or a search term)",
+				},
+				cli.StringFlag{
+					Name:  "since, s",
+					Usage: "only report on submissions finished since this date (YYYY-MM-DD or RFC3339)",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				cfg := submissionsConfig()
+
+				opts := go209.ReportOptions{
+					Rule:  c.String("rule"),
+					Since: c.String("since"),
+				}
+
+				err := go209.ReportSubmissions(&cfg, opts, c.App.Writer)
+				return err
+			},
+		},
+		{
+			Name:  "funnel",
+			Usage: "Show where users drop off in each rule's interactions",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "rule, r",
+					Usage: "only show the funnel for this rule (its name or a search term)",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				cfg := go209.BotConfig{
+					RulesFileLocation: getRulesFileLocation(),
+					RedisAddr:         getRedisAddr(),
+					RedisPwd:          getRedisPwd(),
+					RedisDB:           getRedisDB(),
+					StateBackend:      getStateBackend(),
+					StatePath:         getStatePath(),
+				}
+
+				err := go209.FunnelReport(&cfg, c.String("rule"), os.Stdout)
+				return err
+			},
+		},
+		{
+			Name:  "jobs",
+			Usage: "List, retry or discard the queued and failed module runs",
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "List the queued and failed module runs",
+					Action: func(c *cli.Context) error {
+						cfg := jobsConfig()
+						err := go209.ListJobs(&cfg, os.Stdout)
+						return err
+					},
+				},
+				{
+					Name:      "retry",
+					Usage:     "Run failed module runs again, or all of them if no IDs are given",
+					ArgsUsage: "[job IDs]",
+					Action: func(c *cli.Context) error {
+						cfg := jobsConfig()
+						err := go209.RetryJobs(&cfg, c.Args(), os.Stdout)
+						return err
+					},
+				},
+				{
+					Name:      "discard",
+					Usage:     "Delete module runs, whether they're queued or failed",
+					ArgsUsage: "<job IDs>",
+					Action: func(c *cli.Context) error {
+						if c.NArg() == 0 {
+							return fmt.Errorf("Missing job IDs to discard. Check --help for options")
+						}
+
+						cfg := jobsConfig()
+						err := go209.DiscardJobs(&cfg, c.Args(), os.Stdout)
+						return err
+					},
+				},
+			},
+		},
 		{
 			Name:    "web",
 			Aliases: []string{"w"},
 			Usage:   "Start the web app.",
 			Action: func(c *cli.Context) error {
 				// Fetch required env vars
+				slackToken, err := getSlackToken()
+				if err != nil {
+					return err
+				}
+
 				slackSigningSecret, err := getSlackSigningSecret()
 				if err != nil {
 					return err
 				}
 
-				redisAddr, err := getRedisAddr()
+				moduleTimeout, err := getModuleTimeout()
 				if err != nil {
 					return err
 				}
 
 				cfg := go209.BotConfig{
-					SlackSigningSecret: slackSigningSecret,
-					Debug:              c.GlobalBool("debug"),
-					RulesFileLocation:  getRulesFileLocation(),
-					RedisAddr:          redisAddr,
-					RedisPwd:           getRedisPwd(),
-					RedisDB:            getRedisDB(),
-					WebListen:          getWebListen(),
+					SlackToken:               slackToken,
+					SlackSigningSecret:       slackSigningSecret,
+					Debug:                    c.GlobalBool("debug"),
+					RulesFileLocation:        getRulesFileLocation(),
+					RedisAddr:                getRedisAddr(),
+					RedisPwd:                 getRedisPwd(),
+					RedisDB:                  getRedisDB(),
+					StateBackend:             getStateBackend(),
+					StatePath:                getStatePath(),
+					WebListen:                getWebListen(),
+					SubmissionsFile:          getSubmissionsFile(),
+					SubmissionsKeepCancelled: getSubmissionsKeepCancelled(),
+					AnonymousSalt:            getAnonymousSalt(),
+					DynamicModules:           getDynamicModules(),
+					JobWorkers:               getJobWorkers(),
+					ModuleTimeout:            moduleTimeout,
 				}
 
 				err = go209.StartWeb(&cfg)
@@ -163,3 +420,24 @@ ENV VARIABLES:
 
 	return app
 }
+
+// submissionsConfig is the config the export and report commands need, to
+// read the submissions the way the bot kept them
+func submissionsConfig() go209.BotConfig {
+	return go209.BotConfig{
+		RulesFileLocation:        getRulesFileLocation(),
+		SubmissionsFile:          getSubmissionsFile(),
+		SubmissionsKeepCancelled: getSubmissionsKeepCancelled(),
+	}
+}
+
+// jobsConfig is the config the jobs commands need, to get to the state
+func jobsConfig() go209.BotConfig {
+	return go209.BotConfig{
+		RedisAddr:    getRedisAddr(),
+		RedisPwd:     getRedisPwd(),
+		RedisDB:      getRedisDB(),
+		StateBackend: getStateBackend(),
+		StatePath:    getStatePath(),
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReportCommand(t *testing.T) {
+	path := filepath.Join("pkg", "go209", "testdata", "submissions.jsonl")
+
+	os.Setenv("JSON_RULES", filepath.Join("pkg", "go209", "testdata", "export_rules.json"))
+	os.Setenv("SUBMISSIONS_FILE", path)
+	defer os.Unsetenv("JSON_RULES")
+	defer os.Unsetenv("SUBMISSIONS_FILE")
+	defer os.Unsetenv("SAVE_CANCELLED")
+
+	tests := []struct {
+		saveCancelled string
+		want          string
+	}{
+		{"true", "Submissions: 3 (2 completed, 1 cancelled, 67% completed)"},
+		{"", "completion rate n/a as cancelled submissions aren't kept"},
+	}
+
+	for _, test := range tests {
+		os.Setenv("SAVE_CANCELLED", test.saveCancelled)
+
+		var out bytes.Buffer
+		app := NewApp()
+		app.Writer = &out
+		err := app.Run([]string{"go209", "report", "--rule", "pizza"})
+		if err != nil {
+			t.Fatalf("SAVE_CANCELLED=%q: report error: %s", test.saveCancelled, err)
+		}
+		if !strings.Contains(out.String(), test.want) {
+			t.Errorf("SAVE_CANCELLED=%q: report doesn't contain %q:\n%s", test.saveCancelled, test.want, out.String())
+		}
+	}
+
+	// reporting on a submissions file which isn't there doesn't create it
+	dir, err := ioutil.TempDir("", "go209")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	missing := filepath.Join(dir, "submissions.jsonl")
+	os.Setenv("SUBMISSIONS_FILE", missing)
+
+	app := NewApp()
+	app.Writer = ioutil.Discard
+	err = app.Run([]string{"go209", "report"})
+	if err == nil || !strings.Contains(err.Error(), "doesn't exist") {
+		t.Errorf("report of a missing submissions file = %v, want an error", err)
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("report created the submissions file: %v", err)
+	}
+}
@@ -0,0 +1,220 @@
+package go209
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nlopes/slack"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultNotPermittedResponse is sent when a user isn't allowed to use a
+// rule, if the rule doesn't set not_permitted_response
+const DefaultNotPermittedResponse = "Sorry, you're not allowed to do that"
+
+// AccessCacheTTL is how long users and user group members fetched from slack
+// are cached for
+const AccessCacheTTL = 5 * time.Minute
+
+// AccessList picks out users by their ID, the user groups they're in, the
+// workspace (team) they're in, or whether they're a guest or a full member.
+// A user is on the list if they match any of these
+type AccessList struct {
+	Users   []string `json:"users,omitempty"`
+	Groups  []string `json:"groups,omitempty"`
+	Teams   []string `json:"teams,omitempty"`
+	Guests  bool     `json:"guests,omitempty"`
+	Members bool     `json:"members,omitempty"`
+}
+
+// slackDirectory is the part of the slack API used to look up users and user
+// groups. It's satisfied by *slack.Client
+type slackDirectory interface {
+	GetUserInfo(user string) (*slack.User, error)
+	GetUserGroups(options ...slack.GetUserGroupsOption) ([]slack.UserGroup, error)
+}
+
+// accessCache caches whether users are guests, and the members of each user
+// group, so we don't hit the slack API for every message
+type accessCache struct {
+	mu  sync.Mutex
+	ttl time.Duration
+
+	guests        map[string]bool
+	guestsFetched map[string]time.Time
+
+	// groups is keyed by the group's handle and its ID
+	groups        map[string]map[string]bool
+	groupsFetched time.Time
+}
+
+// newAccessCache sets up an empty cache
+func newAccessCache(ttl time.Duration) *accessCache {
+	return &accessCache{
+		ttl:           ttl,
+		guests:        make(map[string]bool),
+		guestsFetched: make(map[string]time.Time),
+	}
+}
+
+// isGuest returns true if the user is a single or multi-channel guest. The
+// lock isn't held while slack is asked, so other lookups aren't held up
+func (c *accessCache) isGuest(dir slackDirectory, user string) (bool, error) {
+	c.mu.Lock()
+	if fetched, ok := c.guestsFetched[user]; ok && time.Since(fetched) < c.ttl {
+		guest := c.guests[user]
+		c.mu.Unlock()
+		return guest, nil
+	}
+	c.mu.Unlock()
+
+	u, err := dir.GetUserInfo(user)
+	if err != nil {
+		return false, fmt.Errorf("GetUserInfo error: %s", err)
+	}
+	guest := u.IsRestricted || u.IsUltraRestricted
+
+	c.mu.Lock()
+	c.guests[user] = guest
+	c.guestsFetched[user] = time.Now()
+	c.mu.Unlock()
+	return guest, nil
+}
+
+// userGroups returns the members of each user group, keyed by the group's
+// handle and its ID, fetching them from slack if they aren't cached. The
+// lock isn't held while slack is asked, so other lookups aren't held up
+func (c *accessCache) userGroups(dir slackDirectory) (map[string]map[string]bool, error) {
+	c.mu.Lock()
+	if c.groups != nil && time.Since(c.groupsFetched) < c.ttl {
+		groups := c.groups
+		c.mu.Unlock()
+		return groups, nil
+	}
+	c.mu.Unlock()
+
+	userGroups, err := dir.GetUserGroups(slack.GetUserGroupsOptionIncludeUsers(true))
+	if err != nil {
+		return nil, fmt.Errorf("GetUserGroups error: %s", err)
+	}
+
+	groups := make(map[string]map[string]bool)
+	for _, userGroup := range userGroups {
+		members := make(map[string]bool)
+		for _, member := range userGroup.Users {
+			members[member] = true
+		}
+		groups[strings.ToLower(userGroup.Handle)] = members
+		groups[userGroup.ID] = members
+	}
+
+	// the map is replaced, never changed, so it can be read without the lock
+	c.mu.Lock()
+	c.groups = groups
+	c.groupsFetched = time.Now()
+	c.mu.Unlock()
+	return groups, nil
+}
+
+// inGroup returns true if the user is a member of the user group, which is
+// referred to by its handle (with or without the @) or its ID
+func (c *accessCache) inGroup(dir slackDirectory, group, user string) (bool, error) {
+	groups, err := c.userGroups(dir)
+	if err != nil {
+		return false, err
+	}
+
+	members, ok := groups[group]
+	if !ok {
+		members = groups[strings.ToLower(strings.TrimPrefix(group, "@"))]
+	}
+	return members[user], nil
+}
+
+// matches returns true if the user is on the list
+func (a *AccessList) matches(dir slackDirectory, cache *accessCache, team, user string) (bool, error) {
+	for _, u := range a.Users {
+		if u == user {
+			return true, nil
+		}
+	}
+
+	for _, t := range a.Teams {
+		if t == team {
+			return true, nil
+		}
+	}
+
+	if a.Guests || a.Members {
+		guest, err := cache.isGuest(dir, user)
+		if err != nil {
+			return false, err
+		}
+		if (a.Guests && guest) || (a.Members && !guest) {
+			return true, nil
+		}
+	}
+
+	for _, group := range a.Groups {
+		member, err := cache.inGroup(dir, group, user)
+		if err != nil {
+			return false, err
+		}
+		if member {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// notPermittedResponse is the response sent when a user isn't allowed to use
+// the rule
+func (r *Rule) notPermittedResponse() string {
+	if len(r.NotPermittedResponse) > 0 {
+		return r.NotPermittedResponse
+	}
+	return DefaultNotPermittedResponse
+}
+
+// permitted checks the rule's deny and allow lists. A user on the deny list
+// can't use the rule, and if there's an allow list, only the users on it can.
+// If the lists can't be checked, the user isn't permitted
+func (r *RuleSet) permitted(dir slackDirectory, rule *Rule, team, user string) bool {
+	if rule.Deny != nil {
+		denied, err := rule.Deny.matches(dir, r.access, team, user)
+		if err != nil {
+			log.Warn(fmt.Sprintf("Error checking deny list of rule '%s': %s", rule.title(), err))
+			return false
+		}
+		if denied {
+			return false
+		}
+	}
+
+	if rule.Allow != nil {
+		allowed, err := rule.Allow.matches(dir, r.access, team, user)
+		if err != nil {
+			log.Warn(fmt.Sprintf("Error checking allow list of rule '%s': %s", rule.title(), err))
+			return false
+		}
+		return allowed
+	}
+
+	return true
+}
+
+// enforceAccess checks the user can use the rule, and lets them know if they
+// can't. It returns false if the rule shouldn't be run
+func enforceAccess(api *slack.Client, rules *RuleSet, rule *Rule, team, channel, user, username, args string, re *regexp.Regexp) bool {
+	if rules.permitted(api, rule, team, user) {
+		return true
+	}
+
+	log.Info(fmt.Sprintf("User %s isn't permitted to use rule '%s'", logUser(rule.Anonymous, username, user), rule.title()))
+	api.PostMessage(channel, slack.MsgOptionText(rules.renderTemplate(api, team, rule.notPermittedResponse(), username, user, args, re), false))
+	return false
+}
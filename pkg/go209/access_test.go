@@ -0,0 +1,140 @@
+package go209
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// testDirectory is a slackDirectory with fixed guests and user groups. If
+// block is set, GetUserInfo waits for it to be closed
+type testDirectory struct {
+	mu     sync.Mutex
+	calls  int
+	block  chan struct{}
+	guests map[string]bool
+	groups []slack.UserGroup
+}
+
+func (d *testDirectory) GetUserInfo(user string) (*slack.User, error) {
+	d.mu.Lock()
+	d.calls++
+	block := d.block
+	d.mu.Unlock()
+	if block != nil {
+		<-block
+	}
+	return &slack.User{ID: user, IsRestricted: d.guests[user]}, nil
+}
+
+func (d *testDirectory) GetUserGroups(options ...slack.GetUserGroupsOption) ([]slack.UserGroup, error) {
+	d.mu.Lock()
+	d.calls++
+	d.mu.Unlock()
+	return d.groups, nil
+}
+
+func TestAccessCacheDoesntBlock(t *testing.T) {
+	cache := newAccessCache(time.Minute)
+	dir := &testDirectory{guests: map[string]bool{"U1": true}}
+
+	guest, err := cache.isGuest(dir, "U1")
+	if err != nil || !guest {
+		t.Fatalf("isGuest(U1) = %v, %v, want true", guest, err)
+	}
+
+	// while U2 is being fetched, the cached U1 can still be looked up
+	dir.block = make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		cache.isGuest(dir, "U2")
+		close(done)
+	}()
+
+	cached := make(chan bool)
+	go func() {
+		guest, _ := cache.isGuest(dir, "U1")
+		cached <- guest
+	}()
+	select {
+	case guest := <-cached:
+		if !guest {
+			t.Error("cached isGuest(U1) = false, want true")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("isGuest(U1) blocked on another user's lookup")
+	}
+
+	close(dir.block)
+	<-done
+	if dir.calls != 2 {
+		t.Errorf("GetUserInfo called %d times, want 2", dir.calls)
+	}
+}
+
+func TestPermittedRulesListed(t *testing.T) {
+	rules := &RuleSet{
+		access: newAccessCache(time.Minute),
+		Rules: []Rule{
+			{
+				Name:             "expenses",
+				Description:      "Claim your expenses",
+				SearchTerms:      []string{"expenses"},
+				Interactions:     []Interaction{{InteractionID: "e1", Type: "text", Question: "How much?"}},
+				InteractionStart: "e1",
+			},
+			{
+				Name:             "security",
+				Description:      "Report an incident",
+				SearchTerms:      []string{"incident"},
+				Interactions:     []Interaction{{InteractionID: "s1", Type: "text", Question: "What happened?"}},
+				InteractionStart: "s1",
+				Allow:            &AccessList{Groups: []string{"@security"}},
+			},
+		},
+	}
+	dir := &testDirectory{groups: []slack.UserGroup{{ID: "S1", Handle: "security", Users: []string{"U1"}}}}
+
+	tests := []struct {
+		user string
+		want []string
+		deny []string
+	}{
+		{"U1", []string{"expenses", "security"}, nil},
+		{"U2", []string{"expenses"}, []string{"security"}},
+	}
+
+	for _, test := range tests {
+		help := rules.helpText(dir, "T1", test.user)
+		home, err := json.Marshal(buildHomeView(rules, dir, "T1", test.user, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, name := range test.want {
+			if !strings.Contains(help, name) {
+				t.Errorf("help for %s doesn't list %s", test.user, name)
+			}
+			if !strings.Contains(string(home), name) {
+				t.Errorf("App Home for %s doesn't list %s", test.user, name)
+			}
+		}
+		for _, name := range test.deny {
+			if strings.Contains(help, name) {
+				t.Errorf("help for %s lists %s", test.user, name)
+			}
+			if strings.Contains(string(home), name) {
+				t.Errorf("App Home for %s lists %s", test.user, name)
+			}
+		}
+
+		funcs := rules.templateFuncs(dir, "T1", test.user)
+		if got := funcs["help"].(func() string)(); got != help {
+			t.Errorf("{{help}} for %s = %q, want %q", test.user, got, help)
+		}
+	}
+}
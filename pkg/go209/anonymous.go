@@ -0,0 +1,88 @@
+package go209
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultDuplicateResponse is sent when a user tries to take part in an
+// anonymous rule they've already completed, if the rule doesn't set
+// duplicate_response
+const DefaultDuplicateResponse = "You've already taken part in this one, thanks!"
+
+// anonymousKey is the state key the hashes of users who have completed
+// anonymous rules are kept in
+const anonymousKey = "go209:anonymous"
+
+// setAnonymousSalt sets the salt used to hash users of anonymous rules. If any
+// rule is anonymous, the salt is required
+func (r *RuleSet) setAnonymousSalt(salt string) error {
+	for _, rule := range r.Rules {
+		if rule.Anonymous && len(salt) == 0 {
+			return fmt.Errorf("Rule '%s' is anonymous, but ANONYMOUS_SALT isn't set. Check --help for options", rule.title())
+		}
+	}
+	r.anonymousSalt = salt
+	return nil
+}
+
+// anonymousHash is a salted hash of a user, which lets us tell if they've
+// already completed an anonymous rule without keeping who they are. The
+// rule's title is part of the hash, so the same user can't be followed across
+// rules
+func (r *RuleSet) anonymousHash(rule *Rule, user string) string {
+	mac := hmac.New(sha256.New, []byte(r.anonymousSalt))
+	mac.Write([]byte(rule.title()))
+	mac.Write([]byte{0})
+	mac.Write([]byte(user))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// hasSubmitted checks if the user with this hash has completed the anonymous
+// rule it was hashed for
+func hasSubmitted(db StateStore, userHash string) (bool, error) {
+	hashes, err := db.Get(anonymousKey)
+	if err != nil {
+		return false, fmt.Errorf("State error: %s", err)
+	}
+	_, ok := hashes[userHash]
+	return ok, nil
+}
+
+// markSubmitted records that the user with this hash has completed the
+// anonymous rule it was hashed for
+func markSubmitted(db StateStore, userHash string) error {
+	return db.Set(anonymousKey, map[string]string{userHash: "1"}, 0)
+}
+
+// completeAnonymous records that the user of a finished anonymous state has
+// completed the rule, then drops their hash from the final state so it isn't
+// passed on to modules or the logs
+func completeAnonymous(db StateStore, finalval map[string]string) {
+	if !isAnonymous(finalval) {
+		return
+	}
+
+	err := markSubmitted(db, finalval["user_hash"])
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error recording anonymous submission: %s", err))
+	}
+	delete(finalval, "user_hash")
+}
+
+// isAnonymous returns true if the state is for an anonymous rule
+func isAnonymous(val map[string]string) bool {
+	return val["anonymous"] == "true"
+}
+
+// logUser describes a user for the logs, unless they're anonymous
+func logUser(anonymous bool, username, user string) string {
+	if anonymous {
+		return "anonymous"
+	}
+	return fmt.Sprintf("%s (%s)", username, user)
+}
@@ -0,0 +1,229 @@
+package go209
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// userProvider is a data provider which keeps who it was last asked for
+type userProvider struct {
+	mu sync.Mutex
+	in *ProviderInput
+}
+
+func (p *userProvider) Name() string {
+	return "UserProvider"
+}
+
+func (p *userProvider) EnvVars() []string {
+	return nil
+}
+
+func (p *userProvider) Run(ctx context.Context, in *ModuleInput) (*ModuleResult, error) {
+	return nil, nil
+}
+
+func (p *userProvider) Provide(ctx context.Context, in *ProviderInput) (*ProviderResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.in = in
+	return &ProviderResult{Text: "from the provider"}, nil
+}
+
+// testAnonymousRules has an anonymous rule with an end mod and a question from
+// a data provider, and the same rule without anonymous
+func testAnonymousRules() *RuleSet {
+	rule := func(name, prefix string, anonymous bool) Rule {
+		return Rule{
+			Name:        name,
+			SearchTerms: []string{strings.ToLower(name)},
+			Anonymous:   anonymous,
+			Interactions: []Interaction{
+				{InteractionID: prefix + "1", Type: "text", Question: "How are you?", NextInteraction: prefix + "2", TextFrom: &DataSource{Module: "UserProvider"}},
+				{InteractionID: prefix + "2", Type: "finaltext", Response: "Thanks!"},
+			},
+			InteractionStart:   prefix + "1",
+			InteractionEndMods: []EndMod{{Module: "UserProvider"}},
+		}
+	}
+	return &RuleSet{
+		Rules:         []Rule{rule("Feedback", "a", true), rule("Survey", "s", false)},
+		moduleTimeout: time.Minute,
+		providers:     newProviderCache(),
+	}
+}
+
+func TestAnonymousHash(t *testing.T) {
+	rules := testAnonymousRules()
+	err := rules.setAnonymousSalt("")
+	if err == nil || !strings.Contains(err.Error(), "ANONYMOUS_SALT") {
+		t.Errorf("setAnonymousSalt without a salt = %v, want an error", err)
+	}
+	err = rules.setAnonymousSalt("salt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	feedback, survey := &rules.Rules[0], &rules.Rules[1]
+	hash := rules.anonymousHash(feedback, "U1")
+	if len(hash) != 64 || strings.Contains(hash, "U1") {
+		t.Errorf("anonymousHash = %s, want a hex sha256 without the user", hash)
+	}
+	if again := rules.anonymousHash(feedback, "U1"); again != hash {
+		t.Errorf("anonymousHash of the same user and rule = %s, then %s", hash, again)
+	}
+
+	salted := &RuleSet{}
+	salted.setAnonymousSalt("other salt")
+	others := map[string]string{
+		"another user": rules.anonymousHash(feedback, "U2"),
+		"another rule": rules.anonymousHash(survey, "U1"),
+		"another salt": salted.anonymousHash(feedback, "U1"),
+	}
+	for name, other := range others {
+		if other == hash {
+			t.Errorf("%s has the same hash %s", name, hash)
+		}
+	}
+}
+
+func TestAnonymousSubmission(t *testing.T) {
+	saved := modules
+	defer func() { modules = saved }()
+	modules = LoadedModules{}
+	provider := &userProvider{}
+	RegisterV2(provider)
+
+	dir, err := ioutil.TempDir("", "go209")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	subs, err := newJSONLSubmissionStore(filepath.Join(dir, "submissions.jsonl"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subs.Close()
+
+	db := newMemoryStore()
+	defer db.Close()
+	rules := testAnonymousRules()
+	rules.setAnonymousSalt("salt")
+	rule := &rules.Rules[0]
+	userHash := rules.anonymousHash(rule, "U1")
+
+	// the user's ID and name aren't kept in the state, only their hash
+	val, err := newState(db, "T1:D1", "U1", "bob", "", userHash, 0, &rule.Interactions[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(val["userid"]) > 0 || len(val["username"]) > 0 || val["user_hash"] != userHash || !isAnonymous(val) {
+		t.Errorf("anonymous state = %v, want the hash without the user", val)
+	}
+
+	// nor are they given to data providers
+	resolved := rules.resolveInteraction(db, &rule.Interactions[0], "U1", "bob", "", time.Time{})
+	if resolved.Question != "from the provider" {
+		t.Errorf("question = %q, want it from the provider", resolved.Question)
+	}
+	if provider.in == nil || len(provider.in.UserID) > 0 || len(provider.in.Username) > 0 {
+		t.Errorf("provider was given %+v, want no user", provider.in)
+	}
+
+	submitted, _ := hasSubmitted(db, userHash)
+	if submitted {
+		t.Error("anonymous rule marked submitted before it was finished")
+	}
+
+	// finishing takes the hash out of the final state, and marks the hash as
+	// having submitted
+	finalval, finished, err := advanceState(db, "T1:D1", "a1", val["version"], []string{"fine"}, &rule.Interactions[1])
+	if err != nil || !finished {
+		t.Fatalf("advanceState = %v, %v", finished, err)
+	}
+	if _, ok := finalval["user_hash"]; ok {
+		t.Errorf("final state has the user's hash: %v", finalval)
+	}
+	submitted, err = hasSubmitted(db, userHash)
+	if err != nil || !submitted {
+		t.Errorf("hasSubmitted = %v, %v, want true", submitted, err)
+	}
+	if submitted, _ := hasSubmitted(db, rules.anonymousHash(rule, "U2")); submitted {
+		t.Error("another user is marked as having submitted")
+	}
+
+	// the stored submission and the module jobs don't have the user either
+	sub := recordSubmission(subs, rules, finalval, SubmissionCompleted)
+	jobs := newModuleJobs(rule, HookEnd, rule.InteractionEndMods, finalval, sub, "D1")
+	if len(jobs) != 1 || len(jobs[0].Channel) > 0 {
+		t.Fatalf("jobs = %+v, want one without the channel", jobs)
+	}
+	if !sub.Anonymous || len(sub.UserID) > 0 || len(sub.Username) > 0 {
+		t.Errorf("submission = %+v, want it anonymous without the user", sub)
+	}
+
+	stored, err := ioutil.ReadFile(filepath.Join(dir, "submissions.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := json.Marshal(jobs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, b := range map[string][]byte{"stored submission": stored, "job": job} {
+		for _, identity := range []string{"U1", "bob", "D1", userHash, "user_hash"} {
+			if strings.Contains(string(b), identity) {
+				t.Errorf("%s has %q: %s", name, identity, b)
+			}
+		}
+	}
+}
+
+func TestAnonymousCancel(t *testing.T) {
+	db := newMemoryStore()
+	defer db.Close()
+	rules := testAnonymousRules()
+	rules.setAnonymousSalt("salt")
+	rule := &rules.Rules[0]
+	userHash := rules.anonymousHash(rule, "U1")
+
+	_, err := newState(db, "T1:D1", "U1", "bob", "", userHash, 0, &rule.Interactions[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a cancelled rule can be taken part in again, and the hash doesn't go
+	// any further
+	ended, err := endState(db, "T1:D1", "", "", FunnelCancelled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ended["user_hash"]; ok || !isAnonymous(ended) {
+		t.Errorf("cancelled state = %v, want it anonymous without the hash", ended)
+	}
+	if submitted, _ := hasSubmitted(db, userHash); submitted {
+		t.Error("cancelling marked the rule as submitted")
+	}
+
+	state := moduleState(map[string]string{"anonymous": "true", "user_hash": userHash, "response:a1": "fine"})
+	if _, ok := state["user_hash"]; ok || state["response:a1"] != "fine" {
+		t.Errorf("moduleState = %v, want it without the hash", state)
+	}
+
+	// completeAnonymous leaves states of other rules alone
+	val := map[string]string{"userid": "U1", "user_hash": "x"}
+	completeAnonymous(db, val)
+	if val["user_hash"] != "x" {
+		t.Errorf("completeAnonymous changed a state which isn't anonymous: %v", val)
+	}
+	if submitted, _ := hasSubmitted(db, "x"); submitted {
+		t.Error("completeAnonymous marked a state which isn't anonymous")
+	}
+}
@@ -1,15 +1,36 @@
 package go209
 
+import "time"
+
 // BotConfig defines the configuration that is used by both the slack bot app
 // and web server
 type BotConfig struct {
-	SlackToken         string
-	SlackSigningSecret string
-	Debug              bool
-	RulesFileLocation  string
-	RedisAddr          string
-	RedisPwd           string
-	RedisDB            int
-	WebListen          string
-	DynamicModules     string
+	SlackToken               string
+	SlackSigningSecret       string
+	Debug                    bool
+	RulesFileLocation        string
+	RedisAddr                string
+	RedisPwd                 string
+	RedisDB                  int
+	StateBackend             string
+	StatePath                string
+	WebListen                string
+	DynamicModules           string
+	BotWorkers               int
+	JobWorkers               int
+	ModuleTimeout            time.Duration
+	SubmissionsFile          string
+	SubmissionsKeepCancelled bool
+	AdminUsers               []string
+	AnonymousSalt            string
+}
+
+// isAdmin returns true if the slack user is one of the admins
+func (cfg *BotConfig) isAdmin(user string) bool {
+	for _, admin := range cfg.AdminUsers {
+		if admin == user {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,369 @@
+package go209
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// DefaultIntentThreshold is the confidence (between 0 and 1) the intent
+// classifier needs before a rule is fired from a message that didn't contain
+// any of the search terms
+const DefaultIntentThreshold = 0.6
+
+// stopWords are common words which say nothing about the intent of a message
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "can": true, "do": true,
+	"i": true, "is": true, "it": true, "me": true, "my": true, "of": true,
+	"on": true, "please": true, "the": true, "to": true, "you": true,
+	"your": true, "what": true, "how": true, "with": true, "for": true,
+}
+
+// stemSuffixes are the longer suffixes stripped once the plurals and -ing and
+// -ed have been, if enough of the word is left. minMeasure is how many
+// vowel-consonant sequences (Porter's m) the rest of the word needs
+var stemSuffixes = []struct {
+	suffix      string
+	replacement string
+	minMeasure  int
+}{
+	{"ational", "ate", 1},
+	{"ization", "ize", 1},
+	{"fulness", "ful", 1},
+	{"ousness", "ous", 1},
+	{"iveness", "ive", 1},
+	{"ness", "", 1},
+	{"ment", "", 2},
+}
+
+// isConsonant returns true if the letter at i is a consonant. y is a
+// consonant at the start of a word, or after a vowel
+func isConsonant(word string, i int) bool {
+	switch word[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !isConsonant(word, i-1)
+	}
+	return true
+}
+
+// measure is the number of vowel-consonant sequences in the word, Porter's m
+func measure(word string) int {
+	m := 0
+	vowel := false
+	for i := 0; i < len(word); i++ {
+		if isConsonant(word, i) {
+			if vowel {
+				m++
+			}
+			vowel = false
+		} else {
+			vowel = true
+		}
+	}
+	return m
+}
+
+// hasVowel returns true if the word has a vowel in it
+func hasVowel(word string) bool {
+	for i := 0; i < len(word); i++ {
+		if !isConsonant(word, i) {
+			return true
+		}
+	}
+	return false
+}
+
+// endsCVC returns true if the word ends consonant-vowel-consonant, where the
+// last consonant isn't w, x or y, like "hop"
+func endsCVC(word string) bool {
+	n := len(word)
+	if n < 3 || !isConsonant(word, n-1) || isConsonant(word, n-2) || !isConsonant(word, n-3) {
+		return false
+	}
+	return !strings.ContainsAny(word[n-1:], "wxy")
+}
+
+// stem reduces a word to its root form, with step 1 of the Porter stemmer and
+// a few of its longer suffixes, so "question", "questions", "questioning" and
+// "questioned" all become "question", and "expense" and "expenses" both
+// become "expense"
+func stem(word string) string {
+	if len(word) <= 2 {
+		return word
+	}
+
+	// step 1a, plurals
+	switch {
+	case strings.HasSuffix(word, "sses"), strings.HasSuffix(word, "ies"):
+		word = word[:len(word)-2]
+	case strings.HasSuffix(word, "ss"):
+	case strings.HasSuffix(word, "s"):
+		word = word[:len(word)-1]
+	}
+
+	// step 1b, -eed, -ed and -ing
+	if strings.HasSuffix(word, "eed") {
+		if measure(word[:len(word)-3]) > 0 {
+			word = word[:len(word)-1]
+		}
+	} else {
+		for _, suffix := range []string{"ed", "ing"} {
+			rest := strings.TrimSuffix(word, suffix)
+			if rest == word || !hasVowel(rest) {
+				continue
+			}
+
+			word = rest
+			n := len(word)
+			switch {
+			case strings.HasSuffix(word, "at"), strings.HasSuffix(word, "bl"), strings.HasSuffix(word, "iz"):
+				word += "e"
+			case n >= 2 && word[n-1] == word[n-2] && isConsonant(word, n-1) && !strings.ContainsAny(word[n-1:], "lsz"):
+				word = word[:n-1]
+			case measure(word) == 1 && endsCVC(word):
+				word += "e"
+			}
+			break
+		}
+	}
+
+	// step 1c, a y after a vowel becomes i, so "holiday" and "holidays" match
+	if strings.HasSuffix(word, "y") && hasVowel(word[:len(word)-1]) {
+		word = word[:len(word)-1] + "i"
+	}
+
+	for _, s := range stemSuffixes {
+		if strings.HasSuffix(word, s.suffix) {
+			rest := strings.TrimSuffix(word, s.suffix)
+			if measure(rest) >= s.minMeasure {
+				word = rest + s.replacement
+			}
+			break
+		}
+	}
+
+	return word
+}
+
+// intentTokens tokenizes and stems some text, dropping stop words
+func intentTokens(text string) []string {
+	var tokens []string
+	for _, token := range tokenize(text) {
+		if stopWords[token] {
+			continue
+		}
+		tokens = append(tokens, stem(token))
+	}
+	return tokens
+}
+
+// intentClassifier is a multinomial naive Bayes classifier, trained on the
+// examples and search terms of each rule. Every rule is given the same prior,
+// so rules with lots of examples aren't favoured
+type intentClassifier struct {
+	rules       []*Rule
+	wordCounts  []map[string]float64
+	totalCounts []float64
+	vocabulary  map[string]bool
+}
+
+// intentScore is the confidence the classifier has that a message is meant
+// for a rule
+type intentScore struct {
+	Rule       *Rule
+	Confidence float64
+}
+
+// newIntentClassifier trains a classifier from all the rules' examples and
+// search terms. Hidden rules are left out, so they're only ever run by their
+// search terms
+func newIntentClassifier(rules []Rule) *intentClassifier {
+	c := &intentClassifier{
+		vocabulary: make(map[string]bool),
+	}
+
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Hidden || (len(rule.Examples) == 0 && len(rule.SearchTerms) == 0) {
+			continue
+		}
+
+		counts := make(map[string]float64)
+		total := 0.0
+		for _, text := range append(append([]string{}, rule.SearchTerms...), rule.Examples...) {
+			for _, token := range intentTokens(text) {
+				counts[token]++
+				total++
+				c.vocabulary[token] = true
+			}
+		}
+
+		c.rules = append(c.rules, rule)
+		c.wordCounts = append(c.wordCounts, counts)
+		c.totalCounts = append(c.totalCounts, total)
+	}
+
+	return c
+}
+
+// classify scores a message against every rule, most confident first. If none
+// of the words in the message were seen during training, there are no scores
+func (c *intentClassifier) classify(msg string) []intentScore {
+	var tokens []string
+	for _, token := range intentTokens(msg) {
+		if c.vocabulary[token] {
+			tokens = append(tokens, token)
+		}
+	}
+	if len(tokens) == 0 || len(c.rules) == 0 {
+		return nil
+	}
+
+	// log probabilities with Laplace smoothing
+	vocabSize := float64(len(c.vocabulary))
+	logProbs := make([]float64, len(c.rules))
+	maxLogProb := math.Inf(-1)
+	for i := range c.rules {
+		for _, token := range tokens {
+			logProbs[i] += math.Log((c.wordCounts[i][token] + 1) / (c.totalCounts[i] + vocabSize))
+		}
+		if logProbs[i] > maxLogProb {
+			maxLogProb = logProbs[i]
+		}
+	}
+
+	// normalise into confidences which add up to 1
+	sum := 0.0
+	for i := range logProbs {
+		sum += math.Exp(logProbs[i] - maxLogProb)
+	}
+
+	scores := make([]intentScore, len(c.rules))
+	for i, rule := range c.rules {
+		scores[i] = intentScore{
+			Rule:       rule,
+			Confidence: math.Exp(logProbs[i]-maxLogProb) / sum,
+		}
+	}
+
+	sort.SliceStable(scores, func(i, j int) bool {
+		return scores[i].Confidence > scores[j].Confidence
+	})
+
+	return scores
+}
+
+// intentThreshold returns the configured intent threshold
+func (r *RuleSet) intentThreshold() float64 {
+	if r.IntentThreshold > 0 {
+		return r.IntentThreshold
+	}
+	return DefaultIntentThreshold
+}
+
+// classifyRule uses the intent classifier to find the rule a message is meant
+// for. If the classifier isn't confident enough, an error is returned
+func (r *RuleSet) classifyRule(msg string) (*Rule, float64, error) {
+	if r.classifier == nil {
+		return nil, 0, fmt.Errorf("No intent classifier has been trained")
+	}
+
+	scores := r.classifier.classify(msg)
+	if len(scores) == 0 {
+		return nil, 0, fmt.Errorf("No known words in: '%s'", msg)
+	}
+
+	if scores[0].Confidence < r.intentThreshold() {
+		return nil, scores[0].Confidence, fmt.Errorf("Not confident enough about: '%s'", msg)
+	}
+
+	return scores[0].Rule, scores[0].Confidence, nil
+}
+
+// intentTerm is the search term a classified message runs its rule with. The
+// rule's first search term is used when it has one, so that its sub-terms can
+// find the rule again, otherwise rules with only examples use the message
+func (r *Rule) intentTerm(msg string) string {
+	if len(r.SearchTerms) > 0 {
+		return r.SearchTerms[0]
+	}
+	return msg
+}
+
+// The ways a message, sent when there's no interaction in progress, can be
+// handled before falling back to a suggestion or the default response
+const (
+	routeNone = iota
+	routeSearchTerm
+	routeHelp
+	routeIntent
+)
+
+// messageRoute is how a message will be handled, and the rule (and term) it
+// will run, if any
+type messageRoute struct {
+	Kind       int
+	Rule       *Rule
+	Term       string
+	Confidence float64
+}
+
+// routeMessage works out how a lowercased message is handled, in the order
+// the bot checks: a rule's search terms, then the help terms, then the intent
+// classifier. Both the bot and ClassifyText use it, so they always agree
+func (r *RuleSet) routeMessage(msg string) messageRoute {
+	if rule, term, err := r.findRuleByMessage(msg); err == nil {
+		return messageRoute{Kind: routeSearchTerm, Rule: rule, Term: term}
+	}
+
+	for _, term := range r.helpTerms() {
+		if strings.Contains(msg, term) {
+			return messageRoute{Kind: routeHelp, Term: term}
+		}
+	}
+
+	if rule, confidence, err := r.classifyRule(msg); err == nil {
+		return messageRoute{Kind: routeIntent, Rule: rule, Term: rule.intentTerm(msg), Confidence: confidence}
+	}
+
+	return messageRoute{Kind: routeNone}
+}
+
+// ClassifyText shows which rule would fire for a message, and how confident
+// the intent classifier is about each rule. This is used to debug rules
+func ClassifyText(cfg *BotConfig, text string) error {
+	rules, err := parseRuleFile(cfg.RulesFileLocation)
+	if err != nil {
+		return err
+	}
+
+	msg := strings.ToLower(text)
+
+	fmt.Printf("Message: %s\n", text)
+	fmt.Printf("Tokens: %s\n", strings.Join(intentTokens(msg), " "))
+
+	fmt.Println("Intent scores:")
+	scores := rules.classifier.classify(msg)
+	if len(scores) == 0 {
+		fmt.Println("\tNo known words, the classifier can't score this message")
+	}
+	for _, score := range scores {
+		fmt.Printf("\t%.3f %s\n", score.Confidence, score.Rule.title())
+	}
+
+	route := rules.routeMessage(msg)
+	switch route.Kind {
+	case routeSearchTerm:
+		fmt.Printf("Would fire: %s (search term '%s')\n", route.Rule.title(), route.Term)
+	case routeHelp:
+		fmt.Printf("Would fire: the help (help term '%s')\n", route.Term)
+	case routeIntent:
+		fmt.Printf("Would fire: %s (intent, confidence %.3f >= %.3f)\n", route.Rule.title(), route.Confidence, rules.intentThreshold())
+	default:
+		fmt.Printf("Would fire: no rule (below the threshold of %.3f), go209 falls back to a suggestion or the default response\n", rules.intentThreshold())
+	}
+	return nil
+}
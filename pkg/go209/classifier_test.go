@@ -0,0 +1,183 @@
+package go209
+
+import "testing"
+
+func TestStem(t *testing.T) {
+	tests := []struct {
+		word string
+		want string
+	}{
+		{"expense", "expense"},
+		{"expenses", "expense"},
+		{"leave", "leave"},
+		{"leaves", "leave"},
+		{"topping", "top"},
+		{"toppings", "top"},
+		{"question", "question"},
+		{"questions", "question"},
+		{"questioning", "question"},
+		{"questioned", "question"},
+		{"address", "address"},
+		{"addresses", "address"},
+		{"policy", "polici"},
+		{"policies", "polici"},
+		{"holiday", "holidai"},
+		{"holidays", "holidai"},
+		{"filing", "file"},
+		{"file", "file"},
+		{"agreed", "agree"},
+		{"feed", "feed"},
+		{"hopping", "hop"},
+		{"falling", "fall"},
+		{"organization", "organize"},
+		{"happiness", "happi"},
+		{"is", "is"},
+	}
+
+	for _, test := range tests {
+		if got := stem(test.word); got != test.want {
+			t.Errorf("stem(%q) = %q, want %q", test.word, got, test.want)
+		}
+	}
+}
+
+func TestClassifyRule(t *testing.T) {
+	// single words don't give the classifier much to go on, so the threshold
+	// is lower than the default
+	rules := &RuleSet{
+		IntentThreshold: 0.5,
+		Rules: []Rule{
+			{
+				Name:        "expenses",
+				SearchTerms: []string{"expenses"},
+				Examples:    []string{"I need to claim an expense", "how do I get my receipts paid back"},
+			},
+			{
+				Name:        "leave",
+				SearchTerms: []string{"leave"},
+				Examples:    []string{"I want to book some holidays", "taking annual leave next week"},
+			},
+			{
+				Name:        "pizza",
+				SearchTerms: []string{"pizza"},
+				Examples:    []string{"order a pizza with extra toppings"},
+			},
+		},
+	}
+	rules.classifier = newIntentClassifier(rules.Rules)
+
+	tests := []struct {
+		msg  string
+		want string
+	}{
+		{"expense", "expenses"},
+		{"claiming expenses", "expenses"},
+		{"leaves", "leave"},
+		{"booking a holiday", "leave"},
+		{"topping", "pizza"},
+		{"ordering pizzas", "pizza"},
+		{"something else entirely", ""},
+	}
+
+	for _, test := range tests {
+		rule, confidence, err := rules.classifyRule(test.msg)
+		if len(test.want) == 0 {
+			if err == nil {
+				t.Errorf("classifyRule(%q) = %s (%.3f), want no rule", test.msg, rule.title(), confidence)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("classifyRule(%q) returned an error: %s", test.msg, err)
+			continue
+		}
+		if rule.title() != test.want {
+			t.Errorf("classifyRule(%q) = %s (%.3f), want %s", test.msg, rule.title(), confidence, test.want)
+		}
+	}
+}
+
+func TestClassifyExamplesOnlyRule(t *testing.T) {
+	rules := &RuleSet{
+		IntentThreshold: 0.5,
+		Rules: []Rule{
+			{
+				Name:        "expenses",
+				SearchTerms: []string{"expenses"},
+				Examples:    []string{"I need to claim an expense"},
+			},
+			{
+				Name:     "laptop",
+				Examples: []string{"my laptop is broken", "the screen on my laptop cracked"},
+			},
+		},
+	}
+	rules.classifier = newIntentClassifier(rules.Rules)
+
+	msg := "broken laptop screen"
+	rule, confidence, err := rules.classifyRule(msg)
+	if err != nil {
+		t.Fatalf("classifyRule(%q) returned an error: %s", msg, err)
+	}
+	if rule.title() != "laptop" {
+		t.Fatalf("classifyRule(%q) = %s (%.3f), want laptop", msg, rule.title(), confidence)
+	}
+	if term := rule.intentTerm(msg); term != msg {
+		t.Errorf("intentTerm(%q) = %q, want the message", msg, term)
+	}
+
+	if term := rules.Rules[0].intentTerm("claiming"); term != "expenses" {
+		t.Errorf("intentTerm(%q) = %q, want expenses", "claiming", term)
+	}
+}
+
+func TestRouteMessage(t *testing.T) {
+	rules := &RuleSet{
+		IntentThreshold: 0.5,
+		Rules: []Rule{
+			{
+				Name:        "expenses",
+				SearchTerms: []string{"expenses"},
+				Examples:    []string{"I need help to claim an expense", "get my receipts paid back"},
+			},
+			{
+				Name:        "secret",
+				SearchTerms: []string{"secret"},
+				Examples:    []string{"reset the admin password"},
+				Hidden:      true,
+			},
+		},
+	}
+	rules.classifier = newIntentClassifier(rules.Rules)
+
+	tests := []struct {
+		msg  string
+		kind int
+		rule string
+		term string
+	}{
+		{"my expenses", routeSearchTerm, "expenses", "expenses"},
+		{"help with an expense", routeHelp, "", "help"},
+		{"claiming an expense", routeIntent, "expenses", "expenses"},
+		{"secret please", routeSearchTerm, "secret", "secret"},
+		{"admin password reset", routeNone, "", ""},
+		{"something else entirely", routeNone, "", ""},
+	}
+
+	for _, test := range tests {
+		route := rules.routeMessage(test.msg)
+		if route.Kind != test.kind || route.Term != test.term {
+			t.Errorf("routeMessage(%q) = %d/%q, want %d/%q", test.msg, route.Kind, route.Term, test.kind, test.term)
+			continue
+		}
+		if len(test.rule) > 0 && (route.Rule == nil || route.Rule.title() != test.rule) {
+			t.Errorf("routeMessage(%q) ran %v, want %s", test.msg, route.Rule, test.rule)
+		}
+	}
+
+	for _, score := range rules.classifier.classify("admin password reset") {
+		if score.Rule.Hidden {
+			t.Errorf("hidden rule %s was scored", score.Rule.title())
+		}
+	}
+}
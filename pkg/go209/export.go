@@ -0,0 +1,247 @@
+package go209
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// The formats submissions can be exported in
+const (
+	ExportCSV   = "csv"
+	ExportJSON  = "json"
+	ExportJSONL = "jsonl"
+)
+
+// exportDateFormat is the short date format accepted by --since
+const exportDateFormat = "2006-01-02"
+
+// ExportOptions selects which submissions are exported, and how
+type ExportOptions struct {
+	Rule   string
+	Since  string
+	Status string
+	Format string
+}
+
+// exportColumn is an interaction which gets its own column in an export
+type exportColumn struct {
+	InteractionID string
+	Header        string
+}
+
+// exportRow is a single submission, flattened for export. Answers are keyed
+// by interaction_id, with a missing (skipped) interaction set to nil
+type exportRow struct {
+	ID         string                 `json:"id"`
+	Rule       string                 `json:"rule"`
+	UserID     string                 `json:"userid"`
+	Username   string                 `json:"username"`
+	Status     string                 `json:"status"`
+	StartedAt  string                 `json:"started_at"`
+	FinishedAt string                 `json:"finished_at"`
+	Answers    map[string]interface{} `json:"answers"`
+}
+
+// parseSince parses a --since date, either 2006-01-02 or RFC3339
+func parseSince(since string) (time.Time, error) {
+	if len(since) == 0 {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(exportDateFormat, since); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Couldn't parse date '%s', use YYYY-MM-DD or RFC3339", since)
+	}
+	return t, nil
+}
+
+// formatExportTime formats a time for export, leaving unknown times blank
+func formatExportTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// exportColumns works out the interaction columns for a set of submissions.
+// The interactions of the rules, as defined in the rules file, come first, in
+// order. Then any answers to interactions which are no longer in the rules
+// file. Headers use the question text, or the interaction_id if there isn't one
+func exportColumns(rules *RuleSet, subs []*Submission) []exportColumn {
+	var columns []exportColumn
+	seen := make(map[string]bool)
+
+	add := func(id, question string) {
+		if seen[id] {
+			return
+		}
+		seen[id] = true
+		header := question
+		if len(header) == 0 {
+			header = id
+		}
+		columns = append(columns, exportColumn{InteractionID: id, Header: header})
+	}
+
+	seenRules := make(map[string]bool)
+	for _, sub := range subs {
+		if seenRules[sub.Rule] {
+			continue
+		}
+		seenRules[sub.Rule] = true
+
+		rule, err := rules.findRuleByName(sub.Rule)
+		if err != nil {
+			continue
+		}
+		for _, interaction := range rule.Interactions {
+			// finaltext interactions don't ask anything
+			if interaction.Type != "finaltext" {
+				add(interaction.InteractionID, interaction.Question)
+			}
+		}
+	}
+
+	for _, sub := range subs {
+		for _, answer := range sub.Answers {
+			add(answer.InteractionID, answer.Question)
+		}
+	}
+
+	return columns
+}
+
+// newExportRow flattens a submission into a row
+func newExportRow(sub *Submission, columns []exportColumn) exportRow {
+	row := exportRow{
+		ID:         sub.ID,
+		Rule:       sub.Rule,
+		UserID:     sub.UserID,
+		Username:   sub.Username,
+		Status:     sub.Status,
+		StartedAt:  formatExportTime(sub.StartedAt),
+		FinishedAt: formatExportTime(sub.FinishedAt),
+		Answers:    make(map[string]interface{}),
+	}
+
+	for _, column := range columns {
+		answer, ok := sub.Answer(column.InteractionID)
+		switch {
+		case !ok:
+			row.Answers[column.InteractionID] = nil
+		case len(answer.Values) > 0:
+			row.Answers[column.InteractionID] = answer.Values
+		default:
+			row.Answers[column.InteractionID] = answer.Value
+		}
+	}
+
+	return row
+}
+
+// csvValue turns an answer into a CSV cell. Multiple values are separated by
+// semicolons, and skipped interactions are left empty
+func csvValue(v interface{}) string {
+	switch value := v.(type) {
+	case string:
+		return value
+	case []string:
+		return strings.Join(value, "; ")
+	}
+	return ""
+}
+
+// writeExportCSV writes the rows as CSV, with a header row
+func writeExportCSV(w io.Writer, rows []exportRow, columns []exportColumn) error {
+	cw := csv.NewWriter(w)
+
+	header := []string{"id", "rule", "userid", "username", "status", "started_at", "finished_at"}
+	for _, column := range columns {
+		header = append(header, column.Header)
+	}
+	err := cw.Write(header)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		record := []string{row.ID, row.Rule, row.UserID, row.Username, row.Status, row.StartedAt, row.FinishedAt}
+		for _, column := range columns {
+			record = append(record, csvValue(row.Answers[column.InteractionID]))
+		}
+		err = cw.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// ExportSubmissions writes the submissions matching opts to w, as a CSV with
+// a row per submission and a column per interaction, or as JSON or JSONL
+// objects with the answers keyed by interaction_id
+func ExportSubmissions(cfg *BotConfig, opts ExportOptions, w io.Writer) error {
+	switch opts.Format {
+	case "", ExportCSV, ExportJSON, ExportJSONL:
+	default:
+		return fmt.Errorf("Unknown export format: %s", opts.Format)
+	}
+
+	rules, err := parseRuleFile(cfg.RulesFileLocation)
+	if err != nil {
+		return err
+	}
+
+	since, err := parseSince(opts.Since)
+	if err != nil {
+		return err
+	}
+
+	// use the rule's title, so --rule can be any of its search terms too
+	ruleName := opts.Rule
+	if len(ruleName) > 0 {
+		if rule, err := rules.findRuleByName(ruleName); err == nil {
+			ruleName = rule.title()
+		}
+	}
+
+	store := readSubmissionStore(cfg)
+	defer store.Close()
+
+	subs, err := store.List(SubmissionFilter{Rule: ruleName, Status: opts.Status, Since: since})
+	if err != nil {
+		return err
+	}
+
+	columns := exportColumns(rules, subs)
+	rows := make([]exportRow, 0, len(subs))
+	for _, sub := range subs {
+		rows = append(rows, newExportRow(sub, columns))
+	}
+
+	switch opts.Format {
+	case ExportJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rows)
+	case ExportJSONL:
+		enc := json.NewEncoder(w)
+		for _, row := range rows {
+			err = enc.Encode(row)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return writeExportCSV(w, rows, columns)
+}
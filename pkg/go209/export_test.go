@@ -0,0 +1,144 @@
+package go209
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testExportConfig is a config which exports the fixture submissions
+func testExportConfig() *BotConfig {
+	return &BotConfig{
+		RulesFileLocation: filepath.Join("testdata", "export_rules.json"),
+		SubmissionsFile:   filepath.Join("testdata", "submissions.jsonl"),
+	}
+}
+
+func TestExportFilters(t *testing.T) {
+	cfg := testExportConfig()
+
+	tests := []struct {
+		name string
+		opts ExportOptions
+		want []string
+	}{
+		{"everything", ExportOptions{}, []string{"s1", "s2", "s3", "s4"}},
+		{"rule name", ExportOptions{Rule: "pizza SURVEY"}, []string{"s1", "s2", "s4"}},
+		{"rule search term", ExportOptions{Rule: "pizza"}, []string{"s1", "s2", "s4"}},
+		{"unknown rule", ExportOptions{Rule: "holidays"}, nil},
+		{"since date", ExportOptions{Since: "2026-02-01"}, []string{"s2", "s3", "s4"}},
+		{"since RFC3339", ExportOptions{Since: "2026-03-10T00:00:00Z"}, []string{"s4"}},
+		{"status", ExportOptions{Status: SubmissionCompleted}, []string{"s1", "s3", "s4"}},
+		{"everything at once", ExportOptions{Rule: "pizza", Status: SubmissionCompleted, Since: "2026-02-01"}, []string{"s4"}},
+	}
+
+	for _, test := range tests {
+		test.opts.Format = ExportJSONL
+		var buf bytes.Buffer
+		err := ExportSubmissions(cfg, test.opts, &buf)
+		if err != nil {
+			t.Errorf("%s: ExportSubmissions error: %s", test.name, err)
+			continue
+		}
+
+		var ids []string
+		dec := json.NewDecoder(&buf)
+		for dec.More() {
+			var row exportRow
+			err = dec.Decode(&row)
+			if err != nil {
+				t.Fatalf("%s: bad JSONL: %s", test.name, err)
+			}
+			ids = append(ids, row.ID)
+		}
+		if !reflect.DeepEqual(ids, test.want) {
+			t.Errorf("%s: exported %v, want %v", test.name, ids, test.want)
+		}
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	cfg := testExportConfig()
+
+	var buf bytes.Buffer
+	err := ExportSubmissions(cfg, ExportOptions{Rule: "pizza"}, &buf)
+	if err != nil {
+		t.Fatalf("ExportSubmissions error: %s", err)
+	}
+
+	// the interactions are in the order of the rule, whatever order they were
+	// answered in, and the finaltext interaction doesn't get a column
+	want := strings.Join([]string{
+		"id,rule,userid,username,status,started_at,finished_at,Topping?,How many slices?",
+		"s1,Pizza survey,U1,alice,completed,2026-01-05T10:00:00Z,2026-01-05T10:02:00Z,ham,2",
+		"s2,Pizza survey,U2,bob,cancelled,2026-02-10T09:00:00Z,2026-02-10T09:01:00Z,pepperoni,",
+		"s4,Pizza survey,U3,carol,completed,2026-03-15T12:00:00Z,2026-03-15T12:03:00Z,ham; pineapple,3",
+	}, "\n") + "\n"
+	if buf.String() != want {
+		t.Errorf("CSV =\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	// answers to interactions which are no longer in the rules file come last
+	buf.Reset()
+	err = ExportSubmissions(cfg, ExportOptions{Rule: "expenses", Format: ExportCSV}, &buf)
+	if err != nil {
+		t.Fatalf("ExportSubmissions error: %s", err)
+	}
+	header := strings.SplitN(buf.String(), "\n", 2)[0]
+	if !strings.HasSuffix(header, ",How much?,Old question") {
+		t.Errorf("CSV header = %q, want the old question last", header)
+	}
+}
+
+func TestExportJSON(t *testing.T) {
+	cfg := testExportConfig()
+
+	var buf bytes.Buffer
+	err := ExportSubmissions(cfg, ExportOptions{Rule: "pizza", Format: ExportJSON}, &buf)
+	if err != nil {
+		t.Fatalf("ExportSubmissions error: %s", err)
+	}
+
+	var rows []map[string]interface{}
+	err = json.Unmarshal(buf.Bytes(), &rows)
+	if err != nil {
+		t.Fatalf("bad JSON: %s\n%s", err, buf.String())
+	}
+	if len(rows) != 3 {
+		t.Fatalf("exported %d rows, want 3", len(rows))
+	}
+
+	want := []map[string]interface{}{
+		{"p1": "ham", "p2": "2"},
+		{"p1": "pepperoni", "p2": nil},
+		{"p1": []interface{}{"ham", "pineapple"}, "p2": "3"},
+	}
+	for i, row := range rows {
+		if !reflect.DeepEqual(row["answers"], want[i]) {
+			t.Errorf("row %d answers = %v, want %v", i, row["answers"], want[i])
+		}
+	}
+}
+
+func TestExportErrors(t *testing.T) {
+	cfg := testExportConfig()
+
+	tests := []struct {
+		opts    ExportOptions
+		wantErr string
+	}{
+		{ExportOptions{Format: "xml"}, "Unknown export format"},
+		{ExportOptions{Since: "last week"}, "Couldn't parse date"},
+	}
+
+	for _, test := range tests {
+		err := ExportSubmissions(cfg, test.opts, ioutil.Discard)
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("ExportSubmissions(%+v) = %v, want %q", test.opts, err, test.wantErr)
+		}
+	}
+}
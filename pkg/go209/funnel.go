@@ -0,0 +1,383 @@
+package go209
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The events recorded against each interaction, which make up the funnel
+const (
+	FunnelStarted   = "started"
+	FunnelEntered   = "entered"
+	FunnelAnswered  = "answered"
+	FunnelCompleted = "completed"
+	FunnelCancelled = "cancelled"
+	FunnelExpired   = "expired"
+)
+
+// funnelEvents are all the funnel events, in the order they're reported
+var funnelEvents = []string{FunnelStarted, FunnelEntered, FunnelAnswered, FunnelCompleted, FunnelCancelled, FunnelExpired}
+
+// funnelKey is the state key the funnel counters are kept in. Each field is
+// <interaction_id>:<event>. Interaction IDs are unique across all the rules,
+// so the counters are grouped into rules when they're reported
+const funnelKey = "go209:funnel"
+
+// funnelSessionsKey is the sorted set of the sessions in progress, so we can
+// tell when one expires. Each member is a state key, scored by when its state
+// expires (as unix time)
+const funnelSessionsKey = "go209:sessions"
+
+// sessionGrace is how much longer a session's record is kept than its state,
+// so the sweeper has time to find it
+const sessionGrace = time.Hour
+
+// funnelSweepInterval is how often expired sessions are looked for
+const funnelSweepInterval = time.Minute
+
+// sessionKey is the state key a session in progress is tracked in, with the
+// interaction it's at and its on_expire jobs (see trackExpiry). It's kept
+// apart from the session's state, which is gone by the time we know the
+// session has expired
+func sessionKey(redKey string) string {
+	return fmt.Sprintf("go209:session:%s", redKey)
+}
+
+// recordFunnel counts a funnel event for an interaction. Errors are only
+// logged, analytics shouldn't get in the way of the user
+func recordFunnel(db StateStore, interactionID, event string) {
+	if len(interactionID) == 0 {
+		return
+	}
+
+	field := fmt.Sprintf("%s:%s", interactionID, event)
+	_, err := db.Incr(funnelKey, field, 1)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error recording funnel event %s: %s", field, err))
+	}
+}
+
+// claimSession starts tracking a session at its first interaction. If
+// maxSessions is more than 0 and that many other sessions are in progress,
+// it isn't tracked and errTooManySessions is returned. Any other error means
+// the session couldn't be tracked, so it shouldn't be started, as it wouldn't
+// count towards max_sessions, and its expiry wouldn't be noticed
+func claimSession(db StateStore, redKey, interactionID string, expires time.Time, maxSessions int) error {
+	// the state has gone, so a session still tracked for the same key has
+	// expired, and the sweeper hasn't found it yet
+	expireSession(db, redKey)
+
+	if maxSessions > 0 {
+		// the sessions are counted and claimed under a lock, so sessions
+		// starting at the same time can't both take the last place
+		unlock, err := lockState(db, funnelSessionsKey)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		// expired sessions which haven't been swept yet don't count
+		inProgress, err := db.ZCount(funnelSessionsKey, time.Now().Unix())
+		if err != nil {
+			return fmt.Errorf("Error counting sessions: %s", err)
+		}
+		if inProgress >= int64(maxSessions) {
+			return errTooManySessions
+		}
+	}
+
+	err := db.Set(sessionKey(redKey), map[string]string{"interaction": interactionID}, time.Until(expires)+sessionGrace)
+	if err != nil {
+		return fmt.Errorf("Error tracking session %s: %s", redKey, err)
+	}
+	err = db.ZAdd(funnelSessionsKey, redKey, expires.Unix())
+	if err != nil {
+		if err := db.Delete(sessionKey(redKey)); err != nil {
+			log.Warn(fmt.Sprintf("Error deleting session %s: %s", redKey, err))
+		}
+		return fmt.Errorf("Error tracking session %s: %s", redKey, err)
+	}
+	return nil
+}
+
+// moveSession moves a tracked session on to its next interaction
+func moveSession(db StateStore, redKey, interactionID string) {
+	err := db.Update(sessionKey(redKey), 0, func(fields map[string]string) (map[string]string, error) {
+		if len(fields) == 0 {
+			// it isn't tracked (it started before go209 was upgraded)
+			return nil, nil
+		}
+		fields["interaction"] = interactionID
+		return fields, nil
+	})
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error tracking session %s: %s", redKey, err))
+	}
+}
+
+// endSession stops tracking a session, throwing away its on_expire modules
+func endSession(db StateStore, redKey string) {
+	_, err := db.ZRem(funnelSessionsKey, redKey)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error ending session %s: %s", redKey, err))
+	}
+	err = db.Delete(sessionKey(redKey))
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error ending session %s: %s", redKey, err))
+	}
+}
+
+// expireSession counts an expired event for a tracked session, against the
+// interaction it was at, and queues its on_expire modules. The session is
+// claimed by removing it from the sorted set, so if more than one go209
+// process is sweeping, each expiry is only counted once. Nothing happens if
+// the session isn't tracked
+func expireSession(db StateStore, redKey string) {
+	claimed, err := db.ZRem(funnelSessionsKey, redKey)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error claiming expired session %s: %s", redKey, err))
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	session, err := db.Get(sessionKey(redKey))
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error fetching expired session %s: %s", redKey, err))
+		return
+	}
+	err = db.Delete(sessionKey(redKey))
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error deleting session %s: %s", redKey, err))
+	}
+
+	log.Debug(fmt.Sprintf("Session expired at interaction %s", session["interaction"]))
+	recordFunnel(db, session["interaction"], FunnelExpired)
+	runExpireHooks(db, redKey, session)
+}
+
+// sweepExpiredSessions expires each tracked session whose state has expired
+func sweepExpiredSessions(db StateStore) {
+	expired, err := db.ZRangeByScore(funnelSessionsKey, time.Now().Unix(), 0)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error sweeping expired sessions: %s", err))
+		return
+	}
+
+	for _, redKey := range expired {
+		expireSession(db, redKey)
+	}
+}
+
+// startFunnelSweeper looks for expired sessions every funnelSweepInterval,
+// until the returned func is called
+func startFunnelSweeper(db StateStore) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(funnelSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				sweepExpiredSessions(db)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// funnelStep is the funnel counters for a single interaction
+type funnelStep struct {
+	Interaction *Interaction
+	Counts      map[string]int
+}
+
+// ruleFunnel is the funnel for a single rule, with a step per interaction
+type ruleFunnel struct {
+	Rule  *Rule
+	Steps []funnelStep
+}
+
+// total adds up an event across all the steps
+func (f *ruleFunnel) total(event string) int {
+	total := 0
+	for _, step := range f.Steps {
+		total += step.Counts[event]
+	}
+	return total
+}
+
+// buildFunnels groups the funnel counters into rules, in the order of the
+// rules file. Rules without interactions (or without any counts) are left out
+func buildFunnels(db StateStore, rules *RuleSet, ruleName string) ([]ruleFunnel, error) {
+	counters, err := db.Get(funnelKey)
+	if err != nil {
+		return nil, fmt.Errorf("State error: %s", err)
+	}
+
+	var funnels []ruleFunnel
+	for i := range rules.Rules {
+		rule := &rules.Rules[i]
+		if len(ruleName) > 0 && !strings.EqualFold(rule.title(), ruleName) {
+			continue
+		}
+
+		funnel := ruleFunnel{Rule: rule}
+		for j := range rule.Interactions {
+			interaction := &rule.Interactions[j]
+			step := funnelStep{Interaction: interaction, Counts: make(map[string]int)}
+			for _, event := range funnelEvents {
+				step.Counts[event], _ = strconv.Atoi(counters[fmt.Sprintf("%s:%s", interaction.InteractionID, event)])
+			}
+			funnel.Steps = append(funnel.Steps, step)
+		}
+
+		if len(funnel.Steps) > 0 && funnel.total(FunnelEntered) > 0 {
+			funnels = append(funnels, funnel)
+		}
+	}
+
+	return funnels, nil
+}
+
+// percent returns part as a percentage of whole
+func percent(part, whole int) float64 {
+	if whole == 0 {
+		return 0
+	}
+	return float64(part) / float64(whole) * 100
+}
+
+// writeFunnels writes the funnels as a report. For each step, it shows how
+// many users got to it (as a percentage of those who started), how many
+// answered it, and how many dropped off there by cancelling or letting it
+// expire
+func writeFunnels(w io.Writer, funnels []ruleFunnel) {
+	if len(funnels) == 0 {
+		fmt.Fprintln(w, "No funnel data yet")
+		return
+	}
+
+	for i, funnel := range funnels {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+
+		started := funnel.total(FunnelStarted)
+		completed := funnel.total(FunnelCompleted)
+		fmt.Fprintf(w, "%s: %d started, %d completed (%.0f%%)\n", funnel.Rule.title(), started, completed, percent(completed, started))
+
+		for _, step := range funnel.Steps {
+			if step.Interaction.Type == "finaltext" {
+				continue
+			}
+			entered := step.Counts[FunnelEntered]
+			dropped := step.Counts[FunnelCancelled] + step.Counts[FunnelExpired]
+			fmt.Fprintf(w, "  %-10s reached %4d (%3.0f%%)  answered %4d  cancelled %4d  expired %4d  dropped off %3.0f%%\n",
+				step.Interaction.InteractionID, entered, percent(entered, started), step.Counts[FunnelAnswered],
+				step.Counts[FunnelCancelled], step.Counts[FunnelExpired], percent(dropped, entered))
+		}
+	}
+}
+
+// FunnelReport writes the funnel for each rule (or just the one) to w
+func FunnelReport(cfg *BotConfig, ruleName string, w io.Writer) error {
+	rules, err := parseRuleFile(cfg.RulesFileLocation)
+	if err != nil {
+		return err
+	}
+
+	if len(ruleName) > 0 {
+		rule, err := rules.findRuleByName(ruleName)
+		if err != nil {
+			return err
+		}
+		ruleName = rule.title()
+	}
+
+	db, err := NewStateStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// count anything which has expired since go209 last looked
+	sweepExpiredSessions(db)
+
+	funnels, err := buildFunnels(db, rules, ruleName)
+	if err != nil {
+		return err
+	}
+
+	writeFunnels(w, funnels)
+	return nil
+}
+
+// prometheusLabel escapes a Prometheus label value
+func prometheusLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// metricsHandler exposes the funnel counters, how many sessions are in
+// progress and the module run counters, in the Prometheus text format
+func metricsHandler(db StateStore, rules *RuleSet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		funnels, err := buildFunnels(db, rules, "")
+		if err != nil {
+			log.Warn(err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		sessions, err := db.ZCount(funnelSessionsKey, time.Now().Unix())
+		if err != nil {
+			log.Warn(fmt.Sprintf("State error: %s", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		moduleStats, err := buildModuleStats(db)
+		if err != nil {
+			log.Warn(err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.WriteHeader(http.StatusOK)
+
+		fmt.Fprintln(w, "# HELP go209_funnel_events_total Funnel events for each interaction.")
+		fmt.Fprintln(w, "# TYPE go209_funnel_events_total counter")
+		for _, funnel := range funnels {
+			for _, step := range funnel.Steps {
+				events := make([]string, 0, len(step.Counts))
+				for event := range step.Counts {
+					events = append(events, event)
+				}
+				sort.Strings(events)
+				for _, event := range events {
+					fmt.Fprintf(w, "go209_funnel_events_total{rule=\"%s\",interaction=\"%s\",event=\"%s\"} %d\n",
+						prometheusLabel(funnel.Rule.title()), prometheusLabel(step.Interaction.InteractionID), event, step.Counts[event])
+				}
+			}
+		}
+
+		fmt.Fprintln(w, "# HELP go209_sessions_in_progress Sessions which are part way through a set of interactions.")
+		fmt.Fprintln(w, "# TYPE go209_sessions_in_progress gauge")
+		fmt.Fprintf(w, "go209_sessions_in_progress %d\n", sessions)
+
+		writeModuleMetrics(w, moduleStats)
+	})
+}
@@ -0,0 +1,128 @@
+package go209
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRecordFunnelConcurrent(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+
+	for name, db := range stores {
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				recordFunnel(db, "q1", FunnelEntered)
+			}()
+		}
+		wg.Wait()
+
+		counters, _ := db.Get(funnelKey)
+		if counters["q1:entered"] != "50" {
+			t.Errorf("%s: 50 events were counted as %s", name, counters["q1:entered"])
+		}
+	}
+}
+
+func TestMaxSessions(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+
+	first := &Interaction{InteractionID: "q1", Type: "text"}
+
+	for name, db := range stores {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		started := 0
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, err := newState(db, fmt.Sprintf("T:D%d", i), "U", "u", "", "", 3, first)
+				if err == errTooManySessions {
+					return
+				}
+				if err != nil {
+					t.Errorf("%s: newState: %s", name, err)
+					return
+				}
+				mu.Lock()
+				started++
+				mu.Unlock()
+			}(i)
+		}
+		wg.Wait()
+
+		if started != 3 {
+			t.Errorf("%s: %d sessions started with max_sessions 3", name, started)
+		}
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+
+	first := &Interaction{InteractionID: "q1", Type: "text", NextInteraction: "q2"}
+	second := &Interaction{InteractionID: "q2", Type: "text"}
+
+	for name, db := range stores {
+		val, err := newState(db, "T:D1", "U", "u", "", "", 0, first)
+		if err != nil {
+			t.Fatalf("%s: newState: %s", name, err)
+		}
+		_, _, err = advanceState(db, "T:D1", "q1", val["version"], []string{"yes"}, second)
+		if err != nil {
+			t.Fatalf("%s: advanceState: %s", name, err)
+		}
+
+		// a finished session isn't tracked any more
+		val, _ = newState(db, "T:D2", "U", "u", "", "", 0, first)
+		advanceState(db, "T:D2", "q1", val["version"], []string{"yes"}, nil)
+
+		if n, _ := db.ZCount(funnelSessionsKey, time.Now().Unix()); n != 1 {
+			t.Errorf("%s: %d sessions in progress, want 1", name, n)
+		}
+
+		// nothing has expired yet
+		sweepExpiredSessions(db)
+		if counters, _ := db.Get(funnelKey); counters["q2:expired"] != "" {
+			t.Errorf("%s: session expired early", name)
+		}
+
+		// expire it, and sweep twice, as two processes would
+		db.Delete("T:D1")
+		db.ZAdd(funnelSessionsKey, "T:D1", 1)
+		sweepExpiredSessions(db)
+		sweepExpiredSessions(db)
+
+		counters, _ := db.Get(funnelKey)
+		if counters["q2:expired"] != "1" || counters["q1:expired"] != "" {
+			t.Errorf("%s: expired counters = %v, want q2:expired 1", name, counters)
+		}
+		if session, _ := db.Get(sessionKey("T:D1")); len(session) != 0 {
+			t.Errorf("%s: session record left after it expired: %v", name, session)
+		}
+		if n, _ := db.ZCount(funnelSessionsKey, 0); n != 0 {
+			t.Errorf("%s: %d sessions still tracked", name, n)
+		}
+
+		// a session the sweeper hasn't found yet is expired when the user
+		// starts again
+		val, _ = newState(db, "T:D3", "U", "u", "", "", 0, first)
+		db.Delete("T:D3")
+		db.ZAdd(funnelSessionsKey, "T:D3", 1)
+		if _, err := newState(db, "T:D3", "U", "u", "", "", 0, first); err != nil {
+			t.Fatalf("%s: newState: %s", name, err)
+		}
+		counters, _ = db.Get(funnelKey)
+		if counters["q1:expired"] != "1" {
+			t.Errorf("%s: replaced session wasn't counted as expired: %v", name, counters)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package go209
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/nlopes/slack"
+	log "github.com/sirupsen/logrus"
+)
+
+// SlackViewsPublishURL is the Slack API method used to publish the App Home tab
+const SlackViewsPublishURL = "https://slack.com/api/views.publish"
+
+// The action_ids of the buttons on the App Home tab
+const (
+	homeActionStart  = "go209_start"
+	homeActionResume = "go209_resume"
+	homeActionCancel = "go209_cancel"
+)
+
+// homeText is a Block Kit text object
+type homeText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// homeElement is a Block Kit button element
+type homeElement struct {
+	Type     string    `json:"type"`
+	Text     *homeText `json:"text,omitempty"`
+	ActionID string    `json:"action_id,omitempty"`
+	Value    string    `json:"value,omitempty"`
+	Style    string    `json:"style,omitempty"`
+}
+
+// homeBlock is a Block Kit layout block, only the fields we need for the
+// App Home tab are included
+type homeBlock struct {
+	Type      string        `json:"type"`
+	Text      *homeText     `json:"text,omitempty"`
+	Accessory *homeElement  `json:"accessory,omitempty"`
+	Elements  []homeElement `json:"elements,omitempty"`
+}
+
+// homeView is the App Home tab view we publish to slack
+type homeView struct {
+	Type   string      `json:"type"`
+	Blocks []homeBlock `json:"blocks"`
+}
+
+// myEventCallback is the subset of the Events API payload we handle
+type myEventCallback struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	TeamID    string `json:"team_id"`
+	Event     struct {
+		Type string `json:"type"`
+		User string `json:"user"`
+		Tab  string `json:"tab"`
+	} `json:"event"`
+}
+
+// myBlockActionCallback is the payload slack sends when a Block Kit button,
+// such as those on the App Home tab, is clicked
+type myBlockActionCallback struct {
+	Type    string     `json:"type"`
+	Team    slack.Team `json:"team"`
+	User    slack.User `json:"user"`
+	Actions []struct {
+		ActionID string `json:"action_id"`
+		Value    string `json:"value"`
+	} `json:"actions"`
+}
+
+// newHomeButton creates a Block Kit button
+func newHomeButton(text, actionID, value, style string) homeElement {
+	return homeElement{
+		Type:     "button",
+		Text:     &homeText{Type: "plain_text", Text: text},
+		ActionID: actionID,
+		Value:    value,
+		Style:    style,
+	}
+}
+
+// newHomeSection creates a Block Kit section with markdown text
+func newHomeSection(text string) homeBlock {
+	return homeBlock{
+		Type: "section",
+		Text: &homeText{Type: "mrkdwn", Text: text},
+	}
+}
+
+// buildHomeView builds the App Home tab, listing the visible rules which have
+// descriptions and the user is permitted to use, and the user's in-progress
+// interaction (if there is one)
+func buildHomeView(rules *RuleSet, dir slackDirectory, team, user string, val map[string]string) homeView {
+	view := homeView{Type: "home"}
+
+	view.Blocks = append(view.Blocks, newHomeSection("*Here's what I can help you with*"))
+	for _, rule := range rules.Rules {
+		if len(rule.Description) == 0 || rule.Hidden || !rules.permitted(dir, &rule, team, user) {
+			continue
+		}
+
+		block := newHomeSection(fmt.Sprintf("*%s*\n%s", rule.title(), rule.Description))
+		if len(rule.Interactions) > 0 && len(rule.InteractionStart) > 0 {
+			button := newHomeButton("Start", homeActionStart, rule.title(), "primary")
+			block.Accessory = &button
+		}
+		view.Blocks = append(view.Blocks, block)
+	}
+
+	view.Blocks = append(view.Blocks, homeBlock{Type: "divider"})
+
+	if len(val["interaction"]) == 0 {
+		view.Blocks = append(view.Blocks, newHomeSection("You don't have anything in progress with me"))
+		return view
+	}
+
+	title := val["interaction"]
+	if rule, err := rules.findRuleByID(val["interaction"]); err == nil {
+		title = rule.title()
+	}
+	text := fmt.Sprintf("*You're in the middle of:* %s", title)
+	if interaction, err := rules.findInteractionByID(val["interaction"]); err == nil && len(interaction.Question) > 0 {
+		text = fmt.Sprintf("%s\n> %s", text, interaction.Question)
+	}
+
+	view.Blocks = append(view.Blocks, newHomeSection(text))
+	view.Blocks = append(view.Blocks, homeBlock{
+		Type: "actions",
+		Elements: []homeElement{
+			newHomeButton("Resume", homeActionResume, val["interaction"], "primary"),
+			newHomeButton("Cancel", homeActionCancel, homeCancelValue(val), "danger"),
+		},
+	})
+
+	return view
+}
+
+// homeCancelValue is the value of the Cancel button, the interaction and
+// version the state was at when the view was built. If the state has moved on
+// by the time it's clicked, it's out of date and nothing is cancelled
+func homeCancelValue(val map[string]string) string {
+	return fmt.Sprintf("%s:%s", val["interaction"], val["version"])
+}
+
+// parseHomeCancelValue splits the Cancel button's value into the interaction
+// and version. interaction_ids can have a ':' in them, versions can't. A
+// value without a version is never current, so it returns errStaleState
+func parseHomeCancelValue(value string) (string, string, error) {
+	i := strings.LastIndex(value, ":")
+	if i < 0 || i == len(value)-1 {
+		return "", "", errStaleState
+	}
+	return value[:i], value[i+1:], nil
+}
+
+// publishHomeView publishes a view to a user's App Home tab. Our version of
+// the slack library doesn't support views.publish, so we call it directly
+func publishHomeView(token, user string, view homeView) error {
+	body, err := json.Marshal(struct {
+		UserID string   `json:"user_id"`
+		View   homeView `json:"view"`
+	}{user, view})
+	if err != nil {
+		return fmt.Errorf("Error marshalling json: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	req, err := http.NewRequest("POST", SlackViewsPublishURL, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	req = req.WithContext(ctx)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result slack.SlackResponse
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return fmt.Errorf("Error decoding json: %s", err)
+	}
+	if !result.Ok {
+		return fmt.Errorf("Error publishing view: %s", result.Error)
+	}
+
+	return nil
+}
+
+// refreshHome re-publishes a user's App Home tab with their current state
+func refreshHome(cfg *BotConfig, api *slack.Client, db StateStore, rules *RuleSet, team, user string) error {
+	_, _, channel, err := api.OpenIMChannel(user)
+	if err != nil {
+		return fmt.Errorf("Error opening DM with %s: %s", user, err)
+	}
+
+	val, err := db.Get(fmt.Sprintf("%s:%s", team, channel))
+	if err != nil {
+		return fmt.Errorf("State error: %s", err)
+	}
+
+	return publishHomeView(cfg.SlackToken, user, buildHomeView(rules, api, team, user, val))
+}
+
+// handleHomeAction handles the buttons clicked on the App Home tab
+func handleHomeAction(cfg *BotConfig, api *slack.Client, db StateStore, subs SubmissionStore, rules *RuleSet, re *regexp.Regexp, cb *myBlockActionCallback) {
+	if len(cb.Actions) == 0 {
+		return
+	}
+	action := cb.Actions[0]
+	team := cb.Team.ID
+	user := cb.User.ID
+
+	_, _, channel, err := api.OpenIMChannel(user)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error opening DM with %s: %s", user, err))
+		return
+	}
+	redKey := fmt.Sprintf("%s:%s", team, channel)
+
+	switch action.ActionID {
+	case homeActionStart:
+		rule, err := rules.findRuleByTitle(action.Value)
+		if err != nil {
+			log.Warn(fmt.Sprintf("App Home error: %s", err))
+			return
+		}
+
+		err = startRuleInDM(api, db, subs, rules, rule, team, user, cb.User.Name, "", re)
+		if err == errInteractionInProgress {
+			api.PostMessage(channel, slack.MsgOptionText("You're already in the middle of something with me, finish that first (or send me the stop word)", false))
+		} else if err != nil {
+			log.Warn(fmt.Sprintf("Error starting interaction: %s", err))
+			return
+		} else {
+			log.Info(fmt.Sprintf("Initiating interaction from App Home '%s' to %s", action.Value, user))
+		}
+
+	case homeActionResume:
+		unlock, err := lockState(db, redKey)
+		if err != nil {
+			log.Warn(err.Error())
+			return
+		}
+		defer unlock()
+
+		val, err := db.Get(redKey)
+		if err != nil {
+			log.Warn(fmt.Sprintf("State error: %s", err))
+			return
+		}
+
+		username := val["username"]
+		if isAnonymous(val) {
+			// anonymous rules don't keep the user in the state
+			username = cb.User.Name
+		}
+
+		interaction, err := rules.findInteractionByID(val["interaction"])
+		if err != nil {
+			log.Warn(fmt.Sprintf("App Home error: %s", err))
+		} else {
+			log.Info(fmt.Sprintf("User %s has resumed interaction %s", logUser(isAnonymous(val), username, user), val["interaction"]))
+			askInteraction(api, db, rules, team, channel, interaction, username, user, val["args"], re)
+		}
+
+	case homeActionCancel:
+		unlock, err := lockState(db, redKey)
+		if err != nil {
+			log.Warn(err.Error())
+			return
+		}
+		defer unlock()
+
+		interaction, version, err := parseHomeCancelValue(action.Value)
+		var val map[string]string
+		if err == nil {
+			val, err = endState(db, redKey, interaction, version, FunnelCancelled)
+		}
+		if err == errStaleState {
+			// the view was out of date, so it's refreshed instead
+			log.Info(fmt.Sprintf("Ignoring cancel of %s from an out of date App Home", action.Value))
+		} else if err != nil {
+			log.Warn(fmt.Sprintf("Error deleting state: %s", err))
+			return
+		}
+
+		if len(val) > 0 {
+			username := val["username"]
+			if isAnonymous(val) {
+				username = cb.User.Name
+			}
+
+			sub := recordSubmission(subs, rules, val, SubmissionCancelled)
+			log.Info(fmt.Sprintf("User %s has cancelled interaction %s, submission %s", logUser(isAnonymous(val), username, user), val["interaction"], sub.ID))
+			rules.runCancelHooks(db, val, sub, channel)
+			if len(rules.InteractionCancelledResponse) > 0 {
+				api.PostMessage(channel, slack.MsgOptionText(rules.renderTemplate(api, team, rules.InteractionCancelledResponse, username, user, val["args"], re), false))
+			} else {
+				api.PostMessage(channel, slack.MsgOptionText("Interaction cancelled", false))
+			}
+		}
+	}
+
+	err = refreshHome(cfg, api, db, rules, team, user)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error refreshing App Home: %s", err))
+	}
+}
+
+// eventsHandler handles the incoming Slack Events API requests. The only
+// event we're interested in is app_home_opened
+func eventsHandler(cfg *BotConfig, api *slack.Client, db StateStore, rules *RuleSet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !validSlackRequest(cfg, w, r) {
+			return
+		}
+
+		var eventcb myEventCallback
+		err := json.NewDecoder(r.Body).Decode(&eventcb)
+		if err != nil {
+			log.Warn(fmt.Sprintf("Error parsing JSON from slack event: %s", err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		switch eventcb.Type {
+		case "url_verification":
+			// slack checks the URL when it's configured
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(eventcb.Challenge))
+			return
+
+		case "event_callback":
+			// the response isn't sent until we return, and slack wants it
+			// within 3 seconds, so the home tab is published afterwards
+			if eventcb.Event.Type == "app_home_opened" && eventcb.Event.Tab == "home" {
+				log.Debug(fmt.Sprintf("App Home opened by %s", eventcb.Event.User))
+				go func() {
+					err := refreshHome(cfg, api, db, rules, eventcb.TeamID, eventcb.Event.User)
+					if err != nil {
+						log.Warn(fmt.Sprintf("Error publishing App Home: %s", err))
+					}
+				}()
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
@@ -0,0 +1,29 @@
+package go209
+
+import "testing"
+
+func TestHomeCancelValue(t *testing.T) {
+	tests := []struct {
+		val         map[string]string
+		interaction string
+		version     string
+	}{
+		{map[string]string{"interaction": "q1", "version": "3"}, "q1", "3"},
+		{map[string]string{"interaction": "survey:q1", "version": "12"}, "survey:q1", "12"},
+	}
+
+	for _, test := range tests {
+		value := homeCancelValue(test.val)
+		interaction, version, err := parseHomeCancelValue(value)
+		if err != nil || interaction != test.interaction || version != test.version {
+			t.Errorf("parseHomeCancelValue(%q) = %q, %q, %v, want %q, %q", value, interaction, version, err, test.interaction, test.version)
+		}
+	}
+
+	// without a version there's nothing to check, so it's always stale
+	for _, value := range []string{"q1", "q1:", ""} {
+		if _, _, err := parseHomeCancelValue(value); err != errStaleState {
+			t.Errorf("parseHomeCancelValue(%q) returned %v, want errStaleState", value, err)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package go209
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The points in a rule's interactions modules can be run at
+const (
+	HookStart  = "on_start"
+	HookAnswer = "on_answer"
+	HookCancel = "on_cancel"
+	HookExpire = "on_expire"
+	HookEnd    = "interaction_end_mods"
+)
+
+// DefaultAnswerRejectedResponse is sent when an on_answer module rejects an
+// answer without saying why
+const DefaultAnswerRejectedResponse = "Sorry, that answer wasn't accepted. Please try again"
+
+// sessionExpireField is the field of a session's record (see sessionKey) its
+// on_expire jobs are kept in, as JSON, to be queued if the session expires.
+// The state itself is gone by the time we know it's expired, so the jobs are
+// built at each step
+const sessionExpireField = "on_expire"
+
+// moduleState is the state modules are given, without the anonymous user's
+// hash
+func moduleState(val map[string]string) map[string]string {
+	state := make(map[string]string, len(val))
+	for k, v := range val {
+		state[k] = v
+	}
+	delete(state, "user_hash")
+	return state
+}
+
+// moduleLists is every list of modules the rule runs: its
+// interaction_end_mods, its hooks and each interaction's on_answer modules
+func (r *Rule) moduleLists() [][]EndMod {
+	lists := [][]EndMod{r.InteractionEndMods, r.OnStart, r.OnCancel, r.OnExpire}
+	for _, interaction := range r.Interactions {
+		lists = append(lists, interaction.OnAnswer)
+	}
+	return lists
+}
+
+// runStartHooks queues the rule's on_start modules, once the state for its
+// interactions has been saved
+func (r *RuleSet) runStartHooks(db StateStore, rule *Rule, val map[string]string, channel string) {
+	if len(rule.OnStart) == 0 {
+		return
+	}
+	sub := newSubmission(r, val, SubmissionInProgress)
+	enqueueJobs(db, newModuleJobs(rule, HookStart, rule.OnStart, val, sub, channel))
+}
+
+// runCancelHooks queues the on_cancel modules of the rule the cancelled state
+// was for
+func (r *RuleSet) runCancelHooks(db StateStore, val map[string]string, sub *Submission, channel string) {
+	rule, err := r.findRuleByID(val["interaction"])
+	if err != nil || len(rule.OnCancel) == 0 {
+		return
+	}
+	enqueueJobs(db, newModuleJobs(rule, HookCancel, rule.OnCancel, val, sub, channel))
+}
+
+// trackExpiry keeps the rule's on_expire jobs for the session, with the
+// answers it has so far, to be queued if the session expires
+func (r *RuleSet) trackExpiry(db StateStore, rule *Rule, redKey, channel string, val map[string]string) {
+	if len(rule.OnExpire) == 0 {
+		return
+	}
+
+	sub := newSubmission(r, val, SubmissionExpired)
+	jobs, err := json.Marshal(newModuleJobs(rule, HookExpire, rule.OnExpire, val, sub, channel))
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error marshalling json: %s", err))
+		return
+	}
+
+	err = db.Update(sessionKey(redKey), 0, func(fields map[string]string) (map[string]string, error) {
+		if len(fields) == 0 {
+			// the session isn't tracked, so its expiry won't be noticed
+			return nil, nil
+		}
+		fields[sessionExpireField] = string(jobs)
+		return fields, nil
+	})
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error tracking on_expire modules for %s: %s", redKey, err))
+	}
+}
+
+// runExpireHooks queues the on_expire modules kept in the record of a session
+// which has expired
+func runExpireHooks(db StateStore, redKey string, session map[string]string) {
+	value := session[sessionExpireField]
+	if len(value) == 0 {
+		return
+	}
+
+	var jobs []*Job
+	err := json.Unmarshal([]byte(value), &jobs)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error decoding on_expire modules for %s: %s", redKey, err))
+		return
+	}
+
+	now := time.Now().UTC()
+	for _, job := range jobs {
+		job.NextRunAt = now
+		job.Submission.FinishedAt = now
+	}
+	enqueueJobs(db, jobs)
+}
+
+// checkAnswer runs the interaction's on_answer modules with the user's answer,
+// before it's saved. If a module rejects it, the reason is returned with
+// false. Modules which fail (or time out) don't stop the answer being saved,
+// they're only logged. If maxTimeout is more than 0, no module is given longer
+// than that, for when slack is waiting on the answer
+func (r *RuleSet) checkAnswer(db StateStore, interaction *Interaction, val map[string]string, response []string, maxTimeout time.Duration) (string, bool) {
+	if len(interaction.OnAnswer) == 0 {
+		return "", true
+	}
+
+	rule, err := r.findRuleByID(interaction.InteractionID)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Couldn't find rule: %s", err))
+		return "", true
+	}
+
+	answer := &Answer{
+		InteractionID: interaction.InteractionID,
+		Question:      interaction.Question,
+		Type:          interaction.Type,
+		Value:         strings.Join(response, ", "),
+	}
+	if len(response) > 1 {
+		answer.Values = response
+	}
+
+	questions := make(map[string]string)
+	var interactions []string
+	for _, i := range rule.Interactions {
+		questions[i.InteractionID] = i.Question
+		interactions = append(interactions, i.InteractionID)
+	}
+	state := moduleState(val)
+	state[fmt.Sprintf("response:%s", interaction.InteractionID)] = answer.Value
+
+	for _, endMod := range interaction.OnAnswer {
+		in := &ModuleInput{
+			Hook:         HookAnswer,
+			Submission:   newSubmission(r, val, SubmissionInProgress),
+			Answer:       answer,
+			Interactions: interactions,
+			state:        state,
+			questions:    questions,
+		}
+
+		timeout := endMod.timeout
+		if timeout <= 0 {
+			timeout = r.moduleTimeout
+		}
+		if maxTimeout > 0 && (timeout <= 0 || timeout > maxTimeout) {
+			timeout = maxTimeout
+		}
+
+		result, err := callModule(db, endMod.Module, endMod.Config, timeout, in)
+		if err != nil {
+			log.Warn(fmt.Sprintf("Module %s couldn't check the answer to %s, accepting it: %s", endMod.Module, interaction.InteractionID, err))
+			continue
+		}
+		if result.Status == ModuleRejected {
+			log.Info(fmt.Sprintf("Module %s rejected the answer to %s", endMod.Module, interaction.InteractionID))
+			if len(result.Message) == 0 {
+				return DefaultAnswerRejectedResponse, false
+			}
+			return result.Message, false
+		}
+	}
+
+	return "", true
+}
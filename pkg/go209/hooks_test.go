@@ -0,0 +1,107 @@
+package go209
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// deadlineModule records how long it was given to run
+type deadlineModule struct {
+	given time.Duration
+}
+
+func (m *deadlineModule) Name() string {
+	return "DeadlineModule"
+}
+
+func (m *deadlineModule) EnvVars() []string {
+	return nil
+}
+
+func (m *deadlineModule) Run(ctx context.Context, in *ModuleInput) (*ModuleResult, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		m.given = time.Until(deadline)
+	}
+	return &ModuleResult{Status: ModuleOK}, nil
+}
+
+// writeRuleFile writes a rules file to a temporary directory, returning its
+// path and a func which removes it
+func writeRuleFile(t *testing.T, rules string) (string, func()) {
+	dir, err := ioutil.TempDir("", "go209")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "rules.json")
+	err = ioutil.WriteFile(path, []byte(rules), 0600)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestOnAnswerTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout string
+		ok      bool
+	}{
+		{"default", "", true},
+		{"short", `, "timeout": "1s"`, true},
+		{"at the limit", `, "timeout": "2s"`, true},
+		{"too long", `, "timeout": "10s"`, false},
+	}
+
+	for _, test := range tests {
+		path, cleanup := writeRuleFile(t, `{"rules": [{"terms": ["x"], "interaction_start": "a1", "interactions": [
+			{"interaction_id": "a1", "type": "attachment", "next_interaction": "end",
+			 "on_answer": [{"module": "DeadlineModule"`+test.timeout+`}]}]}]}`)
+		_, err := parseRuleFile(path)
+		cleanup()
+		if test.ok && err != nil {
+			t.Errorf("%s: parseRuleFile error: %s", test.name, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: parseRuleFile allowed an on_answer timeout over %s", test.name, WebModuleTimeout)
+		}
+	}
+}
+
+func TestCheckAnswerMaxTimeout(t *testing.T) {
+	saved := modules
+	defer func() { modules = saved }()
+	modules = LoadedModules{}
+	mod := &deadlineModule{}
+	RegisterV2(mod)
+
+	interaction := Interaction{InteractionID: "a1", Type: "text", OnAnswer: []EndMod{{Module: "DeadlineModule"}}}
+	rules := &RuleSet{
+		moduleTimeout: time.Minute,
+		Rules:         []Rule{{Name: "rule", Interactions: []Interaction{interaction}}},
+	}
+	db := newMemoryStore()
+	defer db.Close()
+
+	tests := []struct {
+		maxTimeout time.Duration
+		want       time.Duration
+	}{
+		{0, time.Minute},
+		{WebModuleTimeout, WebModuleTimeout},
+	}
+
+	for _, test := range tests {
+		_, ok := rules.checkAnswer(db, &interaction, map[string]string{"user": "U1"}, []string{"yes"}, test.maxTimeout)
+		if !ok {
+			t.Errorf("checkAnswer(%s) rejected the answer", test.maxTimeout)
+		}
+		if mod.given > test.want || mod.given < test.want-time.Second {
+			t.Errorf("checkAnswer(%s) gave the module %s, want %s", test.maxTimeout, mod.given, test.want)
+		}
+	}
+}
@@ -0,0 +1,586 @@
+package go209
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/nlopes/slack"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultJobWorkers is how many module runs are processed at once
+const DefaultJobWorkers = 2
+
+// MaxJobAttempts is how many times a module run is tried, before it's moved
+// to the dead-letter list
+const MaxJobAttempts = 5
+
+// jobsKey is the sorted set of queued jobs' IDs, scored by the unix time
+// they're next due (or their lease runs out, while they're running). Each job
+// is kept in its own state, see jobKey
+const jobsKey = "go209:jobs"
+
+// deadJobsKey is the sorted set of jobs which have run out of attempts, scored
+// by when they were given up on. They're kept until they're retried or
+// discarded with go209 jobs
+const deadJobsKey = "go209:jobs:dead"
+
+// jobField is the field of a job's state the job is kept in, as JSON
+const jobField = "job"
+
+// jobClaimBatch is how many due jobs a worker looks at when claiming one, in
+// case others claim them first
+const jobClaimBatch = 10
+
+// jobRetryBase is how long before a failed job is retried the first time,
+// this doubles with each attempt up to jobRetryMax
+const jobRetryBase = 30 * time.Second
+
+// jobRetryMax is the longest a failed job waits to be retried
+const jobRetryMax = time.Hour
+
+// jobLease is how long a worker has a job for, on top of the module's
+// timeout. If the worker dies, the job is picked up again once this has passed
+const jobLease = 5 * time.Minute
+
+// jobPollInterval is how often the workers look for due jobs
+const jobPollInterval = time.Second
+
+// Job is a module run for a completed set of interactions, with everything
+// needed to run it, so it survives restarts and changes to the rules. The
+// FailureResponse is the rule's module_failure_response, which is sent to the
+// user if the job is given up on
+type Job struct {
+	ID              string            `json:"id"`
+	Module          string            `json:"module"`
+	Hook            string            `json:"hook,omitempty"`
+	Config          json.RawMessage   `json:"config,omitempty"`
+	Channel         string            `json:"channel,omitempty"`
+	Timeout         time.Duration     `json:"timeout,omitempty"`
+	FailureResponse string            `json:"failure_response,omitempty"`
+	Submission      *Submission       `json:"submission"`
+	State           map[string]string `json:"state"`
+	Questions       map[string]string `json:"questions"`
+	Interactions    []string          `json:"interactions,omitempty"`
+	Attempts        int               `json:"attempts"`
+	LastError       string            `json:"last_error,omitempty"`
+	CreatedAt       time.Time         `json:"created_at"`
+	NextRunAt       time.Time         `json:"next_run_at"`
+	LeaseUntil      time.Time         `json:"lease_until,omitempty"`
+}
+
+// jobBackoff is how long to wait before retrying a job which has failed this
+// many times
+func jobBackoff(attempts int) time.Duration {
+	backoff := jobRetryBase
+	for i := 1; i < attempts && backoff < jobRetryMax; i++ {
+		backoff *= 2
+	}
+	if backoff > jobRetryMax {
+		backoff = jobRetryMax
+	}
+	return backoff
+}
+
+// jobKey is the state key a job is kept in
+func jobKey(id string) string {
+	return fmt.Sprintf("go209:job:%s", id)
+}
+
+// decodeJob decodes the job kept in a state, nil is returned if there isn't
+// one
+func decodeJob(fields map[string]string) (*Job, error) {
+	value, ok := fields[jobField]
+	if !ok {
+		return nil, nil
+	}
+	var job Job
+	err := json.Unmarshal([]byte(value), &job)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding job: %s", err)
+	}
+	return &job, nil
+}
+
+// encodeJob encodes a job into the fields of its state
+func encodeJob(job *Job) (map[string]string, error) {
+	value, err := json.Marshal(job)
+	if err != nil {
+		return nil, fmt.Errorf("Error marshalling json: %s", err)
+	}
+	return map[string]string{jobField: string(value)}, nil
+}
+
+// getJob gets a job by its ID, nil is returned if there isn't one
+func getJob(db StateStore, id string) (*Job, error) {
+	fields, err := db.Get(jobKey(id))
+	if err != nil {
+		return nil, fmt.Errorf("State error: %s", err)
+	}
+	return decodeJob(fields)
+}
+
+// putJob saves a job, and queues it to run at its NextRunAt
+func putJob(db StateStore, job *Job) error {
+	fields, err := encodeJob(job)
+	if err != nil {
+		return err
+	}
+	err = db.Set(jobKey(job.ID), fields, 0)
+	if err != nil {
+		return err
+	}
+	return db.ZAdd(jobsKey, job.ID, job.NextRunAt.Unix())
+}
+
+// removeJob takes a job out of the queue and the dead-letter list, and
+// deletes it. It returns false if it wasn't in either
+func removeJob(db StateStore, id string) (bool, error) {
+	queued, err := db.ZRem(jobsKey, id)
+	if err != nil {
+		return false, err
+	}
+	dead, err := db.ZRem(deadJobsKey, id)
+	if err != nil {
+		return false, err
+	}
+	return queued || dead, db.Delete(jobKey(id))
+}
+
+// listJobs gets the jobs in the queue or the dead-letter list, in the order
+// they're due (or were given up on)
+func listJobs(db StateStore, key string) ([]*Job, error) {
+	ids, err := db.ZRangeByScore(key, math.MaxInt64, 0)
+	if err != nil {
+		return nil, fmt.Errorf("State error: %s", err)
+	}
+
+	var jobs []*Job
+	for _, id := range ids {
+		job, err := getJob(db, id)
+		if err != nil {
+			log.Warn(fmt.Sprintf("Skipping bad job %s: %s", id, err))
+			continue
+		}
+		if job != nil {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, nil
+}
+
+// newModuleJobs builds a job for each of the modules, to run them at the
+// hook. The user's channel is kept so the modules' messages can be sent to
+// them, unless the rule is anonymous
+func newModuleJobs(rule *Rule, hook string, mods []EndMod, val map[string]string, sub *Submission, channel string) []*Job {
+	// Set the interactions
+	questions := make(map[string]string)
+	var interactions []string
+	for _, i := range rule.Interactions {
+		questions[i.InteractionID] = i.Question
+		interactions = append(interactions, i.InteractionID)
+	}
+
+	if isAnonymous(val) {
+		channel = ""
+	}
+
+	var jobs []*Job
+	for _, endMod := range mods {
+		now := time.Now().UTC()
+		jobs = append(jobs, &Job{
+			ID:              newSubmissionID(),
+			Module:          endMod.Module,
+			Hook:            hook,
+			Config:          endMod.Config,
+			Channel:         channel,
+			Timeout:         endMod.timeout,
+			FailureResponse: rule.ModuleFailureResponse,
+			Submission:      sub,
+			State:           moduleState(val),
+			Questions:       questions,
+			Interactions:    interactions,
+			CreatedAt:       now,
+			NextRunAt:       now,
+		})
+	}
+	return jobs
+}
+
+// enqueueJobs queues jobs to run
+func enqueueJobs(db StateStore, jobs []*Job) {
+	for _, job := range jobs {
+		err := putJob(db, job)
+		if err != nil {
+			log.Warn(fmt.Sprintf("Error queueing module %s for submission %s: %s", job.Module, job.Submission.ID, err))
+			continue
+		}
+		log.Debug(fmt.Sprintf("Queued module %s (%s) for submission %s, job %s", job.Module, job.hook(), job.Submission.ID, job.ID))
+	}
+}
+
+// enqueueEndMods queues a job for each of the rule's interaction_end_mods
+func enqueueEndMods(db StateStore, rule *Rule, finalval map[string]string, sub *Submission, channel string) {
+	if len(rule.InteractionEndMods) == 0 {
+		return
+	}
+	log.Debug(fmt.Sprintf("We found %d modules to run", len(rule.InteractionEndMods)))
+
+	enqueueJobs(db, newModuleJobs(rule, HookEnd, rule.InteractionEndMods, finalval, sub, channel))
+}
+
+// hook is when the job's module is run. Jobs queued before there were hooks
+// are all end mods
+func (j *Job) hook() string {
+	if len(j.Hook) == 0 {
+		return HookEnd
+	}
+	return j.Hook
+}
+
+// timeout is the job's deadline, either from the rule or the default
+func (j *Job) timeout(defaultTimeout time.Duration) time.Duration {
+	if j.Timeout > 0 {
+		return j.Timeout
+	}
+	if defaultTimeout > 0 {
+		return defaultTimeout
+	}
+	return DefaultModuleTimeout
+}
+
+// due returns true if the job should be run now
+func (j *Job) due(now time.Time) bool {
+	return !j.NextRunAt.After(now) && !j.LeaseUntil.After(now)
+}
+
+// leaseJob leases a job to this worker for long enough to run it, if it's
+// still due. nil is returned if someone else got to it first, or it's gone
+func leaseJob(db StateStore, id string, defaultTimeout time.Duration) (*Job, error) {
+	var leased *Job
+	err := db.Update(jobKey(id), 0, func(fields map[string]string) (map[string]string, error) {
+		leased = nil
+		job, err := decodeJob(fields)
+		if err != nil || job == nil {
+			return fields, err
+		}
+
+		now := time.Now()
+		if !job.due(now) {
+			return fields, nil
+		}
+		job.LeaseUntil = now.Add(job.timeout(defaultTimeout) + jobLease)
+		leased = job
+		return encodeJob(job)
+	})
+	if err == ErrStateConflict {
+		// another worker has just claimed it
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if leased == nil {
+		return nil, nil
+	}
+
+	// it's due again if the lease runs out, in case this worker dies
+	return leased, db.ZAdd(jobsKey, id, leased.LeaseUntil.Unix())
+}
+
+// claimJob takes the job which has been due the longest, leasing it to this
+// worker for long enough to run it. Only the due jobs are looked at, and only
+// the claimed one is changed. nil is returned if there aren't any due
+func claimJob(db StateStore, defaultTimeout time.Duration) (*Job, error) {
+	ids, err := db.ZRangeByScore(jobsKey, time.Now().Unix(), jobClaimBatch)
+	if err != nil {
+		return nil, fmt.Errorf("State error: %s", err)
+	}
+
+	for _, id := range ids {
+		job, err := leaseJob(db, id, defaultTimeout)
+		if err != nil {
+			log.Warn(fmt.Sprintf("Error claiming job %s: %s", id, err))
+			continue
+		}
+		if job != nil {
+			return job, nil
+		}
+
+		// the job was discarded, or finished, after it was queued
+		if fields, err := db.Get(jobKey(id)); err == nil && len(fields) == 0 {
+			db.ZRem(jobsKey, id)
+		}
+	}
+	return nil, nil
+}
+
+// failJob records a failed attempt at a job, and either schedules it to be
+// retried or moves it to the dead-letter list (straight away if the failure
+// is permanent). It returns true if the job has been given up on
+func failJob(db StateStore, job *Job, runErr error) (bool, error) {
+	job.Attempts++
+	job.LastError = runErr.Error()
+	job.LeaseUntil = time.Time{}
+
+	_, permanent := runErr.(permanentFailure)
+	if job.Attempts >= MaxJobAttempts || permanent {
+		log.Warn(fmt.Sprintf("Module %s for submission %s failed %d times, giving up on job %s: %s", job.Module, job.Submission.ID, job.Attempts, job.ID, runErr))
+		found, err := saveFailedJob(db, job)
+		if err != nil || !found {
+			return found, err
+		}
+		// it's added to the dead-letter list first, so it's never lost
+		err = db.ZAdd(deadJobsKey, job.ID, time.Now().Unix())
+		if err != nil {
+			return true, err
+		}
+		_, err = db.ZRem(jobsKey, job.ID)
+		return true, err
+	}
+
+	job.NextRunAt = time.Now().UTC().Add(jobBackoff(job.Attempts))
+	log.Warn(fmt.Sprintf("Module %s for submission %s failed, retrying job %s at %s: %s", job.Module, job.Submission.ID, job.ID, job.NextRunAt.Format(time.RFC3339), runErr))
+
+	found, err := saveFailedJob(db, job)
+	if err != nil || !found {
+		return false, err
+	}
+	return false, db.ZAdd(jobsKey, job.ID, job.NextRunAt.Unix())
+}
+
+// saveFailedJob saves a job after a failed attempt. It returns false if the
+// job was discarded while it was running, in which case it stays gone
+func saveFailedJob(db StateStore, job *Job) (bool, error) {
+	found := false
+	err := db.Update(jobKey(job.ID), 0, func(fields map[string]string) (map[string]string, error) {
+		if len(fields) == 0 {
+			found = false
+			return fields, nil
+		}
+		found = true
+		return encodeJob(job)
+	})
+	return found, err
+}
+
+// runJob runs a job's module, and sends its message to the user
+func runJob(db StateStore, api *slack.Client, job *Job, defaultTimeout time.Duration) error {
+	in := &ModuleInput{
+		Hook:         job.hook(),
+		Submission:   job.Submission,
+		Interactions: job.Interactions,
+		state:        job.State,
+		questions:    job.Questions,
+	}
+
+	result, err := callModule(db, job.Module, job.Config, job.timeout(defaultTimeout), in)
+	if err != nil {
+		return err
+	}
+
+	if len(result.Output) > 0 {
+		log.Info(fmt.Sprintf("Module %s output for submission %s: %v", job.Module, job.Submission.ID, result.Output))
+	}
+	if len(result.Message) > 0 && len(job.Channel) > 0 {
+		api.PostMessage(job.Channel, slack.MsgOptionText(result.Message, false))
+	}
+	return nil
+}
+
+// processJobs runs due jobs until there aren't any left
+func processJobs(db StateStore, api *slack.Client, defaultTimeout time.Duration) {
+	for {
+		job, err := claimJob(db, defaultTimeout)
+		if err != nil {
+			log.Warn(fmt.Sprintf("Error claiming job: %s", err))
+			return
+		}
+		if job == nil {
+			return
+		}
+
+		err = runJob(db, api, job, defaultTimeout)
+		if err != nil {
+			gaveUp, err := failJob(db, job, err)
+			if err != nil {
+				log.Warn(fmt.Sprintf("Error recording failed job %s: %s", job.ID, err))
+			}
+			if gaveUp && len(job.FailureResponse) > 0 && len(job.Channel) > 0 {
+				api.PostMessage(job.Channel, slack.MsgOptionText(job.FailureResponse, false))
+			}
+			continue
+		}
+
+		_, err = removeJob(db, job.ID)
+		if err != nil {
+			log.Warn(fmt.Sprintf("Error removing finished job %s: %s", job.ID, err))
+		}
+	}
+}
+
+// startJobWorkers starts n workers which run the queued jobs, with the default
+// module timeout, and returns a func which stops them once they've finished
+// what they're running
+func startJobWorkers(db StateStore, api *slack.Client, n int, defaultTimeout time.Duration) func() {
+	if n < 1 {
+		n = DefaultJobWorkers
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticker := time.NewTicker(jobPollInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					processJobs(db, api, defaultTimeout)
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// writeJobs lists jobs as a table
+func writeJobs(w io.Writer, title string, jobs []*Job) {
+	fmt.Fprintf(w, "%s: %d\n", title, len(jobs))
+	for _, job := range jobs {
+		line := fmt.Sprintf("  %s  %-20s  %-20s  submission %s  rule %s  attempts %d", job.ID, job.Module, job.hook(), job.Submission.ID, job.Submission.Rule, job.Attempts)
+		if !job.NextRunAt.IsZero() && job.Attempts < MaxJobAttempts {
+			line = fmt.Sprintf("%s  next run %s", line, job.NextRunAt.Format(time.RFC3339))
+		}
+		if len(job.LastError) > 0 {
+			line = fmt.Sprintf("%s  last error: %s", line, job.LastError)
+		}
+		fmt.Fprintln(w, line)
+	}
+}
+
+// ListJobs prints the queued and failed (dead-letter) module runs, and how
+// each module's runs have gone
+func ListJobs(cfg *BotConfig, w io.Writer) error {
+	db, err := NewStateStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	queued, err := listJobs(db, jobsKey)
+	if err != nil {
+		return err
+	}
+	dead, err := listJobs(db, deadJobsKey)
+	if err != nil {
+		return err
+	}
+
+	stats, err := buildModuleStats(db)
+	if err != nil {
+		return err
+	}
+
+	writeJobs(w, "Queued", queued)
+	writeJobs(w, "Failed", dead)
+	writeModuleStats(w, stats)
+	return nil
+}
+
+// retryJobs moves failed jobs back into the queue to run straight away, with
+// their attempts reset. Queued jobs are brought forward. With no IDs, every
+// failed job is retried
+func retryJobs(db StateStore, ids []string) (int, error) {
+	if len(ids) == 0 {
+		var err error
+		ids, err = db.ZRangeByScore(deadJobsKey, math.MaxInt64, 0)
+		if err != nil {
+			return 0, fmt.Errorf("State error: %s", err)
+		}
+	}
+
+	retried := 0
+	for _, id := range ids {
+		job, err := getJob(db, id)
+		if err != nil {
+			return retried, fmt.Errorf("Error getting job %s: %s", id, err)
+		}
+		if job == nil {
+			return retried, fmt.Errorf("No job found with ID: '%s'", id)
+		}
+		if job.LeaseUntil.After(time.Now()) {
+			return retried, fmt.Errorf("Job %s is running", id)
+		}
+		job.Attempts = 0
+		job.NextRunAt = time.Now().UTC()
+		job.LeaseUntil = time.Time{}
+
+		err = putJob(db, job)
+		if err != nil {
+			return retried, err
+		}
+		_, err = db.ZRem(deadJobsKey, id)
+		if err != nil {
+			return retried, err
+		}
+		retried++
+	}
+
+	return retried, nil
+}
+
+// RetryJobs queues failed module runs to be run again. With no IDs, every
+// failed run is retried
+func RetryJobs(cfg *BotConfig, ids []string, w io.Writer) error {
+	db, err := NewStateStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	retried, err := retryJobs(db, ids)
+	fmt.Fprintf(w, "Retrying %d jobs\n", retried)
+	return err
+}
+
+// discardJobs deletes jobs, whether they're queued or failed
+func discardJobs(db StateStore, ids []string) (int, error) {
+	discarded := 0
+	for _, id := range ids {
+		found, err := removeJob(db, id)
+		if err != nil {
+			return discarded, err
+		}
+		if !found {
+			return discarded, fmt.Errorf("No job found with ID: '%s'", id)
+		}
+		discarded++
+	}
+	return discarded, nil
+}
+
+// DiscardJobs deletes module runs, whether they're queued or failed
+func DiscardJobs(cfg *BotConfig, ids []string, w io.Writer) error {
+	db, err := NewStateStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	discarded, err := discardJobs(db, ids)
+	fmt.Fprintf(w, "Discarded %d jobs\n", discarded)
+	return err
+}
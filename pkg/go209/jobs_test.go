@@ -0,0 +1,252 @@
+package go209
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testJob builds a job which is due now
+func testJob(id string) *Job {
+	now := time.Now().UTC()
+	return &Job{
+		ID:         id,
+		Module:     "TestModule",
+		Submission: &Submission{ID: "s-" + id, Rule: "rule"},
+		CreatedAt:  now,
+		NextRunAt:  now,
+	}
+}
+
+func TestJobBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{8, time.Hour},
+		{20, time.Hour},
+	}
+
+	for _, test := range tests {
+		if got := jobBackoff(test.attempts); got != test.want {
+			t.Errorf("jobBackoff(%d) = %s, want %s", test.attempts, got, test.want)
+		}
+	}
+}
+
+func TestClaimJob(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+
+	for name, db := range stores {
+		older := testJob("j1")
+		older.NextRunAt = older.NextRunAt.Add(-time.Minute)
+		later := testJob("j2")
+		later.NextRunAt = later.NextRunAt.Add(time.Hour)
+		for _, job := range []*Job{testJob("j0"), older, later} {
+			err := putJob(db, job)
+			if err != nil {
+				t.Fatalf("%s: putJob error: %s", name, err)
+			}
+		}
+
+		// the one due the longest is claimed first, and isn't claimed again
+		// while it's leased
+		want := []string{"j1", "j0", ""}
+		for _, id := range want {
+			job, err := claimJob(db, time.Second)
+			if err != nil {
+				t.Fatalf("%s: claimJob error: %s", name, err)
+			}
+			got := ""
+			if job != nil {
+				got = job.ID
+				if !job.LeaseUntil.After(time.Now()) {
+					t.Errorf("%s: job %s wasn't leased", name, job.ID)
+				}
+			}
+			if got != id {
+				t.Errorf("%s: claimJob = %q, want %q", name, got, id)
+			}
+		}
+
+		// once the lease runs out, another worker can claim it
+		job, _ := getJob(db, "j0")
+		job.LeaseUntil = time.Now().Add(-time.Second)
+		fields, _ := encodeJob(job)
+		db.Set(jobKey("j0"), fields, 0)
+		db.ZAdd(jobsKey, "j0", job.LeaseUntil.Unix())
+		job, err := claimJob(db, time.Second)
+		if err != nil || job == nil || job.ID != "j0" {
+			t.Errorf("%s: claimJob after the lease = %+v, %v, want j0", name, job, err)
+		}
+
+		// a queued job whose state has gone is dropped from the queue
+		db.ZAdd(jobsKey, "gone", 0)
+		job, err = claimJob(db, time.Second)
+		if err != nil || job != nil {
+			t.Errorf("%s: claimJob of a missing job = %+v, %v, want nil", name, job, err)
+		}
+		if due, _ := db.ZRangeByScore(jobsKey, 0, 0); len(due) != 0 {
+			t.Errorf("%s: missing job left in the queue: %v", name, due)
+		}
+	}
+}
+
+func TestClaimJobConcurrent(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+
+	const jobs = 20
+	for name, db := range stores {
+		for i := 0; i < jobs; i++ {
+			putJob(db, testJob(newSubmissionID()))
+		}
+
+		var mu sync.Mutex
+		claimed := make(map[string]int)
+		var wg sync.WaitGroup
+		for w := 0; w < 5; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					job, err := claimJob(db, time.Second)
+					if err != nil {
+						t.Errorf("%s: claimJob error: %s", name, err)
+						return
+					}
+					if job == nil {
+						return
+					}
+					mu.Lock()
+					claimed[job.ID]++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		if len(claimed) != jobs {
+			t.Errorf("%s: %d jobs claimed, want %d", name, len(claimed), jobs)
+		}
+		for id, n := range claimed {
+			if n != 1 {
+				t.Errorf("%s: job %s claimed %d times", name, id, n)
+			}
+		}
+	}
+}
+
+func TestFailJob(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+
+	for name, db := range stores {
+		putJob(db, testJob("j1"))
+		job, _ := claimJob(db, time.Second)
+
+		// a failed job is retried after the backoff
+		gaveUp, err := failJob(db, job, errors.New("boom"))
+		if err != nil || gaveUp {
+			t.Fatalf("%s: failJob = %v, %v, want a retry", name, gaveUp, err)
+		}
+		saved, _ := getJob(db, "j1")
+		if saved.Attempts != 1 || saved.LastError != "boom" || !saved.LeaseUntil.IsZero() {
+			t.Errorf("%s: failed job = %+v", name, saved)
+		}
+		if wait := time.Until(saved.NextRunAt); wait < jobBackoff(1)-time.Second || wait > jobBackoff(1) {
+			t.Errorf("%s: retried in %s, want %s", name, wait, jobBackoff(1))
+		}
+		if job, _ := claimJob(db, time.Second); job != nil {
+			t.Errorf("%s: job claimed before its backoff", name)
+		}
+
+		// after MaxJobAttempts it's moved to the dead-letter list
+		for i := 1; i < MaxJobAttempts; i++ {
+			gaveUp, err = failJob(db, saved, errors.New("boom"))
+			if err != nil {
+				t.Fatalf("%s: failJob error: %s", name, err)
+			}
+		}
+		if !gaveUp {
+			t.Errorf("%s: job not given up on after %d attempts", name, MaxJobAttempts)
+		}
+		queued, _ := listJobs(db, jobsKey)
+		dead, _ := listJobs(db, deadJobsKey)
+		if len(queued) != 0 || len(dead) != 1 || dead[0].Attempts != MaxJobAttempts {
+			t.Errorf("%s: %d queued and %d dead jobs, want 0 and 1", name, len(queued), len(dead))
+		}
+
+		// permanent failures aren't retried
+		putJob(db, testJob("j2"))
+		job, _ = claimJob(db, time.Second)
+		gaveUp, err = failJob(db, job, permanentFailure{"400 Bad Request"})
+		if err != nil || !gaveUp {
+			t.Errorf("%s: failJob of a permanent failure = %v, %v, want given up", name, gaveUp, err)
+		}
+
+		// a job discarded while it's running stays discarded
+		putJob(db, testJob("j3"))
+		job, _ = claimJob(db, time.Second)
+		discardJobs(db, []string{"j3"})
+		gaveUp, err = failJob(db, job, errors.New("boom"))
+		if err != nil || gaveUp {
+			t.Errorf("%s: failJob of a discarded job = %v, %v", name, gaveUp, err)
+		}
+		if job, _ := getJob(db, "j3"); job != nil {
+			t.Errorf("%s: discarded job came back: %+v", name, job)
+		}
+	}
+}
+
+func TestRetryAndDiscardJobs(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+
+	for name, db := range stores {
+		for _, id := range []string{"j1", "j2"} {
+			putJob(db, testJob(id))
+			job, _ := claimJob(db, time.Second)
+			failJob(db, job, permanentFailure{"boom"})
+		}
+		putJob(db, testJob("j3"))
+		claimJob(db, time.Second)
+
+		if _, err := retryJobs(db, []string{"j3"}); err == nil {
+			t.Errorf("%s: retried a running job", name)
+		}
+		if _, err := retryJobs(db, []string{"missing"}); err == nil {
+			t.Errorf("%s: retried a missing job", name)
+		}
+
+		retried, err := retryJobs(db, nil)
+		if err != nil || retried != 2 {
+			t.Fatalf("%s: retryJobs = %d, %v, want 2", name, retried, err)
+		}
+		dead, _ := listJobs(db, deadJobsKey)
+		if len(dead) != 0 {
+			t.Errorf("%s: %d dead jobs left after retrying", name, len(dead))
+		}
+		job, _ := claimJob(db, time.Second)
+		if job == nil || job.Attempts != 0 {
+			t.Errorf("%s: retried job = %+v, want its attempts reset", name, job)
+		}
+
+		discarded, err := discardJobs(db, []string{"j1", "j2", "j3"})
+		if err != nil || discarded != 3 {
+			t.Errorf("%s: discardJobs = %d, %v, want 3", name, discarded, err)
+		}
+		if _, err := discardJobs(db, []string{"j1"}); err == nil {
+			t.Errorf("%s: discarded a missing job", name)
+		}
+		queued, _ := listJobs(db, jobsKey)
+		if len(queued) != 0 {
+			t.Errorf("%s: %d jobs left after discarding", name, len(queued))
+		}
+	}
+}
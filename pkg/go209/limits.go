@@ -0,0 +1,160 @@
+package go209
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nlopes/slack"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultLimitResponse is sent when a user hits one of a rule's limits, if the
+// rule doesn't set limit_response
+const DefaultLimitResponse = "Sorry, you can't do that again just yet"
+
+// DefaultMaxSessionsResponse is sent when max_sessions interactions are
+// already in progress, if the rules file doesn't set max_sessions_response
+const DefaultMaxSessionsResponse = "Sorry, I'm a bit busy right now. Try again in a little while"
+
+// limitsKey prefixes the state keys the limit counters are kept in
+const limitsKey = "go209:limits"
+
+// limitWindow is the window max_per_hour is counted over
+const limitWindow = time.Hour
+
+// errLimitReached is returned when a user has hit one of a rule's limits
+var errLimitReached = errors.New("Limit reached")
+
+// errTooManySessions is returned when starting an interaction would take the
+// number of sessions in progress over max_sessions
+var errTooManySessions = errors.New("Too many sessions in progress")
+
+// parsePeriod parses a once_every period. This is a go duration (like "12h"),
+// or a number of days (like "7d")
+func parsePeriod(period string) (time.Duration, error) {
+	if strings.HasSuffix(period, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(period, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("Error parsing period %s: %s", period, err)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+
+	dur, err := time.ParseDuration(period)
+	if err != nil {
+		return 0, fmt.Errorf("Error parsing period %s: %s", period, err)
+	}
+	return dur, nil
+}
+
+// hasLimits returns true if the rule limits how often each user can use it
+func (r *Rule) hasLimits() bool {
+	return r.Once || r.onceEvery > 0 || r.MaxPerHour > 0
+}
+
+// limitResponse is the response sent when a user hits one of the rule's limits
+func (r *Rule) limitResponse() string {
+	if len(r.LimitResponse) > 0 {
+		return r.LimitResponse
+	}
+	return DefaultLimitResponse
+}
+
+// maxSessionsResponse is the response sent when too many sessions are in
+// progress to start another
+func (r *RuleSet) maxSessionsResponse() string {
+	if len(r.MaxSessionsResponse) > 0 {
+		return r.MaxSessionsResponse
+	}
+	return DefaultMaxSessionsResponse
+}
+
+// limitUser is who the limits are counted against. For anonymous rules this
+// is the user's hash, so the counters don't give away who took part
+func (r *RuleSet) limitUser(rule *Rule, user string) string {
+	if rule.Anonymous {
+		return r.anonymousHash(rule, user)
+	}
+	return user
+}
+
+// checkLimits checks whether the user can use the rule again, and counts this
+// use against max_per_hour. errLimitReached is returned if they can't
+func (r *RuleSet) checkLimits(db StateStore, rule *Rule, user string) error {
+	if !rule.hasLimits() {
+		return nil
+	}
+	limitUser := r.limitUser(rule, user)
+
+	if rule.Once || rule.onceEvery > 0 {
+		completed, err := db.Get(fmt.Sprintf("%s:completed:%s", limitsKey, rule.title()))
+		if err != nil {
+			return fmt.Errorf("State error: %s", err)
+		}
+		if last, ok := completed[limitUser]; ok {
+			if rule.Once {
+				return errLimitReached
+			}
+			lastUnix, _ := strconv.ParseInt(last, 10, 64)
+			if time.Since(time.Unix(lastUnix, 0)) < rule.onceEvery {
+				return errLimitReached
+			}
+		}
+	}
+
+	if rule.MaxPerHour > 0 {
+		now := time.Now()
+		key := fmt.Sprintf("%s:rate:%s:%s", limitsKey, rule.title(), limitUser)
+		err := db.Update(key, limitWindow, func(fields map[string]string) (map[string]string, error) {
+			start, _ := strconv.ParseInt(fields["start"], 10, 64)
+			count, _ := strconv.Atoi(fields["count"])
+			if now.Sub(time.Unix(start, 0)) >= limitWindow {
+				start, count = now.Unix(), 0
+			}
+			if count >= rule.MaxPerHour {
+				return nil, errLimitReached
+			}
+			return map[string]string{
+				"start": strconv.FormatInt(start, 10),
+				"count": strconv.Itoa(count + 1),
+			}, nil
+		})
+		if err == errLimitReached {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("Error counting rule usage: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// recordCompletion records when the user completed the rule's interactions,
+// for the rule's once and once_every limits
+func (r *RuleSet) recordCompletion(db StateStore, rule *Rule, user string) error {
+	if !rule.Once && rule.onceEvery == 0 {
+		return nil
+	}
+	key := fmt.Sprintf("%s:completed:%s", limitsKey, rule.title())
+	return db.Set(key, map[string]string{r.limitUser(rule, user): strconv.FormatInt(time.Now().Unix(), 10)}, 0)
+}
+
+// enforceLimits checks the rule's limits for the user, and lets them know if
+// they've hit one. It returns false if the rule shouldn't be run
+func enforceLimits(api *slack.Client, db StateStore, rules *RuleSet, rule *Rule, team, channel, user, username, args string, re *regexp.Regexp) (bool, error) {
+	err := rules.checkLimits(db, rule, user)
+	if err == errLimitReached {
+		log.Info(fmt.Sprintf("User %s has reached the limits of rule '%s'", logUser(rule.Anonymous, username, user), rule.title()))
+		api.PostMessage(channel, slack.MsgOptionText(rules.renderTemplate(api, team, rule.limitResponse(), username, user, args, re), false))
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
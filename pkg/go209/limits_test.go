@@ -0,0 +1,267 @@
+package go209
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// ago is the unix time the duration ago, as the limits keep it
+func ago(d time.Duration) string {
+	return strconv.FormatInt(time.Now().Add(-d).Unix(), 10)
+}
+
+func TestParsePeriod(t *testing.T) {
+	tests := []struct {
+		period  string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"12h", 12 * time.Hour, false},
+		{"90m", 90 * time.Minute, false},
+		{"7d", 7 * 24 * time.Hour, false},
+		{"1.5d", 0, true},
+		{"d", 0, true},
+		{"weekly", 0, true},
+	}
+
+	for _, test := range tests {
+		got, err := parsePeriod(test.period)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parsePeriod(%s) didn't fail", test.period)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("parsePeriod(%s) = %s, %v, want %s", test.period, got, err, test.want)
+		}
+	}
+}
+
+func TestCheckLimits(t *testing.T) {
+	completedKey := fmt.Sprintf("%s:completed:Survey", limitsKey)
+	rateKey := fmt.Sprintf("%s:rate:Survey:U1", limitsKey)
+
+	tests := []struct {
+		name  string
+		rule  Rule
+		state map[string]map[string]string
+		want  error
+	}{
+		{"no limits", Rule{}, map[string]map[string]string{completedKey: {"U1": ago(0)}}, nil},
+		{"once, not completed", Rule{Once: true}, nil, nil},
+		{"once, completed by someone else", Rule{Once: true}, map[string]map[string]string{completedKey: {"U2": ago(0)}}, nil},
+		{"once, completed", Rule{Once: true}, map[string]map[string]string{completedKey: {"U1": ago(365 * 24 * time.Hour)}}, errLimitReached},
+		{"once_every, not completed", Rule{onceEvery: time.Hour}, nil, nil},
+		{"once_every, inside the period", Rule{onceEvery: time.Hour}, map[string]map[string]string{completedKey: {"U1": ago(time.Hour - 5*time.Second)}}, errLimitReached},
+		{"once_every, past the period", Rule{onceEvery: time.Hour}, map[string]map[string]string{completedKey: {"U1": ago(time.Hour + time.Second)}}, nil},
+		{"max_per_hour, none yet", Rule{MaxPerHour: 2}, nil, nil},
+		{"max_per_hour, under", Rule{MaxPerHour: 2}, map[string]map[string]string{rateKey: {"start": ago(time.Minute), "count": "1"}}, nil},
+		{"max_per_hour, at the max", Rule{MaxPerHour: 2}, map[string]map[string]string{rateKey: {"start": ago(time.Minute), "count": "2"}}, errLimitReached},
+		{"max_per_hour, end of the window", Rule{MaxPerHour: 2}, map[string]map[string]string{rateKey: {"start": ago(limitWindow - 5*time.Second), "count": "2"}}, errLimitReached},
+		{"max_per_hour, next window", Rule{MaxPerHour: 2}, map[string]map[string]string{rateKey: {"start": ago(limitWindow), "count": "2"}}, nil},
+		{"max_per_hour, someone else at the max", Rule{MaxPerHour: 2}, map[string]map[string]string{fmt.Sprintf("%s:rate:Survey:U2", limitsKey): {"start": ago(time.Minute), "count": "2"}}, nil},
+		{"once and max_per_hour", Rule{Once: true, MaxPerHour: 2}, map[string]map[string]string{completedKey: {"U1": ago(0)}}, errLimitReached},
+	}
+
+	for _, test := range tests {
+		db := newMemoryStore()
+		for key, fields := range test.state {
+			err := db.Set(key, fields, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		test.rule.Name = "Survey"
+		err := (&RuleSet{}).checkLimits(db, &test.rule, "U1")
+		if err != test.want {
+			t.Errorf("%s: checkLimits = %v, want %v", test.name, err, test.want)
+		}
+		db.Close()
+	}
+}
+
+func TestMaxPerHour(t *testing.T) {
+	db := newMemoryStore()
+	defer db.Close()
+	rules := &RuleSet{}
+	rule := &Rule{Name: "Survey", MaxPerHour: 3}
+
+	for i := 1; i <= 4; i++ {
+		err := rules.checkLimits(db, rule, "U1")
+		if i <= 3 && err != nil {
+			t.Errorf("use %d: checkLimits = %v, want it allowed", i, err)
+		}
+		if i > 3 && err != errLimitReached {
+			t.Errorf("use %d: checkLimits = %v, want %v", i, err, errLimitReached)
+		}
+	}
+
+	// a new window starts the count again
+	key := fmt.Sprintf("%s:rate:Survey:U1", limitsKey)
+	db.Set(key, map[string]string{"start": ago(limitWindow + time.Second)}, 0)
+	if err := rules.checkLimits(db, rule, "U1"); err != nil {
+		t.Errorf("checkLimits in a new window = %v, want it allowed", err)
+	}
+	fields, _ := db.Get(key)
+	if fields["count"] != "1" {
+		t.Errorf("count in a new window = %s, want 1", fields["count"])
+	}
+}
+
+func TestRecordCompletion(t *testing.T) {
+	db := newMemoryStore()
+	defer db.Close()
+	rules := &RuleSet{}
+	rules.setAnonymousSalt("salt")
+
+	once := &Rule{Name: "Survey", Once: true}
+	err := rules.recordCompletion(db, once, "U1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rules.checkLimits(db, once, "U1"); err != errLimitReached {
+		t.Errorf("once after completing = %v, want %v", err, errLimitReached)
+	}
+	if err := rules.checkLimits(db, once, "U2"); err != nil {
+		t.Errorf("once for another user = %v, want it allowed", err)
+	}
+
+	// a rule without once or once_every doesn't keep completions
+	hourly := &Rule{Name: "Hourly", MaxPerHour: 5}
+	rules.recordCompletion(db, hourly, "U1")
+	if fields, _ := db.Get(fmt.Sprintf("%s:completed:Hourly", limitsKey)); len(fields) > 0 {
+		t.Errorf("completions kept without once: %v", fields)
+	}
+
+	// anonymous rules are counted against the user's hash
+	anonymous := &Rule{Name: "Feedback", Once: true, Anonymous: true}
+	rules.recordCompletion(db, anonymous, "U1")
+	fields, _ := db.Get(fmt.Sprintf("%s:completed:Feedback", limitsKey))
+	if _, ok := fields[rules.anonymousHash(anonymous, "U1")]; !ok || len(fields) != 1 {
+		t.Errorf("anonymous completions = %v, want only the hash", fields)
+	}
+	if err := rules.checkLimits(db, anonymous, "U1"); err != errLimitReached {
+		t.Errorf("anonymous once after completing = %v, want %v", err, errLimitReached)
+	}
+}
+
+// postedText waits for a message to be posted to the fake slack API, and
+// returns the call
+func postedText(t *testing.T, calls chan string) string {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case call := <-calls:
+			if strings.HasPrefix(call, "chat.postMessage") {
+				return call
+			}
+		case <-timeout:
+			t.Fatal("no message was posted")
+		}
+	}
+}
+
+func TestLimitResponses(t *testing.T) {
+	srv, calls := testSlackAPI(nil)
+	defer srv.Close()
+	api := slack.New("xoxb-test", slack.OptionAPIURL(srv.URL+"/"))
+	re := regexp.MustCompile(TemplatePreParserRegex)
+
+	tests := []struct {
+		name string
+		rule Rule
+		want string
+	}{
+		{"default", Rule{Name: "Survey", Once: true}, DefaultLimitResponse},
+		{"limit_response", Rule{Name: "Survey", Once: true, LimitResponse: "Once is enough, {{.Username}}"}, "Once is enough, bob"},
+	}
+
+	for _, test := range tests {
+		db := newMemoryStore()
+		rules := &RuleSet{Rules: []Rule{test.rule}}
+		rules.recordCompletion(db, &rules.Rules[0], "U1")
+
+		ok, err := enforceLimits(api, db, rules, &rules.Rules[0], "T1", "D1", "U1", "bob", "", re)
+		if ok || err != nil {
+			t.Errorf("%s: enforceLimits = %v, %v, want the rule stopped", test.name, ok, err)
+		}
+		if call := postedText(t, calls); !strings.Contains(call, test.want) || !strings.Contains(call, "channel=D1") {
+			t.Errorf("%s: posted %s, want %q", test.name, call, test.want)
+		}
+
+		// another user isn't limited, or told anything
+		ok, err = enforceLimits(api, db, rules, &rules.Rules[0], "T1", "D2", "U2", "alice", "", re)
+		if !ok || err != nil {
+			t.Errorf("%s: enforceLimits for another user = %v, %v, want the rule run", test.name, ok, err)
+		}
+		if len(calls) > 0 {
+			t.Errorf("%s: posted %s to a user under the limits", test.name, <-calls)
+		}
+		db.Close()
+	}
+}
+
+func TestMaxSessionsResponse(t *testing.T) {
+	srv, calls := testSlackAPI(nil)
+	defer srv.Close()
+	api := slack.New("xoxb-test", slack.OptionAPIURL(srv.URL+"/"))
+	re := regexp.MustCompile(TemplatePreParserRegex)
+
+	tests := []struct {
+		response string
+		want     string
+	}{
+		{"", DefaultMaxSessionsResponse},
+		{"Too busy, {{.Username}}", "Too busy, bob"},
+	}
+
+	for _, test := range tests {
+		db := newMemoryStore()
+		rules := testSlashRules()
+		rules.MaxSessions = 1
+		rules.MaxSessionsResponse = test.response
+		rule := &rules.Rules[0]
+
+		// someone else has the only session
+		_, err := newState(db, "T1:D2", "U2", "alice", "", "", rules.MaxSessions, &rule.Interactions[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = startInteraction(api, db, nil, rules, rule, "T1:D1", "T1", "D1", "U1", "bob", "", re)
+		if err != nil {
+			t.Errorf("startInteraction = %v", err)
+		}
+		if call := postedText(t, calls); !strings.Contains(call, test.want) {
+			t.Errorf("posted %s, want %q", call, test.want)
+		}
+		if val, _ := db.Get("T1:D1"); len(val) > 0 {
+			t.Errorf("state kept past max_sessions: %v", val)
+		}
+
+		// once it's finished there's room again
+		_, err = endState(db, "T1:D2", "", "", FunnelCancelled)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = startInteraction(api, db, nil, rules, rule, "T1:D1", "T1", "D1", "U1", "bob", "", re)
+		if err != nil {
+			t.Errorf("startInteraction after a session ended = %v", err)
+		}
+		if val, _ := db.Get("T1:D1"); val["interaction"] != "q1" {
+			t.Errorf("state after a session ended = %v, want it at q1", val)
+		}
+		for len(calls) > 0 {
+			<-calls
+		}
+		db.Close()
+	}
+}
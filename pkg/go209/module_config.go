@@ -0,0 +1,247 @@
+package go209
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The types a module's config fields can be. An object is a JSON object of
+// strings, like a set of HTTP headers, and a list is a JSON list of strings
+const (
+	ConfigString = "string"
+	ConfigNumber = "number"
+	ConfigBool   = "bool"
+	ConfigObject = "object"
+	ConfigList   = "list"
+)
+
+// ConfigField describes one of the config fields a module takes from the
+// rules file
+type ConfigField struct {
+	Type        string `json:"type"`
+	Required    bool   `json:"required,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// ConfigurableModule is implemented by modules (v1 or v2) which declare the
+// config they take from the rules file. Modules which don't declare a schema
+// take their ENV VARs as string config fields
+type ConfigurableModule interface {
+	ConfigSchema() map[string]ConfigField
+}
+
+// ConfigValidator is implemented by modules (v1 or v2) which check more about
+// their config than its schema can, like parsing templates. It's called when
+// go209 starts, once the config fits the schema
+type ConfigValidator interface {
+	ValidateConfig(config json.RawMessage) error
+}
+
+// moduleValidator returns the module as a ConfigValidator, if it is one
+func moduleValidator(mod ModuleV2) (ConfigValidator, bool) {
+	if v, ok := mod.(ConfigValidator); ok {
+		return v, true
+	}
+	if v1, ok := mod.(moduleV1); ok {
+		if v, ok := v1.Module.(ConfigValidator); ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// isStringObject returns true if the value is a JSON object of strings
+func isStringObject(value interface{}) bool {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	for _, v := range object {
+		if _, ok := v.(string); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// isStringList returns true if the value is a JSON list of strings
+func isStringList(value interface{}) bool {
+	list, ok := value.([]interface{})
+	if !ok {
+		return false
+	}
+	for _, v := range list {
+		if _, ok := v.(string); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// moduleSchema is the config schema of a module
+func moduleSchema(mod ModuleV2) map[string]ConfigField {
+	if c, ok := mod.(ConfigurableModule); ok {
+		return c.ConfigSchema()
+	}
+	if v1, ok := mod.(moduleV1); ok {
+		if c, ok := v1.Module.(ConfigurableModule); ok {
+			return c.ConfigSchema()
+		}
+	}
+
+	schema := make(map[string]ConfigField)
+	for _, ev := range mod.EnvVars() {
+		schema[strings.ToLower(ev)] = ConfigField{Type: ConfigString}
+	}
+	return schema
+}
+
+// decodeModuleConfig decodes a module's config from the rules file into its
+// fields
+func decodeModuleConfig(config json.RawMessage) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	if len(config) == 0 {
+		return fields, nil
+	}
+
+	err := json.Unmarshal(config, &fields)
+	if err != nil {
+		return nil, fmt.Errorf("config must be an object: %s", err)
+	}
+	return fields, nil
+}
+
+// validateModuleConfig checks a module's config from the rules file against
+// the module's schema
+func validateModuleConfig(mod ModuleV2, config json.RawMessage) error {
+	fields, err := decodeModuleConfig(config)
+	if err != nil {
+		return err
+	}
+	schema := moduleSchema(mod)
+
+	var names []string
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		field, ok := schema[name]
+		if !ok {
+			return fmt.Errorf("%s doesn't take config '%s'", mod.Name(), name)
+		}
+
+		valid := false
+		switch fields[name].(type) {
+		case string:
+			valid = field.Type == ConfigString
+		case float64:
+			valid = field.Type == ConfigNumber
+		case bool:
+			valid = field.Type == ConfigBool
+		case map[string]interface{}:
+			valid = field.Type == ConfigObject && isStringObject(fields[name])
+		case []interface{}:
+			valid = field.Type == ConfigList && isStringList(fields[name])
+		}
+		if !valid {
+			return fmt.Errorf("%s config '%s' must be a %s", mod.Name(), name, field.Type)
+		}
+	}
+
+	for name, field := range schema {
+		if _, ok := fields[name]; field.Required && !ok {
+			return fmt.Errorf("%s config '%s' is required", mod.Name(), name)
+		}
+	}
+
+	if v, ok := moduleValidator(mod); ok {
+		err := v.ValidateConfig(config)
+		if err != nil {
+			return fmt.Errorf("%s config is invalid: %s", mod.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// mergeModuleConfig sets the module's config from the rules file over its
+// ENV VARs, so a rule can override them. Each field sets the ENV VAR of the
+// same name, for instance "to" sets EMAILMODULE_TO. A false bool clears it,
+// and an object or list is set as JSON
+func mergeModuleConfig(mod ModuleV2, env map[string]string, config json.RawMessage) (map[string]string, error) {
+	fields, err := decodeModuleConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := make(map[string]string, len(env)+len(fields))
+	for k, v := range env {
+		merged[k] = v
+	}
+
+	for name, value := range fields {
+		adjusted := strings.ToUpper(fmt.Sprintf("%s_%s", mod.Name(), name))
+		switch v := value.(type) {
+		case string:
+			merged[adjusted] = v
+		case float64:
+			merged[adjusted] = fmt.Sprint(v)
+		case bool:
+			if v {
+				merged[adjusted] = "true"
+			} else {
+				merged[adjusted] = ""
+			}
+		case map[string]interface{}, []interface{}:
+			object, err := json.Marshal(v)
+			if err != nil {
+				return nil, fmt.Errorf("Error marshalling json: %s", err)
+			}
+			merged[adjusted] = string(object)
+		}
+	}
+
+	return merged, nil
+}
+
+// validateModules checks every module in the rules' interaction_end_mods,
+// hooks and data sources is loaded, and that its config fits its schema
+func (r *RuleSet) validateModules() error {
+	for _, rule := range r.Rules {
+		for _, interaction := range rule.Interactions {
+			for _, source := range interaction.dataSources() {
+				mod := modules.find(source.Module)
+				if mod == nil {
+					return fmt.Errorf("Rule '%s' uses a module which isn't loaded: %s", rule.title(), source.Module)
+				}
+				if _, ok := moduleProvider(mod); !ok {
+					return fmt.Errorf("Rule '%s' uses a module which isn't a data provider: %s", rule.title(), source.Module)
+				}
+
+				err := validateModuleConfig(mod, source.Config)
+				if err != nil {
+					return fmt.Errorf("Rule '%s' has bad module config: %s", rule.title(), err)
+				}
+			}
+		}
+
+		for _, mods := range rule.moduleLists() {
+			for _, endMod := range mods {
+				mod := modules.find(endMod.Module)
+				if mod == nil {
+					return fmt.Errorf("Rule '%s' uses a module which isn't loaded: %s", rule.title(), endMod.Module)
+				}
+
+				err := validateModuleConfig(mod, endMod.Config)
+				if err != nil {
+					return fmt.Errorf("Rule '%s' has bad module config: %s", rule.title(), err)
+				}
+			}
+		}
+	}
+	return nil
+}
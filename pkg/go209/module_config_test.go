@@ -0,0 +1,171 @@
+package go209
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// schemaModule is a module with a config field of every type, which rejects a
+// name of "bad" in its ValidateConfig
+type schemaModule struct{}
+
+func (m schemaModule) Name() string {
+	return "SchemaModule"
+}
+
+func (m schemaModule) EnvVars() []string {
+	return []string{"URL"}
+}
+
+func (m schemaModule) Run(ctx context.Context, in *ModuleInput) (*ModuleResult, error) {
+	return &ModuleResult{Status: ModuleOK}, nil
+}
+
+func (m schemaModule) ConfigSchema() map[string]ConfigField {
+	return map[string]ConfigField{
+		"name":    {Type: ConfigString, Required: true},
+		"retries": {Type: ConfigNumber},
+		"reply":   {Type: ConfigBool},
+		"headers": {Type: ConfigObject},
+		"args":    {Type: ConfigList},
+	}
+}
+
+func (m schemaModule) ValidateConfig(config json.RawMessage) error {
+	var cfg struct {
+		Name string `json:"name"`
+	}
+	err := DecodeConfig(config, &cfg)
+	if err != nil {
+		return err
+	}
+	if cfg.Name == "bad" {
+		return errors.New("name can't be bad")
+	}
+	return nil
+}
+
+// envModule is a v1 module without a schema, so it takes its ENV VARs
+type envModule struct{}
+
+func (m envModule) Name() string {
+	return "EnvModule"
+}
+
+func (m envModule) EnvVars() []string {
+	return []string{"TO", "SUBJECT"}
+}
+
+func (m envModule) Run(in interface{}, ev map[string]string, interactions map[string]string) error {
+	return nil
+}
+
+func TestValidateModuleConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		mod     ModuleV2
+		config  string
+		wantErr string
+	}{
+		{"every type", schemaModule{}, `{"name": "n", "retries": 3, "reply": true, "headers": {"X-A": "b"}, "args": ["-v", "x"]}`, ""},
+		{"only required", schemaModule{}, `{"name": "n"}`, ""},
+		{"missing required", schemaModule{}, `{"retries": 3}`, "'name' is required"},
+		{"no config", schemaModule{}, ``, "'name' is required"},
+		{"unknown key", schemaModule{}, `{"name": "n", "url": "x"}`, "doesn't take config 'url'"},
+		{"string as number", schemaModule{}, `{"name": "n", "retries": "3"}`, "'retries' must be a number"},
+		{"number as string", schemaModule{}, `{"name": 1}`, "'name' must be a string"},
+		{"string as bool", schemaModule{}, `{"name": "n", "reply": "yes"}`, "'reply' must be a bool"},
+		{"list as object", schemaModule{}, `{"name": "n", "headers": ["a"]}`, "'headers' must be a object"},
+		{"object of numbers", schemaModule{}, `{"name": "n", "headers": {"X-A": 1}}`, "'headers' must be a object"},
+		{"list of numbers", schemaModule{}, `{"name": "n", "args": [1, 2]}`, "'args' must be a list"},
+		{"string as list", schemaModule{}, `{"name": "n", "args": "-v"}`, "'args' must be a list"},
+		{"null", schemaModule{}, `{"name": null}`, "'name' must be a string"},
+		{"not an object", schemaModule{}, `["name"]`, "config must be an object"},
+		{"module validator", schemaModule{}, `{"name": "bad"}`, "SchemaModule config is invalid: name can't be bad"},
+		{"env vars", moduleV1{envModule{}}, `{"to": "a@example.com", "subject": "hi"}`, ""},
+		{"env vars are strings", moduleV1{envModule{}}, `{"to": ["a@example.com"]}`, "'to' must be a string"},
+		{"env vars aren't required", moduleV1{envModule{}}, ``, ""},
+		{"unknown env var", moduleV1{envModule{}}, `{"from": "b@example.com"}`, "EnvModule doesn't take config 'from'"},
+	}
+
+	for _, test := range tests {
+		err := validateModuleConfig(test.mod, json.RawMessage(test.config))
+		if len(test.wantErr) == 0 {
+			if err != nil {
+				t.Errorf("%s: validateModuleConfig(%s) error: %s", test.name, test.config, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s: validateModuleConfig(%s) = %v, want %q", test.name, test.config, err, test.wantErr)
+		}
+	}
+}
+
+func TestDecodeConfig(t *testing.T) {
+	type config struct {
+		Name    string            `json:"name"`
+		Retries int               `json:"retries"`
+		Headers map[string]string `json:"headers"`
+	}
+	defaults := config{Name: "default", Retries: 1}
+
+	tests := []struct {
+		name    string
+		config  string
+		want    config
+		wantErr bool
+	}{
+		{"no config keeps the defaults", ``, defaults, false},
+		{"fields are set over the defaults", `{"name": "n", "headers": {"X-A": "b"}}`, config{Name: "n", Retries: 1, Headers: map[string]string{"X-A": "b"}}, false},
+		{"unknown fields are ignored", `{"retries": 5, "other": true}`, config{Name: "default", Retries: 5}, false},
+		{"wrong type", `{"retries": "5"}`, config{}, true},
+		{"bad json", `{"name": `, config{}, true},
+	}
+
+	for _, test := range tests {
+		cfg := defaults
+		err := DecodeConfig(json.RawMessage(test.config), &cfg)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: DecodeConfig(%s) didn't fail", test.name, test.config)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: DecodeConfig(%s) error: %s", test.name, test.config, err)
+			continue
+		}
+		if !reflect.DeepEqual(cfg, test.want) {
+			t.Errorf("%s: DecodeConfig(%s) = %+v, want %+v", test.name, test.config, cfg, test.want)
+		}
+	}
+}
+
+func TestMergeModuleConfig(t *testing.T) {
+	env := map[string]string{"SCHEMAMODULE_URL": "https://example.com", "SCHEMAMODULE_REPLY": "true"}
+	config := `{"name": "n", "retries": 3, "reply": false, "args": ["-v"]}`
+
+	merged, err := mergeModuleConfig(schemaModule{}, env, json.RawMessage(config))
+	if err != nil {
+		t.Fatalf("mergeModuleConfig error: %s", err)
+	}
+
+	want := map[string]string{
+		"SCHEMAMODULE_URL":     "https://example.com",
+		"SCHEMAMODULE_NAME":    "n",
+		"SCHEMAMODULE_RETRIES": "3",
+		"SCHEMAMODULE_REPLY":   "",
+		"SCHEMAMODULE_ARGS":    `["-v"]`,
+	}
+	if !reflect.DeepEqual(merged, want) {
+		t.Errorf("mergeModuleConfig = %v, want %v", merged, want)
+	}
+	if env["SCHEMAMODULE_REPLY"] != "true" {
+		t.Errorf("mergeModuleConfig changed the ENV VARs: %v", env)
+	}
+}
@@ -0,0 +1,124 @@
+package go209
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// moduleStatsKey is the state key the module run counters are kept in. Each
+// field is <module>:<outcome> with the number of runs, or <module>:ms with
+// the total milliseconds they took, so they can all be counted with Incr
+const moduleStatsKey = "go209:modules:stats"
+
+// moduleStats is how a module's runs have gone
+type moduleStats struct {
+	Module   string
+	Outcomes map[string]int
+	Seconds  float64
+}
+
+// runs is how many times the module has been run
+func (m *moduleStats) runs() int {
+	total := 0
+	for _, count := range m.Outcomes {
+		total += count
+	}
+	return total
+}
+
+// recordModuleRun counts a module run, and how long it took. Errors are only
+// logged, like the funnel counters
+func recordModuleRun(db StateStore, module, outcome string, took time.Duration) {
+	countField := fmt.Sprintf("%s:%s", module, outcome)
+	msField := fmt.Sprintf("%s:ms", module)
+
+	_, err := db.Incr(moduleStatsKey, countField, 1)
+	if err == nil {
+		_, err = db.Incr(moduleStatsKey, msField, int64(took/time.Millisecond))
+	}
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error recording module run %s: %s", countField, err))
+	}
+}
+
+// buildModuleStats fetches the module run counters, sorted by module
+func buildModuleStats(db StateStore) ([]moduleStats, error) {
+	fields, err := db.Get(moduleStatsKey)
+	if err != nil {
+		return nil, fmt.Errorf("State error: %s", err)
+	}
+
+	byModule := make(map[string]*moduleStats)
+	for field, value := range fields {
+		// the outcome never has a ":", so split on the last one
+		sep := strings.LastIndex(field, ":")
+		if sep < 0 {
+			continue
+		}
+		module, name := field[:sep], field[sep+1:]
+
+		stats, ok := byModule[module]
+		if !ok {
+			stats = &moduleStats{Module: module, Outcomes: make(map[string]int)}
+			byModule[module] = stats
+		}
+
+		if name == "ms" {
+			ms, _ := strconv.ParseInt(value, 10, 64)
+			stats.Seconds = float64(ms) / 1000
+			continue
+		}
+		stats.Outcomes[name], _ = strconv.Atoi(value)
+	}
+
+	var all []moduleStats
+	for _, stats := range byModule {
+		all = append(all, *stats)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Module < all[j].Module
+	})
+	return all, nil
+}
+
+// writeModuleStats lists how each module's runs have gone
+func writeModuleStats(w io.Writer, all []moduleStats) {
+	fmt.Fprintf(w, "Module runs:\n")
+	for _, stats := range all {
+		line := fmt.Sprintf("  %-20s", stats.Module)
+		for _, outcome := range moduleRunOutcomes {
+			line = fmt.Sprintf("%s  %s %4d", line, outcome, stats.Outcomes[outcome])
+		}
+		average := 0.0
+		if stats.runs() > 0 {
+			average = stats.Seconds / float64(stats.runs())
+		}
+		fmt.Fprintf(w, "%s  average %.2fs\n", line, average)
+	}
+}
+
+// writeModuleMetrics writes the module run counters in the Prometheus text
+// format
+func writeModuleMetrics(w io.Writer, all []moduleStats) {
+	fmt.Fprintln(w, "# HELP go209_module_runs_total Module runs, by their outcome.")
+	fmt.Fprintln(w, "# TYPE go209_module_runs_total counter")
+	for _, stats := range all {
+		for _, outcome := range moduleRunOutcomes {
+			fmt.Fprintf(w, "go209_module_runs_total{module=\"%s\",outcome=\"%s\"} %d\n",
+				prometheusLabel(stats.Module), outcome, stats.Outcomes[outcome])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP go209_module_run_seconds How long module runs took.")
+	fmt.Fprintln(w, "# TYPE go209_module_run_seconds summary")
+	for _, stats := range all {
+		fmt.Fprintf(w, "go209_module_run_seconds_sum{module=\"%s\"} %g\n", prometheusLabel(stats.Module), stats.Seconds)
+		fmt.Fprintf(w, "go209_module_run_seconds_count{module=\"%s\"} %d\n", prometheusLabel(stats.Module), stats.runs())
+	}
+}
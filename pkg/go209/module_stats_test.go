@@ -0,0 +1,49 @@
+package go209
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRecordModuleRunConcurrent(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+
+	const runs = 50
+	for name, db := range stores {
+		var wg sync.WaitGroup
+		for i := 0; i < runs; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				outcome := ModuleRunOK
+				if i%5 == 0 {
+					outcome = ModuleRunFailed
+				}
+				recordModuleRun(db, "TestModule", outcome, 100*time.Millisecond)
+			}(i)
+		}
+		wg.Wait()
+		recordModuleRun(db, "OtherModule", ModuleRunTimeout, 2*time.Second)
+
+		all, err := buildModuleStats(db)
+		if err != nil {
+			t.Fatalf("%s: buildModuleStats error: %s", name, err)
+		}
+		if len(all) != 2 || all[0].Module != "OtherModule" || all[1].Module != "TestModule" {
+			t.Fatalf("%s: stats = %+v", name, all)
+		}
+
+		stats := all[1]
+		if stats.Outcomes[ModuleRunOK] != 40 || stats.Outcomes[ModuleRunFailed] != 10 || stats.runs() != runs {
+			t.Errorf("%s: outcomes = %v, want 40 ok and 10 failed", name, stats.Outcomes)
+		}
+		if stats.Seconds != 5 {
+			t.Errorf("%s: seconds = %g, want 5", name, stats.Seconds)
+		}
+		if all[0].Outcomes[ModuleRunTimeout] != 1 || all[0].Seconds != 2 {
+			t.Errorf("%s: other module = %+v", name, all[0])
+		}
+	}
+}
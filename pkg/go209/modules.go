@@ -1,85 +1,481 @@
 package go209
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"plugin"
+	"runtime/debug"
+	"sort"
 	"strings"
+	"sync"
+	"text/template"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
-// PreloadedModules is the list of .so files from the root directory we load by default
-const PreloadedModules = "email-mod:slackwebhook-mod"
-
 var modules = LoadedModules{}
 
-// Module defines what our plugins have to define
+// DefaultModuleTimeout is the deadline given to each module run, unless
+// MODULE_TIMEOUT or the rule's interaction_end_mods set another
+const DefaultModuleTimeout = 30 * time.Second
+
+// WebModuleTimeout is the longest an on_answer module is given when slack is
+// waiting on it, for button and menu answers. Slack only waits 3 seconds
+// before telling the user something went wrong
+const WebModuleTimeout = 2 * time.Second
+
+// The statuses a module can return in its ModuleResult. ModuleRejected only
+// means something to on_answer modules, which can reject the user's answer
+const (
+	ModuleOK       = "ok"
+	ModuleFailed   = "failed"
+	ModuleRejected = "rejected"
+)
+
+// Module defines what our plugins have to define. This is the original
+// module interface, new modules should implement ModuleV2
 type Module interface {
 	Name() string
 	EnvVars() []string
 	Run(in interface{}, ev map[string]string, interactions map[string]string) error
 }
 
-// LoadedModules is a struct we use to hold modules and load modules etc
+// ModuleV2 is the current module interface. Run is given a context with a
+// deadline, and everything about the completed interactions in a ModuleInput
+type ModuleV2 interface {
+	Name() string
+	EnvVars() []string
+	Run(ctx context.Context, in *ModuleInput) (*ModuleResult, error)
+}
+
+// ModuleInput is what a ModuleV2 is run with
+type ModuleInput struct {
+	// Hook is when the module is being run, such as HookEnd at the end of the
+	// interactions, or HookAnswer when an interaction is answered
+	Hook string
+
+	// Submission is the interactions, with the answers so far in the order
+	// the interactions are defined in the rule. Its status is completed,
+	// cancelled, expired or in_progress. For anonymous rules, the user isn't
+	// set
+	Submission *Submission
+
+	// Answer is the answer being given, for on_answer modules. It isn't in
+	// the Submission yet
+	Answer *Answer
+
+	// Interactions are the IDs of all the rule's interactions, in the order
+	// they're defined, whether or not they've been answered
+	Interactions []string
+
+	// Config is the module's config from the rule's interaction_end_mods, if
+	// it has any. The module decodes it into whatever it expects
+	Config json.RawMessage
+
+	// Env is the module's ENV VARs, keyed by the adjusted name (like
+	// EMAILMODULE_TO), with the rule's config merged over them
+	Env map[string]string
+
+	// state and questions are what v1 modules are run with
+	state     map[string]string
+	questions map[string]string
+}
+
+// ModuleResult is what a ModuleV2 returns
+type ModuleResult struct {
+	// Status is ModuleOK or ModuleFailed, ModuleOK is assumed if it's empty.
+	// A failed run is retried, like one which returns an error
+	Status string `json:"status"`
+
+	// Message is sent to the user, if it's set. For a failed run it's the
+	// reason, which is logged instead
+	Message string `json:"message,omitempty"`
+
+	// Permanent is set on a failed run which won't work if it's retried,
+	// like a request which was refused. It's given up on straight away
+	Permanent bool `json:"permanent,omitempty"`
+
+	// Output is any data the module wants to pass on. It's logged
+	Output map[string]string `json:"output,omitempty"`
+}
+
+// TemplateData is what the templates in modules' config are given, such as
+// the webhook module's body
+type TemplateData struct {
+	// Hook is when the module is being run, such as interaction_end_mods
+	Hook string
+
+	// Submission is the interactions, with the user and the answers
+	Submission *Submission
+
+	// Answers are the answers' values, by their interaction ID
+	Answers map[string]string
+
+	// Answer is the answer being given, for on_answer modules
+	Answer *Answer
+}
+
+// TemplateData is the data for the templates in the module's config
+func (in *ModuleInput) TemplateData() *TemplateData {
+	data := &TemplateData{
+		Hook:       in.Hook,
+		Submission: in.Submission,
+		Answers:    make(map[string]string),
+		Answer:     in.Answer,
+	}
+	if in.Submission != nil {
+		for _, answer := range in.Submission.Answers {
+			data.Answers[answer.InteractionID] = answer.Value
+		}
+	}
+	return data
+}
+
+// TemplateFuncs are the extra functions the templates in modules' config can
+// use. json encodes a value, so {{json .Answers.a1}} is a quoted and escaped
+// JSON string
+var TemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// ParseTemplate parses one of the templates in a module's config, with
+// TemplateFuncs. Anything missing from the data is left empty
+func ParseTemplate(name, text string) (*template.Template, error) {
+	t, err := template.New(name).Funcs(TemplateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %s template: %s", name, err)
+	}
+	return t, nil
+}
+
+// RenderTemplate parses one of the templates in a module's config, and
+// executes it with the data
+func RenderTemplate(name, text string, data *TemplateData) (string, error) {
+	t, err := ParseTemplate(name, text)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	err = t.Execute(&buf, data)
+	if err != nil {
+		return "", fmt.Errorf("Error executing %s template: %s", name, err)
+	}
+	return buf.String(), nil
+}
+
+// DecodeConfig decodes a module's config from the rule into v, which is left
+// as it is if the rule doesn't give the module any
+func DecodeConfig(raw json.RawMessage, v interface{}) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// moduleV1 adapts a v1 Module to ModuleV2
+type moduleV1 struct {
+	Module
+}
+
+// Run runs the v1 module with the state and questions, like it always was
+func (m moduleV1) Run(ctx context.Context, in *ModuleInput) (*ModuleResult, error) {
+	err := m.Module.Run(in.state, in.Env, in.questions)
+	if err != nil {
+		return nil, err
+	}
+	return &ModuleResult{Status: ModuleOK}, nil
+}
+
+// LoadedModules is a struct we use to hold modules and load modules etc. v1
+// modules are adapted to ModuleV2
 type LoadedModules struct {
-	Modules []Module
+	Modules []ModuleV2
 }
 
-// LoadModules loads up the plugin .so files
-func (m *LoadedModules) LoadModules() error {
-	modsToLoad := make(map[string]struct{})
-	// var modsToLoad []string
+// Register adds a v1 module which is compiled into go209, so it can be used
+// in interaction_end_mods. This is called before go209 starts, usually from
+// main. Like database/sql's Register, it panics if the module is nil, or if a
+// module with the same name has already been registered
+func Register(mod Module) {
+	if mod == nil {
+		panic("go209: Register module is nil")
+	}
+	RegisterV2(moduleV1{mod})
+}
 
-	// Load Preloaded modules first
-	for _, preLoad := range strings.Split(PreloadedModules, ":") {
-		if _, ok := modsToLoad[preLoad]; !ok {
-			modsToLoad[preLoad] = struct{}{}
-			// modsToLoad = append(modsToLoad, preLoad)
+// RegisterV2 adds a ModuleV2 which is compiled into go209. Like Register, it
+// panics if the module is nil or its name is taken
+func RegisterV2(mod ModuleV2) {
+	if mod == nil {
+		panic("go209: RegisterV2 module is nil")
+	}
+	if modules.find(mod.Name()) != nil {
+		panic(fmt.Sprintf("go209: Register called twice for module %s", mod.Name()))
+	}
+	modules.Modules = append(modules.Modules, mod)
+}
+
+// find looks for a module by its name
+func (m *LoadedModules) find(name string) ModuleV2 {
+	for _, mod := range m.Modules {
+		if mod.Name() == name {
+			return mod
 		}
 	}
+	return nil
+}
+
+// moduleVersion is the version of the module interface a module implements
+func moduleVersion(mod ModuleV2) int {
+	if _, ok := mod.(moduleV1); ok {
+		return 1
+	}
+	return 2
+}
 
-	// Load dynamic modules from env var
-	if len(os.Getenv("DYNAMIC_MODULES")) > 0 {
-		for _, preLoad := range strings.Split(os.Getenv("DYNAMIC_MODULES"), ":") {
-			if _, ok := modsToLoad[preLoad]; !ok {
-				modsToLoad[preLoad] = struct{}{}
-				// modsToLoad = append(modsToLoad, preLoad)
+// moduleEnv fetches the module's ENV VARs
+func moduleEnv(mod ModuleV2) map[string]string {
+	evSet := make(map[string]string)
+	for _, ev := range mod.EnvVars() {
+		adjusted := strings.ToUpper(fmt.Sprintf("%s_%s", mod.Name(), ev))
+		evSet[adjusted] = os.Getenv(adjusted)
+	}
+	return evSet
+}
+
+// The outcomes of a module run, which are recorded for each module
+const (
+	ModuleRunOK      = "ok"
+	ModuleRunFailed  = "failed"
+	ModuleRunTimeout = "timeout"
+	ModuleRunPanic   = "panic"
+)
+
+// moduleRunOutcomes are all the outcomes, in the order they're reported
+var moduleRunOutcomes = []string{ModuleRunOK, ModuleRunFailed, ModuleRunTimeout, ModuleRunPanic}
+
+// errModuleTimeout is returned when a module doesn't finish before its
+// deadline
+var errModuleTimeout = errors.New("Module timed out")
+
+// modulePanic is returned when a module panics
+type modulePanic struct {
+	value interface{}
+}
+
+func (p modulePanic) Error() string {
+	return fmt.Sprintf("Module panicked: %v", p.value)
+}
+
+// permanentFailure is returned when a module fails, and says there's no point
+// retrying it
+type permanentFailure struct {
+	reason string
+}
+
+func (f permanentFailure) Error() string {
+	if len(f.reason) > 0 {
+		return fmt.Sprintf("Module failed: %s", f.reason)
+	}
+	return "Module failed"
+}
+
+// moduleOutcome is the outcome of a module run, from the error it returned
+func moduleOutcome(err error) string {
+	switch err.(type) {
+	case nil:
+		return ModuleRunOK
+	case modulePanic:
+		return ModuleRunPanic
+	}
+	if err == errModuleTimeout {
+		return ModuleRunTimeout
+	}
+	return ModuleRunFailed
+}
+
+// runIsolated runs fn for a module with a deadline, in its own goroutine. If
+// fn doesn't return by the deadline (v1 modules can't be told about it), it's
+// left to finish in the background and errModuleTimeout is returned. A panic
+// is recovered and returned as an error, so it can't take go209 down
+func runIsolated(name string, timeout time.Duration, fn func(ctx context.Context) error) error {
+	if timeout <= 0 {
+		timeout = DefaultModuleTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// buffered, so the goroutine can finish after we've stopped waiting
+	done := make(chan error, 1)
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Warn(fmt.Sprintf("Module %s panicked: %v\n%s", name, r, debug.Stack()))
+				done <- modulePanic{r}
 			}
+		}()
+		done <- fn(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return errModuleTimeout
+	}
+}
+
+// runModule runs a module with a deadline, isolated from the rest of go209. A
+// failed status is returned as an error, so the run is retried (unless it's
+// permanent)
+func runModule(mod ModuleV2, in *ModuleInput, timeout time.Duration) (*ModuleResult, error) {
+	var result *ModuleResult
+	err := runIsolated(mod.Name(), timeout, func(ctx context.Context) error {
+		var err error
+		result, err = mod.Run(ctx, in)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if result == nil {
+		result = &ModuleResult{Status: ModuleOK}
+	}
+	if result.Status == ModuleFailed {
+		if result.Permanent {
+			return nil, permanentFailure{result.Message}
+		}
+		if len(result.Message) > 0 {
+			return nil, fmt.Errorf("Module failed: %s", result.Message)
 		}
+		return nil, fmt.Errorf("Module failed")
+	}
+	return result, nil
+}
+
+// callModule runs a module with its config from the rule merged over its
+// ENV VARs, and records how the run went
+func callModule(db StateStore, name string, config json.RawMessage, timeout time.Duration, in *ModuleInput) (*ModuleResult, error) {
+	mod := modules.find(name)
+	if mod == nil {
+		return nil, fmt.Errorf("Referenced module not found: %s", name)
+	}
+	log.Debug(fmt.Sprintf("Running module %s (%s) for submission %s", mod.Name(), in.Hook, in.Submission.ID))
+
+	env, err := mergeModuleConfig(mod, moduleEnv(mod), config)
+	if err != nil {
+		return nil, fmt.Errorf("Error with module %s config: %s", mod.Name(), err)
 	}
+	in.Config = config
+	in.Env = env
 
-	for preLoad := range modsToLoad {
-		plug, err := plugin.Open(fmt.Sprintf("./%s.so", preLoad))
+	started := time.Now()
+	result, err := runModule(mod, in, timeout)
+	recordModuleRun(db, mod.Name(), moduleOutcome(err), time.Since(started))
+	return result, err
+}
+
+// pluginPath is where a plugin is loaded from. This is either the path to a
+// .so file, or the name of one in the working directory (without the .so)
+func pluginPath(plug string) string {
+	if strings.HasSuffix(plug, ".so") {
+		return plug
+	}
+	return fmt.Sprintf("./%s.so", plug)
+}
+
+// LoadPlugins loads modules from .so plugins, on top of those compiled into
+// go209. plugins is a list separated with ":", as in DYNAMIC_MODULES
+func (m *LoadedModules) LoadPlugins(plugins string) error {
+	for _, plug := range strings.Split(plugins, ":") {
+		plug = strings.TrimSpace(plug)
+		if len(plug) == 0 {
+			continue
+		}
+		path := pluginPath(plug)
+
+		p, err := plugin.Open(path)
 		if err != nil {
-			return err
+			return fmt.Errorf("Error loading module plugin %s: %s", path, err)
 		}
 
-		symMod, err := plug.Lookup("Module")
+		symMod, err := p.Lookup("Module")
 		if err != nil {
-			return err
+			return fmt.Errorf("Error loading module plugin %s: %s", path, err)
 		}
 
-		var mod Module
-		mod, ok := symMod.(Module)
-		if !ok {
-			return errors.New("Unexpected type from module")
+		err = m.addPlugin(path, symMod)
+		if err != nil {
+			return err
 		}
+	}
+
+	return nil
+}
+
+// addPlugin adds the Module symbol loaded from a plugin, adapting it if it's a
+// v1 module
+func (m *LoadedModules) addPlugin(path string, symMod interface{}) error {
+	var mod ModuleV2
+	switch sym := symMod.(type) {
+	case ModuleV2:
+		mod = sym
+	case Module:
+		mod = moduleV1{sym}
+	default:
+		return fmt.Errorf("Error loading module plugin %s: Unexpected type from module", path)
+	}
 
-		m.Modules = append(m.Modules, mod)
+	if m.find(mod.Name()) != nil {
+		return fmt.Errorf("Error loading module plugin %s: a module called %s is already loaded", path, mod.Name())
 	}
 
+	log.Debug(fmt.Sprintf("Loaded module %s from %s", mod.Name(), path))
+	m.Modules = append(m.Modules, mod)
 	return nil
 }
 
-// DumpMods prints information about the loaded modules
-func DumpMods() error {
+// loadPlugins loads the .so plugins configured in DYNAMIC_MODULES. They're
+// only loaded once, even if the slack bot and web server both start
+func loadPlugins(cfg *BotConfig) error {
+	pluginsOnce.Do(func() {
+		pluginsErr = modules.LoadPlugins(cfg.DynamicModules)
+	})
+	return pluginsErr
+}
+
+var (
+	pluginsOnce sync.Once
+	pluginsErr  error
+)
+
+// DumpMods loads the plugins, then prints information about all the modules
+func DumpMods(cfg *BotConfig) error {
+	err := loadPlugins(cfg)
+	if err != nil {
+		return err
+	}
+
 	fmt.Println("Number of modules loaded: ", len(modules.Modules))
 	fmt.Println("Listing loaded modules:")
 
 	for _, mod := range modules.Modules {
-		fmt.Printf("Module: %s\n", mod.Name())
+		if _, ok := moduleProvider(mod); ok {
+			fmt.Printf("Module: %s (v%d, data provider)\n", mod.Name(), moduleVersion(mod))
+		} else {
+			fmt.Printf("Module: %s (v%d)\n", mod.Name(), moduleVersion(mod))
+		}
 		if len(mod.EnvVars()) > 0 {
 			fmt.Println("EnvVars:")
 			for _, ev := range mod.EnvVars() {
@@ -87,6 +483,25 @@ func DumpMods() error {
 				fmt.Printf("\t%s (%s)\n", ev, adjusted)
 			}
 		}
+
+		schema := moduleSchema(mod)
+		if len(schema) > 0 {
+			var names []string
+			for name := range schema {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			fmt.Println("Config:")
+			for _, name := range names {
+				field := schema[name]
+				required := ""
+				if field.Required {
+					required = ", required"
+				}
+				fmt.Printf("\t%s (%s%s) %s\n", name, field.Type, required, field.Description)
+			}
+		}
 	}
 	return nil
 }
@@ -95,11 +510,3 @@ func DumpMods() error {
 func FetchMods() LoadedModules {
 	return modules
 }
-
-func init() {
-	err := modules.LoadModules()
-	if err != nil {
-		log.Fatal(fmt.Sprintf("Error loading modules: %s", err))
-	}
-	// log.Info(fmt.Sprintf("*** Modules loaded successfully count: %d\n", len(modules.Modules)))
-}
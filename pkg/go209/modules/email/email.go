@@ -1,13 +1,19 @@
-package main
+// Package email is a go209 module which emails the responses to a set of
+// interactions
+package email
 
 import (
 	"fmt"
 	"strconv"
 	"strings"
 
+	"github.com/xntrik/go209/pkg/go209"
 	"gopkg.in/gomail.v2"
 )
 
+// defaultSubject is the email's subject, if EMAILMODULE_SUBJECT isn't set
+const defaultSubject = "Email from the go209 slackbot"
+
 type emailModule string
 
 func (tm emailModule) Name() string {
@@ -15,7 +21,17 @@ func (tm emailModule) Name() string {
 }
 
 func (tm emailModule) EnvVars() []string {
-	return []string{"FROM", "TO", "SMTPSERVER", "USERNAME", "PASSWORD", "SKIPTLS"}
+	return []string{"FROM", "TO", "SUBJECT", "SMTPSERVER", "USERNAME", "PASSWORD", "SKIPTLS"}
+}
+
+// ConfigSchema is the config a rule can give the module, over its ENV VARs.
+// The SMTP credentials can only be set with ENV VARs
+func (tm emailModule) ConfigSchema() map[string]go209.ConfigField {
+	return map[string]go209.ConfigField{
+		"from":    {Type: go209.ConfigString, Description: "Who the email is from"},
+		"to":      {Type: go209.ConfigString, Description: "Who the email is sent to"},
+		"subject": {Type: go209.ConfigString, Description: "The email's subject"},
+	}
 }
 
 func (tm emailModule) Run(in interface{}, ev map[string]string, interactions map[string]string) error {
@@ -33,7 +49,10 @@ func (tm emailModule) Run(in interface{}, ev map[string]string, interactions map
 			return err
 		}
 
-		Subject := "Email from the go209 slackbot"
+		Subject := ev["EMAILMODULE_SUBJECT"]
+		if len(Subject) == 0 {
+			Subject = defaultSubject
+		}
 		// Build email
 		emailBody := "go209 slack bot received a complete response from someone.\nHere is the data\n"
 
@@ -95,7 +114,10 @@ func (tm emailModule) Run(in interface{}, ev map[string]string, interactions map
 			return err
 		}
 
-		Subject := "Email from the go209 slackbot"
+		Subject := ev["EMAILMODULE_SUBJECT"]
+		if len(Subject) == 0 {
+			Subject = defaultSubject
+		}
 		// Build email
 		emailBody := "go209 slack bot received a complete response from someone.\nHere is the data\n"
 
@@ -143,5 +165,5 @@ func (tm emailModule) Run(in interface{}, ev map[string]string, interactions map
 	return nil
 }
 
-// Module is exported for the plugin system
+// Module is registered with go209.Register
 var Module emailModule
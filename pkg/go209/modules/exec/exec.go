@@ -0,0 +1,184 @@
+// Package exec is a go209 module which pipes a set of interactions to an
+// external program, so integrations can be written in any language
+package exec
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	osexec "os/exec"
+	"strings"
+
+	"github.com/xntrik/go209/pkg/go209"
+)
+
+// maxOutput is how much of the program's stdout and stderr is kept. stdout is
+// sent to the user if reply is set, and stderr is logged if it fails
+const maxOutput = 4000
+
+// config is the module's config from the rule. The command is merged into
+// the module's ENV VARs, so it's taken from there
+type config struct {
+	Args  []string          `json:"args"`
+	Env   map[string]string `json:"env"`
+	Dir   string            `json:"dir"`
+	Reply bool              `json:"reply"`
+}
+
+// limitedBuffer keeps the first max bytes written to it, and throws away the
+// rest, so a chatty program can't use up all our memory
+type limitedBuffer struct {
+	buf bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.buf.Len(); room > 0 {
+		if len(p) > room {
+			b.buf.Write(p[:room])
+		} else {
+			b.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	return strings.TrimSpace(b.buf.String())
+}
+
+type execModule string
+
+func (em execModule) Name() string {
+	return "ExecModule"
+}
+
+func (em execModule) EnvVars() []string {
+	return []string{"COMMAND"}
+}
+
+// ConfigSchema is the config a rule can give the module
+func (em execModule) ConfigSchema() map[string]go209.ConfigField {
+	return map[string]go209.ConfigField{
+		"command": {Type: go209.ConfigString, Description: "The program to run"},
+		"args":    {Type: go209.ConfigList, Description: "The program's arguments"},
+		"env":     {Type: go209.ConfigObject, Description: "ENV VARs to pass to the program, their values are templates"},
+		"dir":     {Type: go209.ConfigString, Description: "The directory to run the program in"},
+		"reply":   {Type: go209.ConfigBool, Description: "Send what the program writes to stdout to the user"},
+	}
+}
+
+// ValidateConfig checks the env templates, so mistakes are found when go209
+// starts rather than when someone completes the interactions
+func (em execModule) ValidateConfig(raw json.RawMessage) error {
+	cfg := &config{}
+	err := go209.DecodeConfig(raw, cfg)
+	if err != nil {
+		return err
+	}
+
+	for name, value := range cfg.Env {
+		_, err = go209.ParseTemplate(name, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// programEnv is the program's environment. It doesn't get go209's, which
+// has secrets like the slack token, only the PATH and HOME, details of the
+// submission, and the ENV VARs from the rule
+func programEnv(cfg *config, data *go209.TemplateData) ([]string, error) {
+	env := []string{
+		fmt.Sprintf("PATH=%s", os.Getenv("PATH")),
+		fmt.Sprintf("HOME=%s", os.Getenv("HOME")),
+		fmt.Sprintf("GO209_HOOK=%s", data.Hook),
+		fmt.Sprintf("GO209_SUBMISSION_ID=%s", data.Submission.ID),
+		fmt.Sprintf("GO209_RULE=%s", data.Submission.Rule),
+		fmt.Sprintf("GO209_STATUS=%s", data.Submission.Status),
+		fmt.Sprintf("GO209_USERID=%s", data.Submission.UserID),
+		fmt.Sprintf("GO209_USERNAME=%s", data.Submission.Username),
+	}
+
+	for name, value := range cfg.Env {
+		value, err := go209.RenderTemplate(name, value, data)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, fmt.Sprintf("%s=%s", name, value))
+	}
+
+	return env, nil
+}
+
+func (em execModule) Run(ctx context.Context, in *go209.ModuleInput) (*go209.ModuleResult, error) {
+	cfg := &config{}
+	err := go209.DecodeConfig(in.Config, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// the command can come from the rule, or the ENV VAR
+	command := in.Env["EXECMODULE_COMMAND"]
+	if len(command) == 0 {
+		return nil, errors.New("Missing ExecModule COMMAND param")
+	}
+
+	stdin, err := json.Marshal(in.Submission)
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := programEnv(cfg, in.TemplateData())
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := osexec.Command(command, cfg.Args...)
+	cmd.Env = env
+	cmd.Dir = cfg.Dir
+	cmd.Stdin = bytes.NewReader(stdin)
+	stdout := &limitedBuffer{max: maxOutput}
+	stderr := &limitedBuffer{max: maxOutput}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	setProcessGroup(cmd)
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %s", command, err)
+	}
+
+	// the program is killed if it's still running at the deadline, along with
+	// anything it started, which would otherwise keep its output open and the
+	// module waiting
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd)
+		case <-done:
+		}
+	}()
+	err = cmd.Wait()
+	close(done)
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("%s was killed: %s", command, ctx.Err())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %s: %s", command, err, stderr.String())
+	}
+
+	result := &go209.ModuleResult{Status: go209.ModuleOK}
+	if cfg.Reply {
+		result.Message = stdout.String()
+	}
+	return result, nil
+}
+
+// Module is registered with go209.RegisterV2
+var Module execModule
@@ -0,0 +1,80 @@
+package exec
+
+import (
+	"context"
+	"encoding/json"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xntrik/go209/pkg/go209"
+)
+
+// testInput is a submission for the module to run the shell script with
+func testInput(config, script string) *go209.ModuleInput {
+	args, _ := json.Marshal([]string{"-c", script})
+	return &go209.ModuleInput{
+		Hook:       go209.HookEnd,
+		Submission: &go209.Submission{ID: "sub1", Rule: "rule", Answers: []go209.Answer{{InteractionID: "a1", Value: "yes"}}},
+		Config:     json.RawMessage(`{"args": ` + string(args) + config + `}`),
+		Env:        map[string]string{"EXECMODULE_COMMAND": "/bin/sh"},
+	}
+}
+
+func TestRun(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs /bin/sh")
+	}
+
+	tests := []struct {
+		name    string
+		config  string
+		script  string
+		want    string
+		wantErr string
+	}{
+		{"reply", `, "reply": true`, "echo $GO209_SUBMISSION_ID", "sub1", ""},
+		{"no reply", "", "echo $GO209_SUBMISSION_ID", "", ""},
+		{"env template", `, "reply": true, "env": {"ANSWER": "{{.Answers.a1}}"}`, "echo $ANSWER", "yes", ""},
+		{"stdin", `, "reply": true`, "cat", `"id":"sub1"`, ""},
+		{"failure", "", "echo broken >&2; exit 3", "", "broken"},
+	}
+
+	for _, test := range tests {
+		result, err := Module.Run(context.Background(), testInput(test.config, test.script))
+		if len(test.wantErr) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: Run error = %v, want %q", test.name, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Run error: %s", test.name, err)
+			continue
+		}
+		if !strings.Contains(result.Message, test.want) || (len(test.want) == 0 && len(result.Message) > 0) {
+			t.Errorf("%s: Run message = %q, want %q", test.name, result.Message, test.want)
+		}
+	}
+}
+
+func TestRunKillsProcessGroup(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs /bin/sh")
+	}
+
+	// the background sleep keeps stdout open, so the module would wait for it
+	// if only the shell was killed
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	_, err := Module.Run(ctx, testInput("", "sleep 10 & sleep 10; wait"))
+	if err == nil {
+		t.Error("Run past its deadline didn't fail")
+	}
+	if took := time.Since(started); took > 5*time.Second {
+		t.Errorf("Run took %s, the program's children weren't killed", took)
+	}
+}
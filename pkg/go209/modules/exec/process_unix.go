@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package exec
+
+import (
+	osexec "os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts the program in its own process group, so anything
+// it starts can be killed along with it
+func setProcessGroup(cmd *osexec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessGroup kills the program, and everything in its process group
+func killProcessGroup(cmd *osexec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,17 @@
+//go:build windows
+// +build windows
+
+package exec
+
+import (
+	osexec "os/exec"
+)
+
+// setProcessGroup does nothing on Windows, which doesn't have process groups
+func setProcessGroup(cmd *osexec.Cmd) {
+}
+
+// killProcessGroup kills the program. Anything it started is left running
+func killProcessGroup(cmd *osexec.Cmd) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,151 @@
+package sink
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/xntrik/go209/pkg/go209"
+)
+
+type csvModule string
+
+func (cm csvModule) Name() string {
+	return "CSVModule"
+}
+
+func (cm csvModule) EnvVars() []string {
+	return []string{"DIR"}
+}
+
+// ConfigSchema is the config a rule can give the module
+func (cm csvModule) ConfigSchema() map[string]go209.ConfigField {
+	schema := map[string]go209.ConfigField{
+		"dir": {Type: go209.ConfigString, Description: "The directory the rules' CSV files are in"},
+	}
+	for name, field := range fieldsSchema {
+		schema[name] = field
+	}
+	return schema
+}
+
+// ValidateConfig checks the fields
+func (cm csvModule) ValidateConfig(raw json.RawMessage) error {
+	return validateFields(raw)
+}
+
+// fileName turns a name into a file name, keeping letters, numbers, - and _
+func fileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '-'
+	}, name)
+	if len(strings.Trim(name, "-")) == 0 {
+		return "rule"
+	}
+	return name
+}
+
+// ruleFileName is the name of a rule's CSV file. Different rule names can
+// make the same file name, like "Pizza survey" and "pizza-survey", so it ends
+// with a hash of the rule's name
+func ruleFileName(rule string) string {
+	sum := sha256.Sum256([]byte(rule))
+	return fmt.Sprintf("%s-%s.csv", fileName(rule), hex.EncodeToString(sum[:4]))
+}
+
+// appendRow adds the record to the CSV file as a row. The columns are set by
+// the header, which is written from the first record if the file is new. If
+// the record has a value for a field which isn't a column, the row isn't
+// added, rather than lose the value
+func appendRow(path string, rec *record) error {
+	fileLock.Lock()
+	defer fileLock.Unlock()
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	header, err := csv.NewReader(file).Read()
+	if err != nil && err != io.EOF {
+		return err
+	}
+	_, err = file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	cw := csv.NewWriter(file)
+	if len(header) == 0 {
+		header = rec.names
+		err = cw.Write(header)
+		if err != nil {
+			return err
+		}
+	}
+
+	columns := make(map[string]bool)
+	row := make([]string, 0, len(header))
+	for _, name := range header {
+		columns[name] = true
+		row = append(row, rec.cell(name))
+	}
+	for _, name := range rec.names {
+		if !columns[name] && len(rec.cell(name)) > 0 {
+			return fmt.Errorf("%s isn't a column in %s, move the file aside to start a new one with it", name, path)
+		}
+	}
+	err = cw.Write(row)
+	if err != nil {
+		return err
+	}
+
+	cw.Flush()
+	if err = cw.Error(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+func (cm csvModule) Run(ctx context.Context, in *go209.ModuleInput) (*go209.ModuleResult, error) {
+	cfg, err := decodeConfig(in.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	// the directory can come from the rule, or the ENV VAR
+	dir := in.Env["CSVMODULE_DIR"]
+	if len(dir) == 0 {
+		return nil, errors.New("Missing CSVModule DIR param")
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, ruleFileName(in.Submission.Rule))
+	err = appendRow(path, newRecord(in, cfg))
+	if err != nil {
+		return nil, err
+	}
+	return &go209.ModuleResult{Status: go209.ModuleOK}, nil
+}
+
+// CSVModule is registered with go209.RegisterV2
+var CSVModule csvModule
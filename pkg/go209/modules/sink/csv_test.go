@@ -0,0 +1,82 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xntrik/go209/pkg/go209"
+)
+
+// testInput is a submission of a rule with three interactions, where the
+// answers are only given to the ones in answers
+func testInput(config, dir string, answers ...go209.Answer) *go209.ModuleInput {
+	return &go209.ModuleInput{
+		Hook:         go209.HookEnd,
+		Submission:   &go209.Submission{ID: "sub1", Rule: "Pizza survey", UserID: "U1", Username: "bob", Status: go209.SubmissionCompleted, Answers: answers},
+		Interactions: []string{"a1", "a2", "a3"},
+		Config:       json.RawMessage(config),
+		Env:          map[string]string{"CSVMODULE_DIR": dir},
+	}
+}
+
+func TestCSVColumns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go209")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the first submission skipped a2 and a3, but they still get columns
+	rows := [][]go209.Answer{
+		{{InteractionID: "a1", Value: "pepperoni"}},
+		{{InteractionID: "a1", Value: "ham"}, {InteractionID: "a2", Value: "yes"}, {InteractionID: "a3", Value: "thin, thick", Values: []string{"thin", "thick"}}},
+	}
+	for _, answers := range rows {
+		_, err := CSVModule.Run(context.Background(), testInput(`{"fields": ["username", "answers"]}`, dir, answers...))
+		if err != nil {
+			t.Fatalf("Run error: %s", err)
+		}
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, ruleFileName("Pizza survey")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "username,answers.a1,answers.a2,answers.a3\nbob,pepperoni,,\nbob,ham,yes,thin; thick\n"
+	if string(b) != want {
+		t.Errorf("CSV = %q, want %q", b, want)
+	}
+
+	// a value for a field which isn't a column fails, rather than being lost
+	in := testInput(`{"fields": ["username", "answers"]}`, dir, go209.Answer{InteractionID: "a4", Value: "extra"})
+	in.Interactions = append(in.Interactions, "a4")
+	_, err = CSVModule.Run(context.Background(), in)
+	if err == nil || !strings.Contains(err.Error(), "answers.a4") {
+		t.Errorf("Run with a new field = %v, want an error about answers.a4", err)
+	}
+}
+
+func TestRuleFileName(t *testing.T) {
+	names := []string{"Pizza survey", "pizza-survey", "pizza survey", "Pizza Survey!"}
+
+	seen := make(map[string]string)
+	for _, name := range names {
+		file := ruleFileName(name)
+		if !strings.HasPrefix(file, "pizza-survey") || !strings.HasSuffix(file, ".csv") {
+			t.Errorf("ruleFileName(%q) = %q, want pizza-survey-<hash>.csv", name, file)
+		}
+		if other, ok := seen[file]; ok {
+			t.Errorf("ruleFileName(%q) = ruleFileName(%q) = %q", name, other, file)
+		}
+		seen[file] = name
+
+		if again := ruleFileName(name); again != file {
+			t.Errorf("ruleFileName(%q) changed from %q to %q", name, file, again)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/xntrik/go209/pkg/go209"
+)
+
+type dirModule string
+
+func (dm dirModule) Name() string {
+	return "DirModule"
+}
+
+func (dm dirModule) EnvVars() []string {
+	return []string{"DIR"}
+}
+
+// ConfigSchema is the config a rule can give the module
+func (dm dirModule) ConfigSchema() map[string]go209.ConfigField {
+	schema := map[string]go209.ConfigField{
+		"dir": {Type: go209.ConfigString, Description: "The directory the files are written to"},
+	}
+	for name, field := range fieldsSchema {
+		schema[name] = field
+	}
+	return schema
+}
+
+// ValidateConfig checks the fields
+func (dm dirModule) ValidateConfig(raw json.RawMessage) error {
+	return validateFields(raw)
+}
+
+// writeFile writes the file by renaming a temporary one into place, so
+// whatever picks the files up never sees half of one
+func writeFile(dir, name string, data []byte) error {
+	tmp, err := ioutil.TempFile(dir, ".go209-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, name))
+}
+
+func (dm dirModule) Run(ctx context.Context, in *go209.ModuleInput) (*go209.ModuleResult, error) {
+	cfg, err := decodeConfig(in.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	// the directory can come from the rule, or the ENV VAR
+	dir := in.Env["DIRMODULE_DIR"]
+	if len(dir) == 0 {
+		return nil, errors.New("Missing DirModule DIR param")
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := newRecord(in, cfg).json()
+	if err != nil {
+		return nil, err
+	}
+
+	// the submission's hooks other than interaction_end_mods get their own
+	// files, so they don't replace each other
+	name := fileName(in.Submission.ID)
+	if len(in.Hook) > 0 && in.Hook != go209.HookEnd {
+		name = name + "." + fileName(in.Hook)
+	}
+
+	err = writeFile(dir, name+".json", append(data, '\n'))
+	if err != nil {
+		return nil, err
+	}
+	return &go209.ModuleResult{Status: go209.ModuleOK}, nil
+}
+
+// DirModule is registered with go209.RegisterV2
+var DirModule dirModule
@@ -0,0 +1,118 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/xntrik/go209/pkg/go209"
+)
+
+// readJSON decodes the JSON file
+func readJSON(t *testing.T, path string) map[string]interface{} {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v map[string]interface{}
+	err = json.Unmarshal(b, &v)
+	if err != nil {
+		t.Fatalf("bad JSON in %s: %s", path, err)
+	}
+	return v
+}
+
+func TestDirRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go209")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the directory is created if it isn't there
+	out := filepath.Join(dir, "submissions", "pizza")
+	run := func(hook, id, config string, answers ...go209.Answer) error {
+		in := testInput(config, "", answers...)
+		in.Hook = hook
+		in.Submission.ID = id
+		in.Env = map[string]string{"DIRMODULE_DIR": out}
+		_, err := DirModule.Run(context.Background(), in)
+		return err
+	}
+
+	config := `{"fields": ["id", "hook", "userid", "answers"], "redact": ["userid"]}`
+	steps := []struct {
+		hook    string
+		id      string
+		answers []go209.Answer
+	}{
+		{go209.HookCancel, "sub1", nil},
+		{go209.HookEnd, "sub1", []go209.Answer{{InteractionID: "a1", Value: "pepperoni"}}},
+		{go209.HookEnd, "sub1", []go209.Answer{{InteractionID: "a1", Value: "ham"}}},
+		{go209.HookEnd, "../Sub 2", []go209.Answer{{InteractionID: "a2", Value: "yes"}}},
+	}
+	for _, step := range steps {
+		err := run(step.hook, step.id, config, step.answers...)
+		if err != nil {
+			t.Fatalf("Run %s for %s error: %s", step.hook, step.id, err)
+		}
+	}
+
+	// a file for each submission, and its hooks other than the end, which is
+	// replaced if it's run again. The IDs are made safe to use as names, and
+	// nothing is left half written
+	files, err := ioutil.ReadDir(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	sort.Strings(names)
+	want := []string{"---sub-2.json", "sub1.json", "sub1.on_cancel.json"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("files = %v, want %v", names, want)
+	}
+
+	got := readJSON(t, filepath.Join(out, "sub1.json"))
+	wantJSON := map[string]interface{}{
+		"id":      "sub1",
+		"hook":    go209.HookEnd,
+		"userid":  redacted,
+		"answers": map[string]interface{}{"a1": "ham", "a2": nil, "a3": nil},
+	}
+	if !reflect.DeepEqual(got, wantJSON) {
+		t.Errorf("sub1.json = %v, want %v", got, wantJSON)
+	}
+	if got := readJSON(t, filepath.Join(out, "sub1.on_cancel.json")); got["hook"] != go209.HookCancel {
+		t.Errorf("sub1.on_cancel.json = %v, want the on_cancel hook", got)
+	}
+
+	// without fields, everything is written
+	err = run(go209.HookEnd, "sub3", `{}`, go209.Answer{InteractionID: "a1", Value: "ham"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = readJSON(t, filepath.Join(out, "sub3.json"))
+	for _, field := range baseFields {
+		if _, ok := got[field]; !ok {
+			t.Errorf("sub3.json doesn't have %s: %v", field, got)
+		}
+	}
+	if got["username"] != "bob" {
+		t.Errorf("sub3.json username = %v, want bob", got["username"])
+	}
+
+	in := testInput(`{}`, "")
+	in.Env = map[string]string{}
+	if _, err := DirModule.Run(context.Background(), in); err == nil || !strings.Contains(err.Error(), "DIR") {
+		t.Errorf("Run without a dir = %v, want an error about the DIR", err)
+	}
+}
@@ -0,0 +1,134 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/xntrik/go209/pkg/go209"
+)
+
+// The defaults for rotating the JSONL file, if the rule doesn't set them. The
+// size is in MB
+const (
+	defaultMaxSize  = 10
+	defaultMaxFiles = 5
+)
+
+type jsonlModule string
+
+func (jm jsonlModule) Name() string {
+	return "JSONLModule"
+}
+
+func (jm jsonlModule) EnvVars() []string {
+	return []string{"PATH"}
+}
+
+// ConfigSchema is the config a rule can give the module
+func (jm jsonlModule) ConfigSchema() map[string]go209.ConfigField {
+	schema := map[string]go209.ConfigField{
+		"path":      {Type: go209.ConfigString, Description: "The file to append to"},
+		"max_size":  {Type: go209.ConfigNumber, Description: "The size in MB the file is rotated at (default: 10)"},
+		"max_files": {Type: go209.ConfigNumber, Description: "How many rotated files are kept (default: 5)"},
+	}
+	for name, field := range fieldsSchema {
+		schema[name] = field
+	}
+	return schema
+}
+
+// ValidateConfig checks the fields, and the rotation settings
+func (jm jsonlModule) ValidateConfig(raw json.RawMessage) error {
+	cfg, err := decodeConfig(raw)
+	if err != nil {
+		return err
+	}
+	if cfg.MaxSize < 0 || cfg.MaxFiles < 0 {
+		return errors.New("max_size and max_files can't be negative")
+	}
+	return validateFields(raw)
+}
+
+// rotate moves the file to .1, and any older ones up by one, removing the
+// oldest
+func rotate(path string, maxFiles int) error {
+	err := os.Remove(fmt.Sprintf("%s.%d", path, maxFiles))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := maxFiles - 1; i >= 1; i-- {
+		err = os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(path, fmt.Sprintf("%s.1", path))
+}
+
+// appendLine appends a line to the file, rotating it first if the line
+// would take it over maxSize bytes
+func appendLine(path string, line []byte, maxSize int64, maxFiles int) error {
+	fileLock.Lock()
+	defer fileLock.Unlock()
+
+	info, err := os.Stat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil && info.Size() > 0 && info.Size()+int64(len(line)) > maxSize {
+		err = rotate(path, maxFiles)
+		if err != nil {
+			return fmt.Errorf("Error rotating %s: %s", path, err)
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(line)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (jm jsonlModule) Run(ctx context.Context, in *go209.ModuleInput) (*go209.ModuleResult, error) {
+	cfg, err := decodeConfig(in.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	// the path can come from the rule, or the ENV VAR
+	path := in.Env["JSONLMODULE_PATH"]
+	if len(path) == 0 {
+		return nil, errors.New("Missing JSONLModule PATH param")
+	}
+
+	maxSize := cfg.MaxSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxSize
+	}
+	maxFiles := cfg.MaxFiles
+	if maxFiles <= 0 {
+		maxFiles = defaultMaxFiles
+	}
+
+	line, err := newRecord(in, cfg).json()
+	if err != nil {
+		return nil, err
+	}
+
+	err = appendLine(path, append(line, '\n'), int64(maxSize*1024*1024), maxFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &go209.ModuleResult{Status: go209.ModuleOK}, nil
+}
+
+// JSONLModule is registered with go209.RegisterV2
+var JSONLModule jsonlModule
@@ -0,0 +1,175 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/xntrik/go209/pkg/go209"
+)
+
+// readLines returns the lines in the file, or nil if it doesn't exist
+func readLines(t *testing.T, path string) []string {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+}
+
+func TestAppendLineRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go209")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+
+	// each line is 8 bytes, so two fit in 16 and the third rotates the file
+	for i := 1; i <= 7; i++ {
+		err := appendLine(path, []byte(fmt.Sprintf("line %02d\n", i)), 16, 2)
+		if err != nil {
+			t.Fatalf("appendLine %d error: %s", i, err)
+		}
+	}
+
+	want := map[string][]string{
+		path:        {"line 07"},
+		path + ".1": {"line 05", "line 06"},
+		path + ".2": {"line 03", "line 04"},
+		path + ".3": nil,
+	}
+	for file, lines := range want {
+		if got := readLines(t, file); !reflect.DeepEqual(got, lines) {
+			t.Errorf("%s = %v, want %v", filepath.Base(file), got, lines)
+		}
+	}
+
+	// only max_files rotated files are kept
+	files, _ := filepath.Glob(path + "*")
+	if len(files) != 3 {
+		t.Errorf("files = %v, want the file and 2 rotated ones", files)
+	}
+}
+
+func TestAppendLineLongLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go209")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+
+	// a line longer than max_size goes into an empty file, rather than
+	// rotating it away, then the next one rotates it
+	long := strings.Repeat("x", 30) + "\n"
+	for _, line := range []string{long, "short\n"} {
+		err := appendLine(path, []byte(line), 16, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := readLines(t, path+".1"); !reflect.DeepEqual(got, []string{strings.TrimSpace(long)}) {
+		t.Errorf("audit.jsonl.1 = %v, want the long line", got)
+	}
+	if got := readLines(t, path); !reflect.DeepEqual(got, []string{"short"}) {
+		t.Errorf("audit.jsonl = %v, want the short line", got)
+	}
+	if _, err := os.Stat(path + ".2"); !os.IsNotExist(err) {
+		t.Errorf("the empty file was rotated: %v", err)
+	}
+}
+
+func TestJSONLRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go209")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+
+	run := func(config string) error {
+		in := testInput(config, "", go209.Answer{InteractionID: "a1", Value: "ham"}, go209.Answer{InteractionID: "a2", Value: "thin, thick", Values: []string{"thin", "thick"}})
+		in.Env = map[string]string{"JSONLMODULE_PATH": path}
+		_, err := JSONLModule.Run(context.Background(), in)
+		return err
+	}
+
+	// the fields are picked and redacted like the other sinks
+	err = run(`{"fields": ["id", "username", "answers"], "redact": ["username", "answers.a1"]}`)
+	if err != nil {
+		t.Fatalf("Run error: %s", err)
+	}
+	lines := readLines(t, path)
+	if len(lines) != 1 {
+		t.Fatalf("lines = %v, want 1", lines)
+	}
+	var got map[string]interface{}
+	err = json.Unmarshal([]byte(lines[0]), &got)
+	if err != nil {
+		t.Fatalf("bad JSON %s: %s", lines[0], err)
+	}
+	want := map[string]interface{}{
+		"id":       "sub1",
+		"username": redacted,
+		"answers":  map[string]interface{}{"a1": redacted, "a2": []interface{}{"thin", "thick"}, "a3": nil},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("line = %v, want %v", got, want)
+	}
+
+	// max_size is in MB, so a small enough one rotates every line, and
+	// max_files of 1 keeps only the last rotated file
+	for i := 0; i < 3; i++ {
+		err = run(`{"fields": ["id"], "max_size": 0.00001, "max_files": 1}`)
+		if err != nil {
+			t.Fatalf("Run error: %s", err)
+		}
+	}
+	files, _ := filepath.Glob(path + "*")
+	if len(files) != 2 || len(readLines(t, path)) != 1 || len(readLines(t, path+".1")) != 1 {
+		t.Errorf("files = %v, want the file and 1 rotated one, with a line each", files)
+	}
+
+	in := testInput(`{}`, "")
+	in.Env = map[string]string{}
+	if _, err := JSONLModule.Run(context.Background(), in); err == nil || !strings.Contains(err.Error(), "PATH") {
+		t.Errorf("Run without a path = %v, want an error about the PATH", err)
+	}
+}
+
+func TestJSONLValidateConfig(t *testing.T) {
+	tests := []struct {
+		config  string
+		wantErr string
+	}{
+		{`{}`, ""},
+		{`{"path": "/var/log/go209.jsonl", "max_size": 0.5, "max_files": 3, "fields": ["id", "answers.a1"], "redact": ["answers"]}`, ""},
+		{`{"max_size": -1}`, "can't be negative"},
+		{`{"max_files": -1}`, "can't be negative"},
+		{`{"fields": ["email"]}`, "Unknown field 'email'"},
+		{`{"redact": ["answers."]}`, "Unknown field 'answers.'"},
+	}
+
+	for _, test := range tests {
+		err := JSONLModule.ValidateConfig(json.RawMessage(test.config))
+		if len(test.wantErr) == 0 {
+			if err != nil {
+				t.Errorf("ValidateConfig(%s) error: %s", test.config, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("ValidateConfig(%s) = %v, want %q", test.config, err, test.wantErr)
+		}
+	}
+}
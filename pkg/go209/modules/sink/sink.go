@@ -0,0 +1,212 @@
+// Package sink has go209 modules which write each set of interactions to
+// files, for audit logs and simple integrations: JSONLModule appends them to
+// a rotating file, CSVModule adds a row to a file per rule, and DirModule
+// writes a file per submission into a directory
+package sink
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xntrik/go209/pkg/go209"
+)
+
+// redacted replaces the value of a redacted field
+const redacted = "[redacted]"
+
+// answersField selects (or redacts) all the answers, and answerPrefix one of
+// them, like answers.a1
+const (
+	answersField = "answers"
+	answerPrefix = "answers."
+)
+
+// fileLock stops the job workers writing to the files at the same time
+var fileLock sync.Mutex
+
+// baseFields are the submission's own fields, in the order they're written
+var baseFields = []string{"id", "rule", "hook", "userid", "username", "status", "args", "started_at", "finished_at"}
+
+// config is the config from the rule. max_size and max_files are only
+// JSONLModule's. Where the files go (path or dir) is merged into the module's
+// ENV VARs, so it's taken from there
+type config struct {
+	Fields   []string `json:"fields"`
+	Redact   []string `json:"redact"`
+	MaxSize  float64  `json:"max_size"`
+	MaxFiles int      `json:"max_files"`
+}
+
+// fieldsSchema is the config for picking and redacting fields, which all the
+// modules take
+var fieldsSchema = map[string]go209.ConfigField{
+	"fields": {Type: go209.ConfigList, Description: "The fields to write, like username or answers.a1 (default: all of them)"},
+	"redact": {Type: go209.ConfigList, Description: "The fields to write as [redacted]"},
+}
+
+// decodeConfig decodes the rule's config
+func decodeConfig(raw json.RawMessage) (*config, error) {
+	cfg := &config{}
+	err := go209.DecodeConfig(raw, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// validateFields checks the fields and redact lists only have fields which
+// exist
+func validateFields(raw json.RawMessage) error {
+	cfg, err := decodeConfig(raw)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range append(cfg.Fields, cfg.Redact...) {
+		if !knownField(name) {
+			return fmt.Errorf("Unknown field '%s', use one of %s, answers or answers.<interaction_id>", name, strings.Join(baseFields, ", "))
+		}
+	}
+	return nil
+}
+
+// knownField returns true if the name is one of the submission's fields, all
+// the answers, or one answer
+func knownField(name string) bool {
+	if name == answersField || (strings.HasPrefix(name, answerPrefix) && len(name) > len(answerPrefix)) {
+		return true
+	}
+	for _, field := range baseFields {
+		if name == field {
+			return true
+		}
+	}
+	return false
+}
+
+// record is a submission flattened into fields, with only the fields picked,
+// in order, and the redacted ones replaced. There's an answer for each of the
+// rule's interactions. An answer's value is a string, or a list of strings if
+// more than one was picked, and nil if it wasn't answered
+type record struct {
+	names  []string
+	values map[string]interface{}
+}
+
+// formatTime formats a time, leaving unknown times blank
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// newRecord flattens the module's submission into a record
+func newRecord(in *go209.ModuleInput, cfg *config) *record {
+	sub := in.Submission
+	all := map[string]interface{}{
+		"id":          sub.ID,
+		"rule":        sub.Rule,
+		"hook":        in.Hook,
+		"userid":      sub.UserID,
+		"username":    sub.Username,
+		"status":      sub.Status,
+		"args":        sub.Args,
+		"started_at":  formatTime(sub.StartedAt),
+		"finished_at": formatTime(sub.FinishedAt),
+	}
+	// every interaction gets a field, answered or not, so CSV files get a
+	// column for each of them
+	var answers []string
+	seen := make(map[string]bool)
+	for _, id := range in.Interactions {
+		answers = append(answers, answerPrefix+id)
+		seen[id] = true
+	}
+	for _, answer := range sub.Answers {
+		name := answerPrefix + answer.InteractionID
+		if !seen[answer.InteractionID] {
+			answers = append(answers, name)
+		}
+		if len(answer.Values) > 0 {
+			all[name] = answer.Values
+		} else {
+			all[name] = answer.Value
+		}
+	}
+
+	rec := &record{values: make(map[string]interface{})}
+	add := func(name string) {
+		if _, ok := rec.values[name]; ok {
+			return
+		}
+		rec.names = append(rec.names, name)
+		rec.values[name] = all[name]
+	}
+
+	if len(cfg.Fields) == 0 {
+		for _, name := range append(baseFields, answers...) {
+			add(name)
+		}
+	}
+	for _, name := range cfg.Fields {
+		if name == answersField {
+			for _, answer := range answers {
+				add(answer)
+			}
+			continue
+		}
+		add(name)
+	}
+
+	for _, name := range cfg.Redact {
+		for _, field := range rec.names {
+			if rec.values[field] == nil {
+				continue
+			}
+			if field == name || (name == answersField && strings.HasPrefix(field, answerPrefix)) {
+				rec.values[field] = redacted
+			}
+		}
+	}
+
+	return rec
+}
+
+// json encodes the record as a JSON object, with the answers in an object
+// keyed by interaction_id, like go209 export does
+func (r *record) json() ([]byte, error) {
+	object := make(map[string]interface{})
+	answers := make(map[string]interface{})
+	for _, name := range r.names {
+		if strings.HasPrefix(name, answerPrefix) {
+			answers[strings.TrimPrefix(name, answerPrefix)] = r.values[name]
+		} else {
+			object[name] = r.values[name]
+		}
+	}
+	if len(answers) > 0 {
+		object[answersField] = answers
+	}
+
+	b, err := json.Marshal(object)
+	if err != nil {
+		return nil, fmt.Errorf("Error marshalling json: %s", err)
+	}
+	return b, nil
+}
+
+// cell is a field's value in a CSV. Multiple values are separated by
+// semicolons, and unanswered interactions are left empty
+func (r *record) cell(name string) string {
+	switch value := r.values[name].(type) {
+	case string:
+		return value
+	case []string:
+		return strings.Join(value, "; ")
+	}
+	return ""
+}
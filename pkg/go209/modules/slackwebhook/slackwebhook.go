@@ -1,4 +1,6 @@
-package main
+// Package slackwebhook is a go209 module which posts the responses to a set
+// of interactions to a slack webhook
+package slackwebhook
 
 import (
 	"bytes"
@@ -9,6 +11,8 @@ import (
 	"net/http"
 	"strings"
 	"time"
+
+	"github.com/xntrik/go209/pkg/go209"
 )
 
 type myAttachmentField struct {
@@ -41,6 +45,13 @@ func (sm slackWebhookModule) EnvVars() []string {
 	return []string{"URL"}
 }
 
+// ConfigSchema is the config a rule can give the module, over its ENV VARs
+func (sm slackWebhookModule) ConfigSchema() map[string]go209.ConfigField {
+	return map[string]go209.ConfigField{
+		"url": {Type: go209.ConfigString, Description: "The slack webhook to post to"},
+	}
+}
+
 func (sm slackWebhookModule) Run(in interface{}, ev map[string]string, interactions map[string]string) error {
 	if len(ev["SLACKWEBHOOKMODULE_URL"]) == 0 {
 		return errors.New("Missing SlackWebhookModule URL param")
@@ -101,7 +112,8 @@ func (sm slackWebhookModule) Run(in interface{}, ev map[string]string, interacti
 		return err
 	}
 
-	ctx, _ := context.WithTimeout(context.Background(), time.Second*30)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
 	req = req.WithContext(ctx)
 
 	resp, err := http.DefaultClient.Do(req)
@@ -113,5 +125,5 @@ func (sm slackWebhookModule) Run(in interface{}, ev map[string]string, interacti
 	return nil
 }
 
-// Module is exported for the plugin system
+// Module is registered with go209.Register
 var Module slackWebhookModule
@@ -0,0 +1,258 @@
+// Package webhook is a go209 module which sends a set of interactions to any
+// HTTP endpoint, with the request configured in each rule
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xntrik/go209/pkg/go209"
+)
+
+// The defaults, if the rule doesn't set them
+const (
+	defaultMethod          = "POST"
+	defaultContentType     = "application/json"
+	defaultExpectedStatus  = "2xx"
+	defaultRetryStatus     = "408,429,5xx"
+	defaultSignatureHeader = "X-Go209-Signature"
+)
+
+// timestampHeader is sent along with the signature, which covers it, so old
+// requests can't be replayed
+const timestampHeader = "X-Go209-Timestamp"
+
+// maxErrorBody is how much of the response body is kept in the error, if the
+// status isn't what was expected
+const maxErrorBody = 512
+
+// config is the module's config from the rule. The url is merged into the
+// module's ENV VARs, so it's taken from there
+type config struct {
+	Method          string            `json:"method"`
+	Headers         map[string]string `json:"headers"`
+	Body            string            `json:"body"`
+	ContentType     string            `json:"content_type"`
+	ExpectedStatus  string            `json:"expected_status"`
+	RetryStatus     string            `json:"retry_status"`
+	SignatureHeader string            `json:"signature_header"`
+}
+
+type webhookModule string
+
+func (wm webhookModule) Name() string {
+	return "WebhookModule"
+}
+
+func (wm webhookModule) EnvVars() []string {
+	return []string{"URL", "SIGNING_SECRET"}
+}
+
+// ConfigSchema is the config a rule can give the module. The signing secret
+// can only be set with an ENV VAR
+func (wm webhookModule) ConfigSchema() map[string]go209.ConfigField {
+	return map[string]go209.ConfigField{
+		"url":              {Type: go209.ConfigString, Description: "Where the request is sent"},
+		"method":           {Type: go209.ConfigString, Description: "The HTTP method (default: POST)"},
+		"headers":          {Type: go209.ConfigObject, Description: "Extra headers to send, their values are templates"},
+		"body":             {Type: go209.ConfigString, Description: "A text/template for the body (default: the submission as JSON)"},
+		"content_type":     {Type: go209.ConfigString, Description: "The body's Content-Type (default: application/json)"},
+		"expected_status":  {Type: go209.ConfigString, Description: "The statuses which mean it worked, like 200,201 or 2xx (default: 2xx)"},
+		"retry_status":     {Type: go209.ConfigString, Description: "The other statuses which are retried (default: 408,429,5xx)"},
+		"signature_header": {Type: go209.ConfigString, Description: "The header the HMAC signature is sent in (default: X-Go209-Signature)"},
+	}
+}
+
+// ValidateConfig checks the templates and statuses, so mistakes are found
+// when go209 starts rather than when someone completes the interactions
+func (wm webhookModule) ValidateConfig(raw json.RawMessage) error {
+	cfg, err := decodeConfig(raw)
+	if err != nil {
+		return err
+	}
+
+	_, err = go209.ParseTemplate("body", cfg.Body)
+	if err != nil {
+		return err
+	}
+	for name, value := range cfg.Headers {
+		_, err = go209.ParseTemplate(name, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = parseStatuses(cfg.ExpectedStatus)
+	if err != nil {
+		return err
+	}
+	_, err = parseStatuses(cfg.RetryStatus)
+	return err
+}
+
+// decodeConfig decodes the rule's config, with the defaults for anything not
+// set
+func decodeConfig(raw json.RawMessage) (*config, error) {
+	cfg := &config{}
+	err := go209.DecodeConfig(raw, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cfg.Method) == 0 {
+		cfg.Method = defaultMethod
+	}
+	cfg.Method = strings.ToUpper(cfg.Method)
+	if len(cfg.ContentType) == 0 {
+		cfg.ContentType = defaultContentType
+	}
+	if len(cfg.ExpectedStatus) == 0 {
+		cfg.ExpectedStatus = defaultExpectedStatus
+	}
+	if len(cfg.RetryStatus) == 0 {
+		cfg.RetryStatus = defaultRetryStatus
+	}
+	if len(cfg.SignatureHeader) == 0 {
+		cfg.SignatureHeader = defaultSignatureHeader
+	}
+	return cfg, nil
+}
+
+// statusList is a parsed list of statuses, which are either a status code
+// like 201, or a class like 2xx, stored as 2
+type statusList []int
+
+// parseStatuses parses a list of statuses separated with ",", which can have
+// classes like 2xx. Every entry is checked, not just the ones before a match
+func parseStatuses(list string) (statusList, error) {
+	var statuses statusList
+	for _, status := range strings.Split(list, ",") {
+		status = strings.ToLower(strings.TrimSpace(status))
+		if len(status) == 3 && strings.HasSuffix(status, "xx") && status[0] >= '1' && status[0] <= '5' {
+			statuses = append(statuses, int(status[0]-'0'))
+			continue
+		}
+
+		n, err := strconv.Atoi(status)
+		if err != nil || n < 100 || n > 599 {
+			return nil, fmt.Errorf("Invalid status '%s'", status)
+		}
+		statuses = append(statuses, n)
+	}
+	return statuses, nil
+}
+
+// match returns true if the status code is in the list
+func (s statusList) match(code int) bool {
+	for _, status := range s {
+		if status == code || status == code/100 {
+			return true
+		}
+	}
+	return false
+}
+
+// sign is the HMAC-SHA256 signature of the timestamp and body, in hex
+func sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (wm webhookModule) Run(ctx context.Context, in *go209.ModuleInput) (*go209.ModuleResult, error) {
+	cfg, err := decodeConfig(in.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	// the url can come from the rule, or the ENV VAR
+	uri := in.Env["WEBHOOKMODULE_URL"]
+	if len(uri) == 0 {
+		return nil, errors.New("Missing WebhookModule URL param")
+	}
+
+	expected, err := parseStatuses(cfg.ExpectedStatus)
+	if err != nil {
+		return nil, err
+	}
+	retry, err := parseStatuses(cfg.RetryStatus)
+	if err != nil {
+		return nil, err
+	}
+
+	data := in.TemplateData()
+
+	var body []byte
+	if len(cfg.Body) > 0 {
+		rendered, err := go209.RenderTemplate("body", cfg.Body, data)
+		if err != nil {
+			return nil, err
+		}
+		body = []byte(rendered)
+	} else {
+		body, err = json.Marshal(in.Submission)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest(cfg.Method, uri, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", cfg.ContentType)
+
+	for name, value := range cfg.Headers {
+		rendered, err := go209.RenderTemplate(name, value, data)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(name, rendered)
+	}
+
+	if secret := in.Env["WEBHOOKMODULE_SIGNING_SECRET"]; len(secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(timestampHeader, timestamp)
+		req.Header.Set(cfg.SignatureHeader, fmt.Sprintf("sha256=%s", sign(secret, timestamp, body)))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if expected.match(resp.StatusCode) {
+		return &go209.ModuleResult{
+			Status: go209.ModuleOK,
+			Output: map[string]string{"status": strconv.Itoa(resp.StatusCode)},
+		}, nil
+	}
+
+	snippet, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	reason := fmt.Sprintf("%s %s returned %s: %s", cfg.Method, uri, resp.Status, strings.TrimSpace(string(snippet)))
+
+	return &go209.ModuleResult{
+		Status:    go209.ModuleFailed,
+		Message:   reason,
+		Permanent: !retry.match(resp.StatusCode),
+	}, nil
+}
+
+// Module is registered with go209.RegisterV2
+var Module webhookModule
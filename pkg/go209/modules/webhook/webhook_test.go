@@ -0,0 +1,196 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/xntrik/go209/pkg/go209"
+)
+
+// testRequest is what the test server saw of the module's request
+type testRequest struct {
+	method string
+	header http.Header
+	body   string
+}
+
+// testServer replies to every request with the status, and sends what it saw
+// to the channel
+func testServer(status int) (*httptest.Server, chan testRequest) {
+	requests := make(chan testRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- testRequest{method: r.Method, header: r.Header, body: string(body)}
+		w.WriteHeader(status)
+		w.Write([]byte("nope"))
+	}))
+	return srv, requests
+}
+
+// testInput is a submission for the module to send to the url
+func testInput(config, url, secret string) *go209.ModuleInput {
+	return &go209.ModuleInput{
+		Hook:       go209.HookEnd,
+		Submission: &go209.Submission{ID: "sub1", Rule: "rule", Username: "bob", Answers: []go209.Answer{{InteractionID: "a1", Value: `say "hi"`}}},
+		Config:     json.RawMessage(config),
+		Env:        map[string]string{"WEBHOOKMODULE_URL": url, "WEBHOOKMODULE_SIGNING_SECRET": secret},
+	}
+}
+
+func TestRunPayload(t *testing.T) {
+	srv, requests := testServer(http.StatusOK)
+	defer srv.Close()
+
+	tests := []struct {
+		name        string
+		config      string
+		method      string
+		contentType string
+		body        string
+		header      string
+	}{
+		{"default", `{}`, "POST", "application/json", `"id":"sub1"`, ""},
+		{
+			"templated",
+			`{"method": "put", "content_type": "text/plain", "body": "{{.Submission.Username}}: {{json .Answers.a1}}", "headers": {"X-Answer": "{{.Answers.a1}}"}}`,
+			"PUT", "text/plain", `bob: "say \"hi\""`, `say "hi"`,
+		},
+	}
+
+	for _, test := range tests {
+		result, err := Module.Run(context.Background(), testInput(test.config, srv.URL, ""))
+		if err != nil {
+			t.Errorf("%s: Run error: %s", test.name, err)
+			continue
+		}
+		if result.Status != go209.ModuleOK || result.Output["status"] != "200" {
+			t.Errorf("%s: Run result = %+v, want ok with status 200", test.name, result)
+		}
+
+		req := <-requests
+		if req.method != test.method {
+			t.Errorf("%s: method = %s, want %s", test.name, req.method, test.method)
+		}
+		if got := req.header.Get("Content-Type"); got != test.contentType {
+			t.Errorf("%s: Content-Type = %s, want %s", test.name, got, test.contentType)
+		}
+		if !strings.Contains(req.body, test.body) {
+			t.Errorf("%s: body = %q, want %q", test.name, req.body, test.body)
+		}
+		if got := req.header.Get("X-Answer"); got != test.header {
+			t.Errorf("%s: X-Answer = %q, want %q", test.name, got, test.header)
+		}
+		if got := req.header.Get(defaultSignatureHeader); len(got) > 0 {
+			t.Errorf("%s: signed without a secret: %s", test.name, got)
+		}
+	}
+}
+
+func TestRunSignature(t *testing.T) {
+	srv, requests := testServer(http.StatusOK)
+	defer srv.Close()
+
+	tests := []struct {
+		config string
+		header string
+	}{
+		{`{}`, defaultSignatureHeader},
+		{`{"signature_header": "X-Hub-Signature-256"}`, "X-Hub-Signature-256"},
+	}
+
+	for _, test := range tests {
+		_, err := Module.Run(context.Background(), testInput(test.config, srv.URL, "s3cret"))
+		if err != nil {
+			t.Fatalf("Run error: %s", err)
+		}
+
+		req := <-requests
+		timestamp := req.header.Get(timestampHeader)
+		if len(timestamp) == 0 {
+			t.Errorf("%s: no %s header", test.header, timestampHeader)
+		}
+		want := "sha256=" + sign("s3cret", timestamp, []byte(req.body))
+		if got := req.header.Get(test.header); got != want {
+			t.Errorf("%s = %q, want %q", test.header, got, want)
+		}
+	}
+}
+
+func TestRunStatus(t *testing.T) {
+	tests := []struct {
+		config    string
+		status    int
+		ok        bool
+		permanent bool
+	}{
+		{`{}`, http.StatusOK, true, false},
+		{`{}`, http.StatusCreated, true, false},
+		{`{}`, http.StatusBadRequest, false, true},
+		{`{}`, http.StatusTooManyRequests, false, false},
+		{`{}`, http.StatusBadGateway, false, false},
+		{`{"expected_status": "201"}`, http.StatusOK, false, true},
+		{`{"expected_status": "200,4xx"}`, http.StatusNotFound, true, false},
+		{`{"retry_status": "409"}`, http.StatusConflict, false, false},
+		{`{"retry_status": "409"}`, http.StatusServiceUnavailable, false, true},
+	}
+
+	for _, test := range tests {
+		srv, requests := testServer(test.status)
+		result, err := Module.Run(context.Background(), testInput(test.config, srv.URL, ""))
+		<-requests
+		srv.Close()
+		if err != nil {
+			t.Errorf("%s returning %d: Run error: %s", test.config, test.status, err)
+			continue
+		}
+
+		if test.ok {
+			if result.Status != go209.ModuleOK {
+				t.Errorf("%s returning %d: Run status = %s, want ok", test.config, test.status, result.Status)
+			}
+			continue
+		}
+		if result.Status != go209.ModuleFailed || result.Permanent != test.permanent {
+			t.Errorf("%s returning %d: Run result = %+v, want failed with permanent %v", test.config, test.status, result, test.permanent)
+		}
+		if !strings.Contains(result.Message, "nope") {
+			t.Errorf("%s returning %d: Run message = %q, want the response body", test.config, test.status, result.Message)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		config  string
+		wantErr string
+	}{
+		{`{}`, ""},
+		{`{"url": "https://example.com", "method": "put", "expected_status": "200, 2xx", "retry_status": "5xx,429"}`, ""},
+		{`{"body": "{{.Answers.a1}}", "headers": {"X-Answer": "{{json .Answers.a1}}"}}`, ""},
+		{`{"body": "{{.Answers.a1"}`, "body"},
+		{`{"headers": {"X-Answer": "{{end}}"}}`, "X-Answer"},
+		{`{"expected_status": "200,bogus"}`, "bogus"},
+		{`{"expected_status": "2xx,9zz"}`, "9zz"},
+		{`{"retry_status": "5xx,600"}`, "600"},
+		{`{"retry_status": "6xx"}`, "6xx"},
+		{`{"method": 1}`, "method"},
+	}
+
+	for _, test := range tests {
+		err := Module.ValidateConfig(json.RawMessage(test.config))
+		if len(test.wantErr) == 0 {
+			if err != nil {
+				t.Errorf("ValidateConfig(%s) error: %s", test.config, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("ValidateConfig(%s) = %v, want an error about %q", test.config, err, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package go209
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// panics runs fn, returning what it panicked with, if anything
+func panics(fn func()) (value interface{}) {
+	defer func() {
+		value = recover()
+	}()
+	fn()
+	return nil
+}
+
+func TestRegister(t *testing.T) {
+	saved := modules
+	defer func() { modules = saved }()
+	modules = LoadedModules{}
+
+	Register(envModule{})
+	RegisterV2(schemaModule{})
+	if len(modules.Modules) != 2 || moduleVersion(modules.find("EnvModule")) != 1 || moduleVersion(modules.find("SchemaModule")) != 2 {
+		t.Fatalf("registered modules = %v, want EnvModule v1 and SchemaModule v2", modules.Modules)
+	}
+
+	tests := []struct {
+		name string
+		fn   func()
+		want string
+	}{
+		{"nil v1", func() { Register(nil) }, "go209: Register module is nil"},
+		{"nil v2", func() { RegisterV2(nil) }, "go209: RegisterV2 module is nil"},
+		{"v1 twice", func() { Register(envModule{}) }, "go209: Register called twice for module EnvModule"},
+		{"v2 twice", func() { RegisterV2(schemaModule{}) }, "go209: Register called twice for module SchemaModule"},
+		{"v2 with a v1 module's name", func() { RegisterV2(moduleV1{envModule{}}) }, "go209: Register called twice for module EnvModule"},
+	}
+
+	for _, test := range tests {
+		got := panics(test.fn)
+		if got != test.want {
+			t.Errorf("%s: panicked with %v, want %q", test.name, got, test.want)
+		}
+	}
+
+	if len(modules.Modules) != 2 {
+		t.Errorf("%d modules after the panics, want 2", len(modules.Modules))
+	}
+}
+
+func TestPluginPath(t *testing.T) {
+	tests := map[string]string{
+		"email":               "./email.so",
+		"mods/email.so":       "mods/email.so",
+		"/opt/go209/email.so": "/opt/go209/email.so",
+	}
+	for plug, want := range tests {
+		if got := pluginPath(plug); got != want {
+			t.Errorf("pluginPath(%s) = %s, want %s", plug, got, want)
+		}
+	}
+}
+
+func TestLoadPluginsErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go209")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	junk := filepath.Join(dir, "junk.so")
+	err = ioutil.WriteFile(junk, []byte("not a plugin"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing.so")
+
+	tests := []struct {
+		name    string
+		plugins string
+		wantErr string
+	}{
+		{"nothing configured", "", ""},
+		{"only separators", " : :", ""},
+		{"missing file", missing, "Error loading module plugin " + missing},
+		{"not a plugin", junk, "Error loading module plugin " + junk},
+		{"missing after a blank", ":" + missing, "Error loading module plugin " + missing},
+	}
+
+	for _, test := range tests {
+		m := &LoadedModules{}
+		err := m.LoadPlugins(test.plugins)
+		if len(test.wantErr) == 0 {
+			if err != nil {
+				t.Errorf("%s: LoadPlugins(%q) error: %s", test.name, test.plugins, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s: LoadPlugins(%q) = %v, want %q", test.name, test.plugins, err, test.wantErr)
+		}
+		if len(m.Modules) > 0 {
+			t.Errorf("%s: LoadPlugins loaded %v", test.name, m.Modules)
+		}
+	}
+}
+
+func TestAddPlugin(t *testing.T) {
+	m := &LoadedModules{}
+
+	// plugins export a pointer to their Module variable
+	v1 := &envModule{}
+	v2 := &schemaModule{}
+	tests := []struct {
+		name    string
+		sym     interface{}
+		wantErr string
+	}{
+		{"v1", v1, ""},
+		{"v2", v2, ""},
+		{"v1 twice", v1, "Error loading module plugin test.so: a module called EnvModule is already loaded"},
+		{"v2 twice", v2, "Error loading module plugin test.so: a module called SchemaModule is already loaded"},
+		{"not a module", &struct{ Name string }{"Module"}, "Error loading module plugin test.so: Unexpected type from module"},
+	}
+
+	for _, test := range tests {
+		err := m.addPlugin("test.so", test.sym)
+		if len(test.wantErr) == 0 {
+			if err != nil {
+				t.Errorf("%s: addPlugin error: %s", test.name, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != test.wantErr {
+			t.Errorf("%s: addPlugin = %v, want %q", test.name, err, test.wantErr)
+		}
+	}
+
+	if len(m.Modules) != 2 || moduleVersion(m.find("EnvModule")) != 1 || moduleVersion(m.find("SchemaModule")) != 2 {
+		t.Errorf("loaded modules = %v, want EnvModule v1 and SchemaModule v2", m.Modules)
+	}
+}
+
+// stubModule is a v1 module which keeps what it was run with
+type stubModule struct {
+	err          error
+	in           interface{}
+	ev           map[string]string
+	interactions map[string]string
+}
+
+func (m *stubModule) Name() string {
+	return "StubModule"
+}
+
+func (m *stubModule) EnvVars() []string {
+	return []string{"TO", "SUBJECT"}
+}
+
+func (m *stubModule) Run(in interface{}, ev map[string]string, interactions map[string]string) error {
+	m.in, m.ev, m.interactions = in, ev, interactions
+	return m.err
+}
+
+func TestModuleV1Adapter(t *testing.T) {
+	saved := modules
+	defer func() { modules = saved }()
+	modules = LoadedModules{}
+	stub := &stubModule{}
+	Register(stub)
+
+	os.Setenv("STUBMODULE_TO", "a@example.com")
+	defer os.Unsetenv("STUBMODULE_TO")
+	os.Unsetenv("STUBMODULE_SUBJECT")
+
+	db := newMemoryStore()
+	defer db.Close()
+	rules := testSurveyRules()
+	rule := &rules.Rules[0]
+	rule.InteractionEndMods = []EndMod{{Module: "StubModule"}}
+
+	finalval := map[string]string{
+		"interaction":   "p3",
+		"userid":        "U1",
+		"username":      "bob",
+		"submission_id": "sub1",
+		"response:p1":   "ham",
+		"response:p2":   "2",
+	}
+	sub := newSubmission(rules, finalval, SubmissionCompleted)
+	jobs := newModuleJobs(rule, HookEnd, rule.InteractionEndMods, finalval, sub, "D1")
+	if len(jobs) != 1 {
+		t.Fatalf("%d jobs, want 1", len(jobs))
+	}
+
+	// the job goes through the queue before it's run
+	fields, err := encodeJob(jobs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := decodeJob(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = runJob(db, nil, job, time.Minute)
+	if err != nil {
+		t.Fatalf("runJob error: %s", err)
+	}
+
+	// v1 modules were run with the final state, their ENV VARs and the
+	// questions, before there was a ModuleV2
+	if in, ok := stub.in.(map[string]string); !ok || !reflect.DeepEqual(in, finalval) {
+		t.Errorf("in = %#v, want the final state %v", stub.in, finalval)
+	}
+	wantEnv := map[string]string{"STUBMODULE_TO": "a@example.com", "STUBMODULE_SUBJECT": ""}
+	if !reflect.DeepEqual(stub.ev, wantEnv) {
+		t.Errorf("ev = %v, want %v", stub.ev, wantEnv)
+	}
+	wantInteractions := map[string]string{"p1": "Topping?", "p2": "How many slices?", "p3": ""}
+	if !reflect.DeepEqual(stub.interactions, wantInteractions) {
+		t.Errorf("interactions = %v, want %v", stub.interactions, wantInteractions)
+	}
+
+	// the rule's config is merged over the ENV VARs
+	job.Config = json.RawMessage(`{"subject": "Pizza"}`)
+	runJob(db, nil, job, time.Minute)
+	wantEnv["STUBMODULE_SUBJECT"] = "Pizza"
+	if !reflect.DeepEqual(stub.ev, wantEnv) {
+		t.Errorf("ev with config = %v, want %v", stub.ev, wantEnv)
+	}
+
+	// an error from the module fails the job, so it's retried
+	stub.err = errors.New("smtp is down")
+	err = runJob(db, nil, job, time.Minute)
+	if err == nil || err.Error() != "smtp is down" {
+		t.Errorf("runJob of a failing module = %v, want its error", err)
+	}
+}
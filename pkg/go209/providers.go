@@ -0,0 +1,388 @@
+package go209
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nlopes/slack"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultProviderCacheTTL is how long what a data provider returns is cached
+// for, if the interaction doesn't set its own cache
+const DefaultProviderCacheTTL = time.Minute
+
+// providerCacheSize is the most results the provider cache keeps. Results
+// cached per_user take an entry for each user, so without a limit the cache
+// would grow for as long as go209 runs
+const providerCacheSize = 1000
+
+// DataProvider is implemented by modules (v1 or v2) which can supply an
+// interaction's select menu options, or its text, when it's asked
+type DataProvider interface {
+	Provide(ctx context.Context, in *ProviderInput) (*ProviderResult, error)
+}
+
+// ProviderInput is what a DataProvider is given
+type ProviderInput struct {
+	// Interaction is the ID of the interaction being asked
+	Interaction string
+
+	// UserID and Username are who it's being asked of. They're not set for
+	// anonymous rules
+	UserID   string
+	Username string
+
+	// Args are the arguments the rule was started with, from a slash command
+	Args string
+
+	// Config is the config from the interaction's options_from or text_from,
+	// and Env the module's ENV VARs with the config merged over them
+	Config json.RawMessage
+	Env    map[string]string
+}
+
+// ProviderOption is one of the options in a select menu
+type ProviderOption struct {
+	Text  string `json:"text"`
+	Value string `json:"value"`
+}
+
+// ProviderResult is what a DataProvider returns. Options are used for
+// options_from, and Text for text_from
+type ProviderResult struct {
+	Options []ProviderOption `json:"options,omitempty"`
+	Text    string           `json:"text,omitempty"`
+}
+
+// DataSource is where an interaction gets its options or text from. Action is
+// the name of the select menu in the attachment to fill, the first one is used
+// if it isn't set. Cache is how long the result is kept for, shared between
+// everyone unless PerUser is set
+type DataSource struct {
+	Module  string          `json:"module"`
+	Config  json.RawMessage `json:"config,omitempty"`
+	Timeout string          `json:"timeout,omitempty"`
+	Cache   string          `json:"cache,omitempty"`
+	PerUser bool            `json:"per_user,omitempty"`
+	Action  string          `json:"action,omitempty"`
+
+	// timeout and cache are Timeout and Cache, parsed when the file is parsed
+	timeout time.Duration
+	cache   time.Duration
+}
+
+// parse checks the data source's timeout and cache, and keeps them parsed
+func (d *DataSource) parse() error {
+	d.cache = DefaultProviderCacheTTL
+	if len(d.Cache) > 0 {
+		cache, err := time.ParseDuration(d.Cache)
+		if err != nil {
+			return fmt.Errorf("Error parsing %s cache: %s", d.Module, err)
+		}
+		if cache < 0 {
+			return fmt.Errorf("%s cache can't be negative", d.Module)
+		}
+		d.cache = cache
+	}
+
+	if len(d.Timeout) > 0 {
+		timeout, err := time.ParseDuration(d.Timeout)
+		if err != nil {
+			return fmt.Errorf("Error parsing %s timeout: %s", d.Module, err)
+		}
+		if timeout <= 0 {
+			return fmt.Errorf("%s timeout must be more than 0", d.Module)
+		}
+		d.timeout = timeout
+	}
+	return nil
+}
+
+// moduleProvider returns the module as a DataProvider, if it is one
+func moduleProvider(mod ModuleV2) (DataProvider, bool) {
+	if p, ok := mod.(DataProvider); ok {
+		return p, true
+	}
+	if v1, ok := mod.(moduleV1); ok {
+		if p, ok := v1.Module.(DataProvider); ok {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// dataSources are the interaction's data sources
+func (i *Interaction) dataSources() []*DataSource {
+	var sources []*DataSource
+	if i.OptionsFrom != nil {
+		sources = append(sources, i.OptionsFrom)
+	}
+	if i.TextFrom != nil {
+		sources = append(sources, i.TextFrom)
+	}
+	return sources
+}
+
+// providerEntry is a cached result from a data provider, which expires once
+// it's older than ttl
+type providerEntry struct {
+	result  *ProviderResult
+	fetched time.Time
+	ttl     time.Duration
+}
+
+// providerCache caches what data providers return, so they aren't asked every
+// time an interaction is. Expired results are kept, in case there isn't time
+// to ask the provider again, until the cache is full (see set)
+type providerCache struct {
+	mu         sync.Mutex
+	entries    map[string]providerEntry
+	refreshing map[string]bool
+	maxEntries int
+}
+
+// newProviderCache sets up an empty cache
+func newProviderCache() *providerCache {
+	return &providerCache{
+		entries:    make(map[string]providerEntry),
+		refreshing: make(map[string]bool),
+		maxEntries: providerCacheSize,
+	}
+}
+
+// get returns the cached result, if there's one which hasn't expired
+func (c *providerCache) get(key string, ttl time.Duration) (*ProviderResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || time.Since(entry.fetched) >= ttl {
+		return nil, false
+	}
+	return entry.result, true
+}
+
+// getStale returns the cached result, however old it is
+func (c *providerCache) getStale(key string) (*ProviderResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	return entry.result, ok
+}
+
+// startRefresh returns true if the result isn't already being fetched in the
+// background, in which case it's marked as being fetched until endRefresh is
+// called
+func (c *providerCache) startRefresh(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.refreshing[key] {
+		return false
+	}
+	c.refreshing[key] = true
+	return true
+}
+
+// endRefresh marks the result as no longer being fetched in the background
+func (c *providerCache) endRefresh(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.refreshing, key)
+}
+
+// set caches a result for ttl. If the cache is full, the expired results are
+// dropped to make room, and if none have expired the oldest one is
+func (c *providerCache) set(key string, result *ProviderResult, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxEntries {
+		c.evict()
+	}
+	c.entries[key] = providerEntry{result: result, fetched: time.Now(), ttl: ttl}
+}
+
+// evict drops the expired results, or the oldest one if none have expired.
+// c.mu must be held
+func (c *providerCache) evict() {
+	oldest := ""
+	for key, entry := range c.entries {
+		if time.Since(entry.fetched) >= entry.ttl {
+			delete(c.entries, key)
+			continue
+		}
+		if len(oldest) == 0 || entry.fetched.Before(c.entries[oldest].fetched) {
+			oldest = key
+		}
+	}
+	if len(c.entries) >= c.maxEntries {
+		delete(c.entries, oldest)
+	}
+}
+
+// provide asks the data source's module for its data, or returns what it
+// returned last time if it's still cached. If there's a deadline (slack is
+// waiting on the interaction), the provider isn't given any longer than
+// that, and an expired result is returned straight away while a new one is
+// fetched in the background
+func (r *RuleSet) provide(db StateStore, source *DataSource, interactionID, user, username, args string, deadline time.Time) (*ProviderResult, error) {
+	key := fmt.Sprintf("%s %s %s", source.Module, interactionID, source.Config)
+	if source.PerUser {
+		key = fmt.Sprintf("%s %s", key, user)
+	}
+	if result, ok := r.providers.get(key, source.cache); ok {
+		return result, nil
+	}
+
+	timeout := source.timeout
+	if timeout <= 0 {
+		timeout = r.moduleTimeout
+	}
+
+	if !deadline.IsZero() {
+		if result, ok := r.providers.getStale(key); ok {
+			if r.providers.startRefresh(key) {
+				go func() {
+					defer r.providers.endRefresh(key)
+					_, err := r.fetch(db, source, key, interactionID, user, username, args, timeout)
+					if err != nil {
+						log.Warn(fmt.Sprintf("Error refreshing %s for %s: %s", source.Module, interactionID, err))
+					}
+				}()
+			}
+			return result, nil
+		}
+
+		if left := time.Until(deadline); left < timeout {
+			timeout = left
+		}
+		if timeout <= 0 {
+			return nil, fmt.Errorf("No time left to ask %s, slack is waiting", source.Module)
+		}
+	}
+
+	return r.fetch(db, source, key, interactionID, user, username, args, timeout)
+}
+
+// fetch runs the data source's module, caching what it returns under the key
+func (r *RuleSet) fetch(db StateStore, source *DataSource, key, interactionID, user, username, args string, timeout time.Duration) (*ProviderResult, error) {
+	mod := modules.find(source.Module)
+	if mod == nil {
+		return nil, fmt.Errorf("Referenced module not found: %s", source.Module)
+	}
+	provider, ok := moduleProvider(mod)
+	if !ok {
+		return nil, fmt.Errorf("Module %s isn't a data provider", source.Module)
+	}
+
+	env, err := mergeModuleConfig(mod, moduleEnv(mod), source.Config)
+	if err != nil {
+		return nil, fmt.Errorf("Error with module %s config: %s", mod.Name(), err)
+	}
+	in := &ProviderInput{
+		Interaction: interactionID,
+		UserID:      user,
+		Username:    username,
+		Args:        args,
+		Config:      source.Config,
+		Env:         env,
+	}
+
+	var result *ProviderResult
+	started := time.Now()
+	err = runIsolated(mod.Name(), timeout, func(ctx context.Context) error {
+		var err error
+		result, err = provider.Provide(ctx, in)
+		return err
+	})
+	recordModuleRun(db, mod.Name(), moduleOutcome(err), time.Since(started))
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		result = &ProviderResult{}
+	}
+
+	if source.cache > 0 {
+		r.providers.set(key, result, source.cache)
+	}
+	return result, nil
+}
+
+// withOptions returns a copy of the attachment, with the options of the select
+// menu called action (or the first one) replaced
+func withOptions(attachment slack.Attachment, action string, options []ProviderOption) (slack.Attachment, error) {
+	actions := make([]slack.AttachmentAction, len(attachment.Actions))
+	copy(actions, attachment.Actions)
+
+	for i := range actions {
+		if actions[i].Type != "select" || (len(action) > 0 && actions[i].Name != action) {
+			continue
+		}
+
+		actions[i].Options = make([]slack.AttachmentActionOption, 0, len(options))
+		for _, option := range options {
+			actions[i].Options = append(actions[i].Options, slack.AttachmentActionOption{Text: option.Text, Value: option.Value})
+		}
+		actions[i].OptionGroups = nil
+		attachment.Actions = actions
+		return attachment, nil
+	}
+
+	return attachment, fmt.Errorf("No select menu to fill")
+}
+
+// resolveInteraction fills in an interaction's options and text from its data
+// providers, as it's about to be asked. A copy is returned, so the rules
+// aren't changed. If a provider fails, what's in the rules file is used. If
+// the deadline isn't zero, slack is waiting, so the providers aren't given
+// any longer than that (see provide)
+func (r *RuleSet) resolveInteraction(db StateStore, interaction *Interaction, user, username, args string, deadline time.Time) *Interaction {
+	if interaction.OptionsFrom == nil && interaction.TextFrom == nil {
+		return interaction
+	}
+
+	// data providers are outside of go209, so they don't get told who's
+	// taking part in anonymous rules
+	if rule, err := r.findRuleByID(interaction.InteractionID); err == nil && rule.Anonymous {
+		user, username = "", ""
+	}
+
+	resolved := *interaction
+
+	if source := interaction.OptionsFrom; source != nil {
+		result, err := r.provide(db, source, interaction.InteractionID, user, username, args, deadline)
+		if err == nil && len(result.Options) == 0 {
+			err = fmt.Errorf("No options returned")
+		}
+		if err == nil {
+			resolved.Attachment, err = withOptions(interaction.Attachment, source.Action, result.Options)
+		}
+		if err != nil {
+			log.Warn(fmt.Sprintf("Error getting the options for %s from %s, using the static ones: %s", interaction.InteractionID, source.Module, err))
+		}
+	}
+
+	if source := interaction.TextFrom; source != nil {
+		result, err := r.provide(db, source, interaction.InteractionID, user, username, args, deadline)
+		if err == nil && len(result.Text) == 0 {
+			err = fmt.Errorf("No text returned")
+		}
+		if err != nil {
+			log.Warn(fmt.Sprintf("Error getting the text for %s from %s, using the static text: %s", interaction.InteractionID, source.Module, err))
+		} else if interaction.Type == "finaltext" {
+			resolved.Response = result.Text
+		} else {
+			resolved.Question = result.Text
+		}
+	}
+
+	return &resolved
+}
@@ -0,0 +1,162 @@
+package go209
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowProvider is a data provider which takes a while, returning how many
+// times it's been asked as its text
+type slowProvider struct {
+	mu    sync.Mutex
+	delay time.Duration
+	calls int
+}
+
+func (p *slowProvider) Name() string {
+	return "SlowProvider"
+}
+
+func (p *slowProvider) EnvVars() []string {
+	return nil
+}
+
+func (p *slowProvider) Run(ctx context.Context, in *ModuleInput) (*ModuleResult, error) {
+	return nil, nil
+}
+
+func (p *slowProvider) Provide(ctx context.Context, in *ProviderInput) (*ProviderResult, error) {
+	p.mu.Lock()
+	p.calls++
+	calls := p.calls
+	p.mu.Unlock()
+
+	select {
+	case <-time.After(p.delay):
+		return &ProviderResult{Text: strconv.Itoa(calls)}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *slowProvider) callCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls
+}
+
+func TestProvideDeadline(t *testing.T) {
+	saved := modules
+	defer func() { modules = saved }()
+	modules = LoadedModules{}
+	provider := &slowProvider{delay: 200 * time.Millisecond}
+	RegisterV2(provider)
+
+	rules := &RuleSet{moduleTimeout: time.Minute, providers: newProviderCache()}
+	db := newMemoryStore()
+	defer db.Close()
+
+	source := &DataSource{Module: "SlowProvider"}
+	err := source.parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// with a deadline, a provider with nothing cached gets no longer than that
+	started := time.Now()
+	_, err = rules.provide(db, source, "p1", "U1", "bob", "", time.Now().Add(50*time.Millisecond))
+	if err == nil {
+		t.Error("provide past the deadline didn't fail")
+	}
+	if took := time.Since(started); took > 150*time.Millisecond {
+		t.Errorf("provide took %s, past its deadline", took)
+	}
+
+	// without one it's given the module timeout, and the result is cached
+	result, err := rules.provide(db, source, "p1", "U1", "bob", "", time.Time{})
+	if err != nil || result.Text != "2" {
+		t.Fatalf("provide = %+v, %v, want the second call", result, err)
+	}
+
+	// once the cache expires, the old result is returned straight away with a
+	// deadline, and a new one is fetched in the background
+	expired := *source
+	expired.cache = time.Nanosecond
+	started = time.Now()
+	result, err = rules.provide(db, &expired, "p1", "U1", "bob", "", time.Now().Add(50*time.Millisecond))
+	if err != nil || result.Text != "2" {
+		t.Errorf("provide with an expired cache = %+v, %v, want the cached result", result, err)
+	}
+	if took := time.Since(started); took > 50*time.Millisecond {
+		t.Errorf("provide with an expired cache took %s", took)
+	}
+
+	// it's only fetched once at a time
+	rules.provide(db, &expired, "p1", "U1", "bob", "", time.Now().Add(50*time.Millisecond))
+	refreshed := false
+	for i := 0; i < 20 && !refreshed; i++ {
+		time.Sleep(50 * time.Millisecond)
+		result, err := rules.provide(db, source, "p1", "U1", "bob", "", time.Time{})
+		refreshed = err == nil && result.Text == "3"
+	}
+	if !refreshed {
+		t.Error("the background fetch didn't update the cache")
+	}
+	if calls := provider.callCount(); calls != 3 {
+		t.Errorf("provider called %d times, want 3", calls)
+	}
+}
+
+func TestProviderCacheEviction(t *testing.T) {
+	c := newProviderCache()
+	c.maxEntries = 3
+
+	// full of results which haven't expired, the oldest makes room
+	for _, key := range []string{"U1", "U2", "U3", "U4"} {
+		c.set(key, &ProviderResult{Text: key}, time.Hour)
+		time.Sleep(time.Millisecond)
+	}
+	if _, ok := c.getStale("U1"); ok || len(c.entries) != 3 {
+		t.Errorf("cache has %d entries, want 3 without U1", len(c.entries))
+	}
+	for _, key := range []string{"U2", "U3", "U4"} {
+		if result, ok := c.get(key, time.Hour); !ok || result.Text != key {
+			t.Errorf("get(%s) = %+v, %v, want it cached", key, result, ok)
+		}
+	}
+
+	// setting a key which is already cached doesn't evict anything
+	c.set("U3", &ProviderResult{Text: "again"}, time.Hour)
+	if len(c.entries) != 3 {
+		t.Errorf("cache has %d entries after replacing one, want 3", len(c.entries))
+	}
+
+	// expired results all go before any which haven't expired, and are kept
+	// until then
+	c.set("U2", &ProviderResult{Text: "U2"}, time.Nanosecond)
+	c.set("U4", &ProviderResult{Text: "U4"}, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if result, ok := c.getStale("U2"); !ok || result.Text != "U2" {
+		t.Errorf("expired result went before the cache was full")
+	}
+	c.set("U5", &ProviderResult{Text: "U5"}, time.Hour)
+	if len(c.entries) != 2 {
+		t.Errorf("cache has %d entries, want the 2 which haven't expired", len(c.entries))
+	}
+	for _, key := range []string{"U3", "U5"} {
+		if _, ok := c.get(key, time.Hour); !ok {
+			t.Errorf("%s was evicted", key)
+		}
+	}
+
+	// it doesn't grow past its size, however many users there are
+	for i := 0; i < 100; i++ {
+		c.set(strconv.Itoa(i), &ProviderResult{}, time.Hour)
+	}
+	if len(c.entries) != 3 {
+		t.Errorf("cache has %d entries, want 3", len(c.entries))
+	}
+}
@@ -0,0 +1,342 @@
+package go209
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reportBuckets is how many buckets numeric answers are split into
+const reportBuckets = 5
+
+// reportBarWidth is the width of the longest bar in a report
+const reportBarWidth = 20
+
+// ReportOptions selects which submissions are reported on
+type ReportOptions struct {
+	Rule  string
+	Since string
+}
+
+// valueCount is how many times an answer was given
+type valueCount struct {
+	Value string
+	Count int
+}
+
+// reportBar draws a bar for a count, scaled against the largest count
+func reportBar(count, max int) string {
+	if max == 0 {
+		return ""
+	}
+	width := int(math.Round(float64(count) / float64(max) * reportBarWidth))
+	if width == 0 && count > 0 {
+		width = 1
+	}
+	return strings.Repeat("#", width)
+}
+
+// reportLine writes a labelled count, with a bar
+func reportLine(b *strings.Builder, width int, label string, count, max int) {
+	line := fmt.Sprintf("    %-*s %4d %s", width, label, count, reportBar(count, max))
+	b.WriteString(strings.TrimRight(line, " "))
+	b.WriteString("\n")
+}
+
+// median returns the median of some (unsorted) numbers
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+// formatNumber formats a number without needless decimals
+func formatNumber(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// numericAnswers returns the answers as numbers, if every answer is a number
+func numericAnswers(answers []*Answer) ([]float64, bool) {
+	var numbers []float64
+	for _, answer := range answers {
+		f, err := strconv.ParseFloat(strings.TrimSpace(answer.Value), 64)
+		if err != nil {
+			return nil, false
+		}
+		numbers = append(numbers, f)
+	}
+	return numbers, len(numbers) > 0
+}
+
+// reportCounts writes how many times each value was picked, most popular first
+func reportCounts(b *strings.Builder, answers []*Answer) {
+	counts := make(map[string]int)
+	for _, answer := range answers {
+		values := answer.Values
+		if len(values) == 0 {
+			values = []string{answer.Value}
+		}
+		for _, value := range values {
+			counts[value]++
+		}
+	}
+
+	var sorted []valueCount
+	width := 0
+	for value, count := range counts {
+		sorted = append(sorted, valueCount{value, count})
+		if len(value) > width {
+			width = len(value)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Count != sorted[j].Count {
+			return sorted[i].Count > sorted[j].Count
+		}
+		return sorted[i].Value < sorted[j].Value
+	})
+
+	for _, vc := range sorted {
+		reportLine(b, width, vc.Value, vc.Count, sorted[0].Count)
+	}
+}
+
+// reportHistogram writes a histogram of numeric answers
+func reportHistogram(b *strings.Builder, numbers []float64) {
+	min, max := numbers[0], numbers[0]
+	sum := 0.0
+	for _, n := range numbers {
+		min = math.Min(min, n)
+		max = math.Max(max, n)
+		sum += n
+	}
+
+	fmt.Fprintf(b, "    min %s, median %s, mean %s, max %s\n", formatNumber(min), formatNumber(median(numbers)),
+		formatNumber(math.Round(sum/float64(len(numbers))*100)/100), formatNumber(max))
+
+	buckets := reportBuckets
+	if max == min {
+		buckets = 1
+	}
+	size := (max - min) / float64(buckets)
+
+	counts := make([]int, buckets)
+	for _, n := range numbers {
+		i := buckets - 1
+		if size > 0 && n < max {
+			i = int((n - min) / size)
+		}
+		counts[i]++
+	}
+
+	largest := 0
+	labels := make([]string, buckets)
+	width := 0
+	for i := range counts {
+		if counts[i] > largest {
+			largest = counts[i]
+		}
+		if buckets == 1 {
+			labels[i] = formatNumber(min)
+		} else {
+			labels[i] = fmt.Sprintf("%s-%s", formatNumber(math.Round((min+size*float64(i))*100)/100), formatNumber(math.Round((min+size*float64(i+1))*100)/100))
+		}
+		if len(labels[i]) > width {
+			width = len(labels[i])
+		}
+	}
+
+	for i := range counts {
+		reportLine(b, width, labels[i], counts[i], largest)
+	}
+}
+
+// reportRule writes the summary statistics for a single rule's submissions.
+// Without the cancelled submissions there's no completion rate, as every
+// submission would be a completed one
+func reportRule(b *strings.Builder, rules *RuleSet, name string, subs []*Submission, keepCancelled bool) {
+	completed := 0
+	cancelled := 0
+	var durations []float64
+	for _, sub := range subs {
+		switch sub.Status {
+		case SubmissionCompleted:
+			completed++
+			if !sub.StartedAt.IsZero() && sub.FinishedAt.After(sub.StartedAt) {
+				durations = append(durations, sub.FinishedAt.Sub(sub.StartedAt).Seconds())
+			}
+		case SubmissionCancelled:
+			cancelled++
+		}
+	}
+
+	fmt.Fprintf(b, "%s\n", name)
+	if keepCancelled {
+		fmt.Fprintf(b, "  Submissions: %d (%d completed, %d cancelled, %.0f%% completed)\n", len(subs), completed, cancelled, percent(completed, completed+cancelled))
+	} else {
+		fmt.Fprintf(b, "  Submissions: %d (%d completed, completion rate n/a as cancelled submissions aren't kept)\n", len(subs), completed)
+	}
+	if len(durations) > 0 {
+		fmt.Fprintf(b, "  Median completion time: %s\n", time.Duration(median(durations)*float64(time.Second)).Round(time.Second))
+	}
+
+	for _, column := range exportColumns(rules, subs) {
+		var answers []*Answer
+		for _, sub := range subs {
+			if answer, ok := sub.Answer(column.InteractionID); ok {
+				answers = append(answers, answer)
+			}
+		}
+
+		fmt.Fprintf(b, "  %s (%s): %d answers\n", column.Header, column.InteractionID, len(answers))
+		if len(answers) == 0 {
+			continue
+		}
+
+		interaction, err := rules.findInteractionByID(column.InteractionID)
+		switch {
+		case err == nil && interaction.Type == "attachment":
+			reportCounts(b, answers)
+		case err != nil && answers[0].Type == "attachment":
+			reportCounts(b, answers)
+		default:
+			if numbers, ok := numericAnswers(answers); ok {
+				reportHistogram(b, numbers)
+			}
+		}
+	}
+}
+
+// buildReport summarises submissions for each rule: how many were completed
+// or cancelled, how long they took, and the answers to each interaction.
+// Button and menu answers are counted, and numeric text answers are shown as
+// a histogram. keepCancelled is whether cancelled submissions are kept, so the
+// completion rate can be worked out
+func buildReport(rules *RuleSet, subs []*Submission, keepCancelled bool) string {
+	if len(subs) == 0 {
+		return "No submissions found\n"
+	}
+
+	byRule := make(map[string][]*Submission)
+	var names []string
+	for _, sub := range subs {
+		if _, ok := byRule[sub.Rule]; !ok {
+			names = append(names, sub.Rule)
+		}
+		byRule[sub.Rule] = append(byRule[sub.Rule], sub)
+	}
+
+	// rules in the order they're in the rules file, then any which have gone
+	order := make(map[string]int)
+	for i, rule := range rules.Rules {
+		order[rule.title()] = i
+	}
+	sort.SliceStable(names, func(i, j int) bool {
+		oi, iok := order[names[i]]
+		oj, jok := order[names[j]]
+		if iok && jok {
+			return oi < oj
+		}
+		if iok != jok {
+			return iok
+		}
+		return names[i] < names[j]
+	})
+
+	var b strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		reportRule(&b, rules, name, byRule[name], keepCancelled)
+	}
+	return b.String()
+}
+
+// reportFor builds the report for the submissions matching opts
+func reportFor(cfg *BotConfig, rules *RuleSet, store SubmissionStore, opts ReportOptions) (string, error) {
+	since, err := parseSince(opts.Since)
+	if err != nil {
+		return "", err
+	}
+
+	ruleName := opts.Rule
+	if len(ruleName) > 0 {
+		rule, err := rules.findRuleByName(ruleName)
+		if err == nil {
+			ruleName = rule.title()
+		}
+	}
+
+	subs, err := store.List(SubmissionFilter{Rule: ruleName, Since: since})
+	if err != nil {
+		return "", err
+	}
+
+	return buildReport(rules, subs, cfg.SubmissionsKeepCancelled), nil
+}
+
+// ReportSubmissions writes summary statistics for the submissions matching
+// opts to w
+func ReportSubmissions(cfg *BotConfig, opts ReportOptions, w io.Writer) error {
+	rules, err := parseRuleFile(cfg.RulesFileLocation)
+	if err != nil {
+		return err
+	}
+
+	store := readSubmissionStore(cfg)
+	defer store.Close()
+
+	report, err := reportFor(cfg, rules, store, opts)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, report)
+	return err
+}
+
+// ReportCommand is what an admin sends the bot in a DM to get a report,
+// optionally followed by the rule to report on
+const ReportCommand = "report"
+
+// adminReport checks if a DM is an admin asking for a report, and if so,
+// returns the report. "report" on its own reports on every rule, "report"
+// followed by anything other than a rule isn't treated as a request for a
+// report, so it can still match a rule's search terms
+func adminReport(cfg *BotConfig, rules *RuleSet, subs SubmissionStore, user, msg string) (string, bool) {
+	if !cfg.isAdmin(user) {
+		return "", false
+	}
+
+	opts := ReportOptions{}
+	switch {
+	case msg == ReportCommand:
+	case strings.HasPrefix(msg, ReportCommand+" "):
+		rule, err := rules.findRuleByName(strings.TrimSpace(strings.TrimPrefix(msg, ReportCommand)))
+		if err != nil {
+			return "", false
+		}
+		opts.Rule = rule.title()
+	default:
+		return "", false
+	}
+
+	report, err := reportFor(cfg, rules, subs, opts)
+	if err != nil {
+		return fmt.Sprintf("Sorry, I couldn't build the report: %s", err), true
+	}
+	return fmt.Sprintf("```\n%s```", report), true
+}
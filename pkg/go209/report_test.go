@@ -0,0 +1,128 @@
+package go209
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSurveyRules is a rule with a menu, a numeric text question and a
+// finaltext interaction, which doesn't get a column
+func testSurveyRules() *RuleSet {
+	return &RuleSet{
+		Rules: []Rule{
+			{
+				Name:        "Pizza survey",
+				SearchTerms: []string{"pizza"},
+				Interactions: []Interaction{
+					{InteractionID: "p1", Type: "attachment", Question: "Topping?"},
+					{InteractionID: "p2", Type: "text", Question: "How many slices?"},
+					{InteractionID: "p3", Type: "finaltext", Response: "Thanks!"},
+				},
+				InteractionStart: "p1",
+			},
+			{Name: "Expenses", SearchTerms: []string{"expenses"}},
+		},
+	}
+}
+
+// testSubmission is a submission of the pizza survey, which took the given
+// number of minutes
+func testSubmission(id, status string, minutes int, answers ...Answer) *Submission {
+	started := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	return &Submission{
+		ID:         id,
+		Rule:       "Pizza survey",
+		UserID:     "U" + id,
+		Status:     status,
+		StartedAt:  started,
+		FinishedAt: started.Add(time.Duration(minutes) * time.Minute),
+		Answers:    answers,
+	}
+}
+
+func TestBuildReport(t *testing.T) {
+	rules := testSurveyRules()
+	subs := []*Submission{
+		testSubmission("1", SubmissionCompleted, 1, Answer{InteractionID: "p1", Type: "attachment", Value: "pepperoni"}, Answer{InteractionID: "p2", Type: "text", Value: "2"}),
+		testSubmission("2", SubmissionCompleted, 2, Answer{InteractionID: "p1", Type: "attachment", Value: "ham"}, Answer{InteractionID: "p2", Type: "text", Value: "4"}),
+		testSubmission("3", SubmissionCompleted, 3, Answer{InteractionID: "p1", Type: "attachment", Value: "ham, pineapple", Values: []string{"ham", "pineapple"}}, Answer{InteractionID: "p2", Type: "text", Value: " 6 "}),
+		testSubmission("4", SubmissionCancelled, 10, Answer{InteractionID: "p1", Type: "attachment", Value: "ham"}),
+		{ID: "5", Rule: "Old rule", Status: SubmissionCompleted, Answers: []Answer{{InteractionID: "o1", Type: "text", Value: "yes"}}},
+	}
+
+	report := buildReport(rules, subs, true)
+
+	want := []string{
+		"Pizza survey\n",
+		"  Submissions: 4 (3 completed, 1 cancelled, 75% completed)\n",
+		"  Median completion time: 2m0s\n",
+		"  Topping? (p1): 4 answers\n",
+		"    ham          3 ####################\n",
+		"    pepperoni    1 #######\n",
+		"    pineapple    1 #######\n",
+		"  How many slices? (p2): 3 answers\n",
+		"    min 2, median 4, mean 4, max 6\n",
+		"    2-2.8      1 ####################\n",
+		"    2.8-3.6    0\n",
+		"    3.6-4.4    1 ####################\n",
+		"    5.2-6      1 ####################\n",
+		"\nOld rule\n",
+		"  o1 (o1): 1 answers\n",
+	}
+	for _, line := range want {
+		if !strings.Contains(report, line) {
+			t.Errorf("report doesn't contain %q:\n%s", line, report)
+		}
+	}
+
+	// rules come in the order of the rules file, then the ones which have gone
+	if strings.Index(report, "Pizza survey") > strings.Index(report, "Old rule") {
+		t.Errorf("Old rule reported before Pizza survey:\n%s", report)
+	}
+	if strings.Contains(report, "p3") {
+		t.Errorf("report has the finaltext interaction:\n%s", report)
+	}
+	if strings.Contains(report, "Expenses") {
+		t.Errorf("report has a rule without submissions:\n%s", report)
+	}
+}
+
+func TestBuildReportWithoutCancelled(t *testing.T) {
+	rules := testSurveyRules()
+	subs := []*Submission{
+		testSubmission("1", SubmissionCompleted, 1),
+		testSubmission("2", SubmissionCompleted, 2),
+	}
+
+	report := buildReport(rules, subs, false)
+	want := "  Submissions: 2 (2 completed, completion rate n/a as cancelled submissions aren't kept)\n"
+	if !strings.Contains(report, want) {
+		t.Errorf("report doesn't contain %q:\n%s", want, report)
+	}
+	if strings.Contains(report, "100%") {
+		t.Errorf("report has a completion rate:\n%s", report)
+	}
+
+	if report := buildReport(rules, nil, true); report != "No submissions found\n" {
+		t.Errorf("report of no submissions = %q", report)
+	}
+}
+
+func TestMedian(t *testing.T) {
+	tests := []struct {
+		values []float64
+		want   float64
+	}{
+		{nil, 0},
+		{[]float64{3}, 3},
+		{[]float64{5, 1, 3}, 3},
+		{[]float64{4, 1, 3, 2}, 2.5},
+	}
+
+	for _, test := range tests {
+		if got := median(test.values); got != test.want {
+			t.Errorf("median(%v) = %v, want %v", test.values, got, test.want)
+		}
+	}
+}
@@ -4,30 +4,80 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"strings"
+	"text/template"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/nlopes/slack"
 )
 
+// DefaultHelpTerms are the terms which trigger the built-in help, if the
+// rules file doesn't set help_terms
+var DefaultHelpTerms = []string{"help", "what can you do"}
+
 // RuleSet is the parent struct that defines the rules.json file
 type RuleSet struct {
-	Rules                        []Rule `json:"rules"`
-	DefaultResponse              string `json:"default"`
-	InteractionCancelledResponse string `json:"interaction_cancelled_response,omitempty"`
-	InteractionCompleteResponse  string `json:"interaction_complete_response,omitempty"`
+	Rules                        []Rule   `json:"rules"`
+	DefaultResponse              string   `json:"default"`
+	InteractionCancelledResponse string   `json:"interaction_cancelled_response,omitempty"`
+	InteractionCompleteResponse  string   `json:"interaction_complete_response,omitempty"`
+	HelpTerms                    []string `json:"help_terms,omitempty"`
+	SuggestionThreshold          float64  `json:"suggestion_threshold,omitempty"`
+	IntentThreshold              float64  `json:"intent_threshold,omitempty"`
+	MaxSessions                  int      `json:"max_sessions,omitempty"`
+	MaxSessionsResponse          string   `json:"max_sessions_response,omitempty"`
+
+	// classifier is trained from the rules' examples when the file is parsed
+	classifier *intentClassifier
+
+	// anonymousSalt is used to hash the users of anonymous rules
+	anonymousSalt string
+
+	// access caches what's needed from slack to check allow and deny lists
+	access *accessCache
+
+	// moduleTimeout is MODULE_TIMEOUT, for the on_answer modules and data
+	// providers
+	moduleTimeout time.Duration
+
+	// providers caches what the data providers return
+	providers *providerCache
 }
 
 // Rule defines the mapping of search terms (i.e. words a user may say to the
 // bot), to a simple response, OR, the initiation of a more complex
 // interaction
 type Rule struct {
-	SearchTerms        []string         `json:"terms"`
-	Response           string           `json:"response,omitempty"`
-	Attachment         slack.Attachment `json:"attachment,omitempty"`
-	Interactions       []Interaction    `json:"interactions,omitempty"`
-	InteractionStart   string           `json:"interaction_start,omitempty"`
-	InteractionEndMods []string         `json:"interaction_end_mods,omitempty"`
-	SubTerms           []SubTerm        `json:"subterms,omitempty"`
+	SearchTerms             []string         `json:"terms"`
+	Examples                []string         `json:"examples,omitempty"`
+	Name                    string           `json:"name,omitempty"`
+	Description             string           `json:"description,omitempty"`
+	Hidden                  bool             `json:"hidden,omitempty"`
+	SlashCommand            string           `json:"slash_command,omitempty"`
+	Anonymous               bool             `json:"anonymous,omitempty"`
+	DuplicateResponse       string           `json:"duplicate_response,omitempty"`
+	Once                    bool             `json:"once,omitempty"`
+	OnceEvery               string           `json:"once_every,omitempty"`
+	MaxPerHour              int              `json:"max_per_hour,omitempty"`
+	LimitResponse           string           `json:"limit_response,omitempty"`
+	Allow                   *AccessList      `json:"allow,omitempty"`
+	Deny                    *AccessList      `json:"deny,omitempty"`
+	NotPermittedResponse    string           `json:"not_permitted_response,omitempty"`
+	Response                string           `json:"response,omitempty"`
+	Attachment              slack.Attachment `json:"attachment,omitempty"`
+	Interactions            []Interaction    `json:"interactions,omitempty"`
+	InteractionStart        string           `json:"interaction_start,omitempty"`
+	InteractionStartDynamic []DynamicNext    `json:"interaction_start_dynamic,omitempty"`
+	InteractionEndMods      []EndMod         `json:"interaction_end_mods,omitempty"`
+	OnStart                 []EndMod         `json:"on_start,omitempty"`
+	OnCancel                []EndMod         `json:"on_cancel,omitempty"`
+	OnExpire                []EndMod         `json:"on_expire,omitempty"`
+	ModuleFailureResponse   string           `json:"module_failure_response,omitempty"`
+	SubTerms                []SubTerm        `json:"subterms,omitempty"`
+
+	// onceEvery is OnceEvery, parsed when the file is parsed
+	onceEvery time.Duration
 }
 
 // SubTerm defines the mapping of a sub-search term
@@ -53,17 +103,50 @@ type Interaction struct {
 	NextInteraction        string           `json:"next_interaction"`
 	Attachment             slack.Attachment `json:"attachment,omitempty"`
 	NextInteractionDynamic []DynamicNext    `json:"next_interaction_dynamic,omitempty"`
+	OnAnswer               []EndMod         `json:"on_answer,omitempty"`
+	OptionsFrom            *DataSource      `json:"options_from,omitempty"`
+	TextFrom               *DataSource      `json:"text_from,omitempty"`
 }
 
 // DynamicNext defines dynamic branching.
 // This occurs after an interaction, with an attachment, is responded to by
 // a user, which subsequently sends a web hook. We use these to determine the
-// next interaction to present to the user
+// next interaction to present to the user. They are also used to pick the
+// starting interaction of a rule from the text passed to its slash command.
 type DynamicNext struct {
 	Response        string `json:"response"`
 	NextInteraction string `json:"next_interaction"`
 }
 
+// EndMod is a module to run at the end of a rule's interactions. In the rules
+// file it's either the module's name, or an object with the module's name and
+// its config (and timeout) for this rule
+type EndMod struct {
+	Module  string          `json:"module"`
+	Config  json.RawMessage `json:"config,omitempty"`
+	Timeout string          `json:"timeout,omitempty"`
+
+	// timeout is Timeout, parsed when the file is parsed
+	timeout time.Duration
+}
+
+// UnmarshalJSON decodes an EndMod from a module's name, or an object
+func (e *EndMod) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*e = EndMod{Module: name}
+		return nil
+	}
+
+	type endMod EndMod
+	var mod endMod
+	if err := json.Unmarshal(data, &mod); err != nil {
+		return fmt.Errorf("interaction_end_mods must be a module name, or an object with a module: %s", err)
+	}
+	*e = EndMod(mod)
+	return nil
+}
+
 // findInteractionByID looks for a particular interaction within a rule
 func (r *Rule) findInteractionByID(id string) (*Interaction, error) {
 	for _, interaction := range r.Interactions {
@@ -74,6 +157,127 @@ func (r *Rule) findInteractionByID(id string) (*Interaction, error) {
 	return nil, fmt.Errorf("No Interaction found with ID: '%s'", id)
 }
 
+// startingInteraction determines the first interaction of a rule. If the rule
+// was started from a slash command, the arguments may select a different
+// starting interaction via interaction_start_dynamic
+func (r *Rule) startingInteraction(args string) (*Interaction, error) {
+	start := r.InteractionStart
+	args = strings.ToLower(strings.TrimSpace(args))
+	for _, dynamicNext := range r.InteractionStartDynamic {
+		if strings.ToLower(dynamicNext.Response) == args {
+			start = dynamicNext.NextInteraction
+		}
+	}
+	return r.findInteractionByID(start)
+}
+
+// title is how we refer to a rule outside of a DM, such as on the App Home tab
+// or in the help. This is the rule's name, or its first search term
+func (r *Rule) title() string {
+	if len(r.Name) > 0 {
+		return r.Name
+	}
+	if len(r.SearchTerms) == 0 {
+		return ""
+	}
+	return r.SearchTerms[0]
+}
+
+// helpTerms returns the terms which trigger the built-in help
+func (r *RuleSet) helpTerms() []string {
+	if len(r.HelpTerms) > 0 {
+		return r.HelpTerms
+	}
+	return DefaultHelpTerms
+}
+
+// helpText lists all the rules which aren't hidden, and how to trigger them,
+// leaving out the ones the user isn't permitted to use
+func (r *RuleSet) helpText(dir slackDirectory, team, user string) string {
+	var b strings.Builder
+	b.WriteString("Here's what I can help you with:\n")
+
+	for _, rule := range r.Rules {
+		if rule.Hidden || len(rule.SearchTerms) == 0 || !r.permitted(dir, &rule, team, user) {
+			continue
+		}
+
+		fmt.Fprintf(&b, "• *%s*", rule.title())
+		if len(rule.Description) > 0 {
+			fmt.Fprintf(&b, " - %s", rule.Description)
+		}
+
+		terms := make([]string, 0, len(rule.SearchTerms))
+		for _, term := range rule.SearchTerms {
+			terms = append(terms, fmt.Sprintf("'%s'", term))
+		}
+		fmt.Fprintf(&b, "\n    Just say %s", strings.Join(terms, " or "))
+		if len(rule.SlashCommand) > 0 {
+			fmt.Fprintf(&b, ", or use %s", rule.SlashCommand)
+		}
+		b.WriteString("\n")
+	}
+
+	return b.String()
+}
+
+// templateFuncs are the template functions which need the rules, for instance
+// {{help}} which renders the same list as the built-in help for the user
+func (r *RuleSet) templateFuncs(dir slackDirectory, team, user string) template.FuncMap {
+	return template.FuncMap{
+		"help": func() string { return r.helpText(dir, team, user) },
+	}
+}
+
+// findRuleByTitle looks for the rule with a particular title
+func (r *RuleSet) findRuleByTitle(title string) (*Rule, error) {
+	for _, rule := range r.Rules {
+		if rule.title() == title {
+			return &rule, nil
+		}
+	}
+	return nil, fmt.Errorf("No rule found with title: '%s'", title)
+}
+
+// findRuleByName looks for a rule by its title or one of its search terms,
+// ignoring case. This is how rules are picked from the command line
+func (r *RuleSet) findRuleByName(name string) (*Rule, error) {
+	for i, rule := range r.Rules {
+		if strings.EqualFold(rule.title(), name) {
+			return &r.Rules[i], nil
+		}
+		for _, term := range rule.SearchTerms {
+			if strings.EqualFold(term, name) {
+				return &r.Rules[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("No rule found called: '%s'", name)
+}
+
+// findRuleByMessage looks for the first rule with a search term contained in
+// the (lowercased) message
+func (r *RuleSet) findRuleByMessage(msg string) (*Rule, string, error) {
+	for i, rule := range r.Rules {
+		for _, term := range rule.SearchTerms {
+			if strings.Contains(msg, term) {
+				return &r.Rules[i], term, nil
+			}
+		}
+	}
+	return nil, "", fmt.Errorf("No rule found for message: '%s'", msg)
+}
+
+// findRuleBySlashCommand looks for the rule which is started by a slash command
+func (r *RuleSet) findRuleBySlashCommand(command string) (*Rule, error) {
+	for _, rule := range r.Rules {
+		if len(rule.SlashCommand) > 0 && rule.SlashCommand == command {
+			return &rule, nil
+		}
+	}
+	return nil, fmt.Errorf("No rule found for slash command: '%s'", command)
+}
+
 // findInteractionByID looks for a particular interaction within ALL the rules
 func (r *RuleSet) findInteractionByID(id string) (*Interaction, error) {
 	for _, rule := range r.Rules {
@@ -138,6 +342,51 @@ func parseRuleFile(fileLoc string) (*RuleSet, error) {
 		}
 	}
 
+	// checking that interaction_start_dynamic points to valid interactions
+	for _, rule := range rules.Rules {
+		for _, dynamicNext := range rule.InteractionStartDynamic {
+			if _, err := rule.findInteractionByID(dynamicNext.NextInteraction); err != nil {
+				return nil, fmt.Errorf("We couldn't find an interaction for '%s'", dynamicNext.NextInteraction)
+			}
+		}
+	}
+
+	if rules.SuggestionThreshold < 0 || rules.SuggestionThreshold > 1 {
+		return nil, fmt.Errorf("suggestion_threshold must be between 0 and 1: %f", rules.SuggestionThreshold)
+	}
+
+	if rules.IntentThreshold < 0 || rules.IntentThreshold > 1 {
+		return nil, fmt.Errorf("intent_threshold must be between 0 and 1: %f", rules.IntentThreshold)
+	}
+
+	// checking that rule titles are unique, they're used to refer to rules
+	// outside of a DM
+	ruletitles := make(map[string]bool)
+	for _, rule := range rules.Rules {
+		if _, ok := ruletitles[rule.title()]; ok == true {
+			return nil, fmt.Errorf("Duplicate rule name (or first search term) found: %s", rule.title())
+		}
+		ruletitles[rule.title()] = true
+	}
+
+	// checking that slash commands are unique, and look like slash commands
+	slashcommands := make(map[string]bool)
+	for _, rule := range rules.Rules {
+		if len(rule.SlashCommand) == 0 {
+			continue
+		}
+		if !strings.HasPrefix(rule.SlashCommand, "/") {
+			return nil, fmt.Errorf("Slash command must start with '/': %s", rule.SlashCommand)
+		}
+		if len(rule.Interactions) == 0 {
+			return nil, fmt.Errorf("Slash command must start a set of interactions: %s", rule.SlashCommand)
+		}
+		if _, ok := slashcommands[rule.SlashCommand]; ok == true {
+			return nil, fmt.Errorf("Duplicate slash command found: %s", rule.SlashCommand)
+		}
+		slashcommands[rule.SlashCommand] = true
+	}
+
 	// check to ensure that if there is a slack.Attachment, that the callback_id
 	// matches the interaction_id
 	for _, rule := range rules.Rules {
@@ -157,10 +406,88 @@ func parseRuleFile(fileLoc string) (*RuleSet, error) {
 		}
 	}
 
+	// checking the limits make sense
+	for i, rule := range rules.Rules {
+		if rule.MaxPerHour < 0 {
+			return nil, fmt.Errorf("max_per_hour can't be negative: %s", rule.title())
+		}
+		if rule.Once && len(rule.Interactions) == 0 {
+			return nil, fmt.Errorf("once only applies to rules with interactions: %s", rule.title())
+		}
+		if len(rule.OnceEvery) == 0 {
+			continue
+		}
+		if len(rule.Interactions) == 0 {
+			return nil, fmt.Errorf("once_every only applies to rules with interactions: %s", rule.title())
+		}
+		onceEvery, err := parsePeriod(rule.OnceEvery)
+		if err != nil {
+			return nil, err
+		}
+		if onceEvery <= 0 {
+			return nil, fmt.Errorf("once_every must be more than 0: %s", rule.title())
+		}
+		rules.Rules[i].onceEvery = onceEvery
+	}
+
+	// checking the module timeouts make sense. The lists share their arrays
+	// with the rules, so the parsed timeouts are kept
+	for _, rule := range rules.Rules {
+		for _, mods := range rule.moduleLists() {
+			for j, endMod := range mods {
+				if len(endMod.Timeout) == 0 {
+					continue
+				}
+				timeout, err := time.ParseDuration(endMod.Timeout)
+				if err != nil {
+					return nil, fmt.Errorf("Error parsing %s timeout in rule '%s': %s", endMod.Module, rule.title(), err)
+				}
+				if timeout <= 0 {
+					return nil, fmt.Errorf("%s timeout must be more than 0: %s", endMod.Module, rule.title())
+				}
+				mods[j].timeout = timeout
+			}
+		}
+		for _, interaction := range rule.Interactions {
+			if interaction.Type != "attachment" {
+				continue
+			}
+			for _, endMod := range interaction.OnAnswer {
+				if endMod.timeout > WebModuleTimeout {
+					return nil, fmt.Errorf("%s on_answer timeout can't be more than %s for attachment interactions, as slack is waiting on it: %s", endMod.Module, WebModuleTimeout, interaction.InteractionID)
+				}
+			}
+		}
+	}
+
+	// checking the data sources make sense
+	for _, rule := range rules.Rules {
+		for _, interaction := range rule.Interactions {
+			if interaction.OptionsFrom != nil && interaction.Type != "attachment" {
+				return nil, fmt.Errorf("options_from only applies to attachment interactions: %s", interaction.InteractionID)
+			}
+			for _, source := range interaction.dataSources() {
+				err := source.parse()
+				if err != nil {
+					return nil, fmt.Errorf("Interaction %s has a bad data source: %s", interaction.InteractionID, err)
+				}
+			}
+		}
+	}
+
+	if rules.MaxSessions < 0 {
+		return nil, fmt.Errorf("max_sessions can't be negative: %d", rules.MaxSessions)
+	}
+
+	rules.classifier = newIntentClassifier(rules.Rules)
+	rules.access = newAccessCache(AccessCacheTTL)
+	rules.providers = newProviderCache()
+
 	return &rules, nil
 }
 
-// DumpRules takes the rules.json and dumps it out.
+// DumpRules takes the rules.json and dumps it out, after checking the modules
+// it uses are loaded and their config is valid.
 func DumpRules(cfg *BotConfig) error {
 	rules, err := parseRuleFile(cfg.RulesFileLocation)
 
@@ -168,6 +495,16 @@ func DumpRules(cfg *BotConfig) error {
 		return err
 	}
 
+	err = loadPlugins(cfg)
+	if err != nil {
+		return err
+	}
+
+	err = rules.validateModules()
+	if err != nil {
+		return err
+	}
+
 	spew.Dump(rules)
 	return nil
 }
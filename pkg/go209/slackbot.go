@@ -9,8 +9,8 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"time"
 
-	"github.com/go-redis/redis"
 	"github.com/nlopes/slack"
 	log "github.com/sirupsen/logrus"
 )
@@ -46,27 +46,121 @@ func respondToDM(ev *slack.MessageEvent) bool {
 	return true
 }
 
-func finalizeInteraction(redKey, channel, username, user string, db *redis.Client, rules *RuleSet, re *regexp.Regexp, rtm *slack.RTM) {
-	finalval, err := db.HGetAll(redKey).Result()
-	log.Info(fmt.Sprintf("User %s (%s) has completed all interactions, final step %s", username, user, finalval["interaction"]))
-	log.Info(fmt.Sprintf("Interaction RESULT:\n%v", finalval))
-	err = db.Del(redKey).Err()
+// renderTemplate pre-parses and parses a template, with the rules' template
+// functions such as {{help}}, logging any errors. The directory and team are
+// used to check which rules the user can see
+func (r *RuleSet) renderTemplate(dir slackDirectory, team, templatetext, username, user, args string, re *regexp.Regexp) string {
+	resp := preParseTemplate(templatetext, re)
+	resp, err := parseTemplateWithArgs(resp, username, user, args, r.templateFuncs(dir, team, user))
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error parsing template: %s", err))
+	}
+	return resp
+}
+
+// askInteraction sends an interaction's question (and attachment) to a
+// channel, once its data providers have filled them in. A "finaltext"
+// interaction sends its response, it is then up to the caller to finalize the
+// interaction.
+func askInteraction(api *slack.Client, db StateStore, rules *RuleSet, team, channel string, interaction *Interaction, username, user, args string, re *regexp.Regexp) {
+	interaction = rules.resolveInteraction(db, interaction, user, username, args, time.Time{})
+	switch interaction.Type {
+	case "text":
+		api.PostMessage(channel, slack.MsgOptionText(rules.renderTemplate(api, team, interaction.Question, username, user, args, re), false))
+	case "attachment":
+		if len(interaction.Question) > 0 {
+			api.PostMessage(channel, slack.MsgOptionText(rules.renderTemplate(api, team, interaction.Question, username, user, args, re), false))
+		}
+		api.PostMessage(channel, slack.MsgOptionAttachments(interaction.Attachment))
+	case "finaltext":
+		api.PostMessage(channel, slack.MsgOptionText(rules.renderTemplate(api, team, interaction.Response, username, user, args, re), false))
+	}
+}
+
+// startInteraction saves the initial state for a rule's interactions, and asks
+// the first question. args are the (optional) arguments passed to a slash
+// command, which can select the starting interaction and are available to
+// templates as {{.Args}}
+func startInteraction(api *slack.Client, db StateStore, subs SubmissionStore, rules *RuleSet, rule *Rule, redKey, team, channel, user, username, args string, re *regexp.Regexp) error {
+	interaction, err := rule.startingInteraction(args)
 	if err != nil {
-		log.Warn(fmt.Sprintf("Error deleting hash: %s", err))
+		return fmt.Errorf("Error finding starting interaction: %s", err)
 	}
 
+	// anonymous rules can only be completed once by each user, as we can't
+	// tell their submissions apart afterwards
+	userHash := ""
+	if rule.Anonymous {
+		userHash = rules.anonymousHash(rule, user)
+		submitted, err := hasSubmitted(db, userHash)
+		if err != nil {
+			return err
+		}
+		if submitted {
+			resp := rule.DuplicateResponse
+			if len(resp) == 0 {
+				resp = DefaultDuplicateResponse
+			}
+			log.Info(fmt.Sprintf("Anonymous rule '%s' has already been completed by this user", rule.title()))
+			api.PostMessage(channel, slack.MsgOptionText(rules.renderTemplate(api, team, resp, username, user, args, re), false))
+			return nil
+		}
+	}
+
+	val, err := newState(db, redKey, user, username, args, userHash, rules.MaxSessions, interaction)
+	if err == errInteractionInProgress {
+		return err
+	}
+	if err == errTooManySessions {
+		log.Info(fmt.Sprintf("Too many sessions in progress to start rule '%s' for %s", rule.title(), logUser(rule.Anonymous, username, user)))
+		api.PostMessage(channel, slack.MsgOptionText(rules.renderTemplate(api, team, rules.maxSessionsResponse(), username, user, args, re), false))
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error saving initial state for interaction: %s", err)
+	}
+	rules.runStartHooks(db, rule, val, channel)
+	rules.trackExpiry(db, rule, redKey, channel, val)
+
+	// time to ask the first question
+	askInteraction(api, db, rules, team, channel, interaction, username, user, args, re)
+	if interaction.Type == "finaltext" {
+		finalval, err := endState(db, redKey, "", val["version"], FunnelCompleted)
+		if err == errStaleState {
+			// someone else has already finished (or cancelled) it
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		finalizeInteraction(finalval, team, channel, username, user, db, subs, rules, re, api)
+	}
+
+	return nil
+}
+
+// finalizeInteraction is called with the final state, which has already been
+// cleared, at the end of a set of interactions. It thanks the user and runs
+// any modules configured for the rule
+func finalizeInteraction(finalval map[string]string, team, channel, username, user string, db StateStore, subs SubmissionStore, rules *RuleSet, re *regexp.Regexp, api *slack.Client) {
+	var err error
+	sub := recordSubmission(subs, rules, finalval, SubmissionCompleted)
+	finalval["submission_id"] = sub.ID
+	log.Info(fmt.Sprintf("User %s has completed all interactions, final step %s, submission %s", logUser(isAnonymous(finalval), username, user), finalval["interaction"], sub.ID))
+	log.Info(fmt.Sprintf("Interaction RESULT:\n%v", finalval))
+
 	if len(rules.InteractionCompleteResponse) > 0 {
 		// We have a JSON rule to parse and respond with
 		resp := preParseTemplate(rules.InteractionCompleteResponse, re)
 
-		resp, err = parseTemplate(resp, username, user)
+		resp, err = parseTemplateWithArgs(resp, username, user, finalval["args"], rules.templateFuncs(api, team, user))
 		if err != nil {
 			log.Warn(fmt.Sprintf("Error parsing template: %s", err))
 		}
-		rtm.PostMessage(channel, slack.MsgOptionText(resp, false))
+		api.PostMessage(channel, slack.MsgOptionText(resp, false))
 
 	} else {
-		rtm.PostMessage(channel, slack.MsgOptionText("Thanks! We'll get back to you soon", false))
+		api.PostMessage(channel, slack.MsgOptionText("Thanks! We'll get back to you soon", false))
 	}
 
 	// now we check for any modules we need to parse for this rule
@@ -74,139 +168,143 @@ func finalizeInteraction(redKey, channel, username, user string, db *redis.Clien
 	if err != nil {
 		log.Warn(fmt.Sprintf("Couldn't find rule: %s", err))
 	} else {
+		err = rules.recordCompletion(db, thisRule, user)
+		if err != nil {
+			log.Warn(fmt.Sprintf("Error recording completion: %s", err))
+		}
+
 		// we have the rule, and therefore can check for end mods
-		if len(thisRule.InteractionEndMods) > 0 {
-			log.Debug(fmt.Sprintf("We found %d modules to run", len(thisRule.InteractionEndMods)))
-
-			for _, endModName := range thisRule.InteractionEndMods {
-				foundMod := false
-				for _, mod := range modules.Modules {
-					if endModName == mod.Name() {
-						foundMod = true
-						log.Debug(fmt.Sprintf("We found %s module to run", mod.Name()))
-
-						// Fetch the modules ENV VARs
-						evSet := make(map[string]string)
-						for _, ev := range mod.EnvVars() {
-							adjusted := strings.ToUpper(fmt.Sprintf("%s_%s", mod.Name(), ev))
-							evSet[adjusted] = os.Getenv(adjusted)
-						}
+		enqueueEndMods(db, thisRule, finalval, sub, channel)
+	}
+}
 
-						// Set the interactions
-						interactions := make(map[string]string)
-						for _, i := range thisRule.Interactions {
-							interactions[i.InteractionID] = i.Question
-						}
+// runRule responds to a message which matched one of the rule's search terms.
+// It sends the rule's response and attachment, and then kicks off any
+// interactions or sub-terms
+func runRule(api *slack.Client, db StateStore, subs SubmissionStore, rules *RuleSet, rule *Rule, redKey, team, channel, user, username, msg, term string, re *regexp.Regexp) error {
+	if !enforceAccess(api, rules, rule, team, channel, user, username, "", re) {
+		return nil
+	}
 
-						// Running the module
-						err = mod.Run(finalval, evSet, interactions)
-						if err != nil {
-							log.Warn(fmt.Sprintf("Error running module: %s", err))
-						}
-					}
-				}
+	ok, err := enforceLimits(api, db, rules, rule, team, channel, user, username, "", re)
+	if err != nil || !ok {
+		return err
+	}
 
-				if foundMod == false {
-					log.Warn(fmt.Sprintf("Referenced module not found: %s", endModName))
-				}
-			}
+	// If there's a response in the rule, send it now.
+	if len(rule.Response) > 0 {
+		resp := preParseTemplate(rule.Response, re)
+		resp, err := parseTemplateWithArgs(resp, username, user, "", rules.templateFuncs(api, team, user))
+		if err != nil {
+			log.Warn(fmt.Sprintf("Error parsing template: %s", err))
 		}
+
+		log.Info(fmt.Sprintf("Sending standard response to search term '%s' to %s", term, logUser(rule.Anonymous, username, user)))
+		api.PostMessage(channel, slack.MsgOptionText(resp, false))
+	}
+
+	// If there's an attachment in the rule, send it now
+	if len(rule.Attachment.Text) > 0 {
+		log.Info(fmt.Sprintf("Sending standard attachment to search term '%s' to %s", term, logUser(rule.Anonymous, username, user)))
+		api.PostMessage(channel, slack.MsgOptionAttachments(rule.Attachment))
+	}
+
+	// If there's interactions in the rule, kick it off
+	if len(rule.Interactions) > 0 && len(rule.InteractionStart) > 0 {
+		err := startInteraction(api, db, subs, rules, rule, redKey, team, channel, user, username, "", re)
+		if err != nil {
+			return err
+		}
+
+		log.Info(fmt.Sprintf("Initiating interaction to term '%s' to %s", term, logUser(rule.Anonymous, username, user)))
 	}
+
+	// If there's subterms in the rule, let's set the state to handle it
+	if len(rule.SubTerms) > 0 {
+		err := newSubTermState(db, redKey, msg)
+		if err != nil {
+			return fmt.Errorf("Error saving state: %s", err)
+		}
+
+		log.Info(fmt.Sprintf("Set state to handle sub search terms from '%s' to %s (%s)", term, username, user))
+	}
+
+	return nil
 }
 
 // handleDM handled all the slack.MessageEvents that the bot receives
 // Messages presented here have already been validated by respondToDM to ensure
 // the bot only responds to what it should
-func handleDM(rtm *slack.RTM, rules *RuleSet, msg, team, channel, user, username string, re *regexp.Regexp, db *redis.Client) {
-	// redKey is the key used in our redis state
+func handleDM(cfg *BotConfig, rtm *slack.RTM, rules *RuleSet, msg, team, channel, user, username string, re *regexp.Regexp, db StateStore, subs SubmissionStore) {
+	// redKey is the key used in our state
 	redKey := fmt.Sprintf("%s:%s", team, channel)
 
-	val, err := db.HGetAll(redKey).Result()
+	// only one message (or button click) is handled at a time for a session
+	unlock, err := lockState(db, redKey)
+	if err != nil {
+		log.Warn(err.Error())
+		rtm.PostMessage(channel, slack.MsgOptionText("Sorry, I'm still working on your last message, try again in a moment", false))
+		return
+	}
+	defer unlock()
+
+	val, err := db.Get(redKey)
 	if err != nil {
-		// If we get to this branch, it means there was a redis error?
-		log.Fatal(fmt.Sprintf("Redis error: %s", err))
+		// If we get to this branch, it means there was a state store error?
+		log.Fatal(fmt.Sprintf("State error: %s", err))
 	}
 
 	// No existing state is found, this is a fresh/stateless message
 	if len(val) == 0 {
 
-		//go through the rules first
-		for _, rule := range rules.Rules {
-			for _, term := range rule.SearchTerms {
-				// lowercase the string
-				msg = strings.ToLower(msg)
-
-				if strings.Contains(msg, term) {
-					// We found an instance of a 'searchTerm' in the message
-
-					// If there's a response in the rule, send it now.
-					if len(rule.Response) > 0 {
-						resp := preParseTemplate(rule.Response, re)
-						resp, err := parseTemplate(resp, username, user)
-						if err != nil {
-							log.Warn(fmt.Sprintf("Error parsing template: %s", err))
-						}
-
-						log.Info(fmt.Sprintf("Sending standard response to search term '%s' to %s (%s)", term, username, user))
-						rtm.PostMessage(channel, slack.MsgOptionText(resp, false))
-					}
-
-					// If there's an attachment in the rule, send it now
-					if len(rule.Attachment.Text) > 0 {
-						log.Info(fmt.Sprintf("Sending standard attachment to search term '%s' to %s (%s)", term, username, user))
-						rtm.PostMessage(channel, slack.MsgOptionAttachments(rule.Attachment))
-					}
-
-					// If there's interactions in the rule, kick it off
-					if len(rule.Interactions) > 0 && len(rule.InteractionStart) > 0 {
-						interaction, err := rule.findInteractionByID(rule.InteractionStart)
-						if err != nil {
-							log.Fatal(fmt.Sprintf("Error finding starting interaction: %s", err))
-						}
-
-						err = newState(db, redKey, user, username, interaction)
-						if err != nil {
-							log.Fatal(fmt.Sprintf("Error saving initial state for interaction: %s", err))
-						}
+		// lowercase the string
+		msg = strings.ToLower(msg)
 
-						log.Info(fmt.Sprintf("Initiating interaction to term '%s' to %s (%s)", term, username, user))
+		// admins can ask for a report on the submissions
+		if report, ok := adminReport(cfg, rules, subs, user, msg); ok {
+			log.Info(fmt.Sprintf("Sending report to admin %s (%s)", username, user))
+			rtm.PostMessage(channel, slack.MsgOptionText(report, false))
+			return
+		}
 
-						// time to ask the first question
-						switch interaction.Type {
-						case "text":
-							rtm.PostMessage(channel, slack.MsgOptionText(interaction.Question, false))
-						case "attachment":
-							if len(interaction.Question) > 0 {
-								rtm.PostMessage(channel, slack.MsgOptionText(interaction.Question, false))
-							}
-							rtm.PostMessage(channel, slack.MsgOptionAttachments(interaction.Attachment))
-						case "finaltext":
-							rtm.PostMessage(channel, slack.MsgOptionText(interaction.Response, false))
-							finalizeInteraction(redKey, channel, username, user, db, rules, re, rtm)
-						}
-					}
+		route := rules.routeMessage(msg)
+		switch route.Kind {
+		case routeSearchTerm:
+			// We found an instance of a 'searchTerm' in the message
+			err = runRule(&rtm.Client, db, subs, rules, route.Rule, redKey, team, channel, user, username, msg, route.Term, re)
+			if err != nil {
+				log.Fatal(fmt.Sprintf("Error running rule: %s", err))
+			}
 
-					// If there's subterms in the rule, let's set the state to handle it
-					if len(rule.SubTerms) > 0 {
-						err := newSubTermState(db, redKey, msg)
-						if err != nil {
-							log.Fatal(fmt.Sprintf("Error saving state: %s", err))
-						}
+			// if we find a matching rule, we process it and return
+			// this also means that we don't handle duplicate rules.
+			return
 
-						log.Info(fmt.Sprintf("Set state to handle sub search terms from '%s' to %s (%s)", term, username, user))
-					}
+		case routeHelp:
+			log.Info(fmt.Sprintf("Sending help to %s (%s)", username, user))
+			rtm.PostMessage(channel, slack.MsgOptionText(rules.helpText(&rtm.Client, team, user), false))
+			return
 
-					// if we find a matching rule, we process it and return
-					// this also means that we don't handle duplicate rules.
-					return
-				}
+		case routeIntent:
+			log.Info(fmt.Sprintf("Classified intent as '%s' (confidence %.2f) for %s", route.Rule.title(), route.Confidence, logUser(route.Rule.Anonymous, username, user)))
+			err = runRule(&rtm.Client, db, subs, rules, route.Rule, redKey, team, channel, user, username, route.Term, route.Term, re)
+			if err != nil {
+				log.Fatal(fmt.Sprintf("Error running rule: %s", err))
 			}
+			return
+		}
+
+		// no rule matched, maybe it was a typo
+		if rule, term, err := rules.suggestRule(&rtm.Client, team, user, msg); err == nil {
+			log.Info(fmt.Sprintf("Suggesting search term '%s' to %s (%s)", term, username, user))
+			rtm.PostMessage(channel, slack.MsgOptionText(fmt.Sprintf("Did you mean '%s'?", term), false), slack.MsgOptionAttachments(suggestionAttachment(rule, term)))
+			return
 		}
 
 		// if we get to here - just throw the default
 		resp := preParseTemplate(rules.DefaultResponse, re)
 
-		resp, err = parseTemplate(resp, username, user)
+		resp, err = parseTemplateWithArgs(resp, username, user, "", rules.templateFuncs(&rtm.Client, team, user))
 		if err != nil {
 			log.Warn(fmt.Sprintf("Error parsing template: %s", err))
 		}
@@ -215,7 +313,7 @@ func handleDM(rtm *slack.RTM, rules *RuleSet, msg, team, channel, user, username
 		rtm.PostMessage(channel, slack.MsgOptionText(resp, false))
 
 	} else {
-		// Because we found a valid state in redis,  we are within an interaction now!
+		// Because we found a valid state,  we are within an interaction now!
 
 		if _, ok := val["searchTerm"]; ok == true {
 			// This is a sub-term state
@@ -236,11 +334,7 @@ func handleDM(rtm *slack.RTM, rules *RuleSet, msg, team, channel, user, username
 										foundSubTerm = true
 										// If there's a response in the rule, send it now.
 										if len(subTerm.Response) > 0 {
-											resp := preParseTemplate(subTerm.Response, re)
-											resp, err := parseTemplate(resp, username, user)
-											if err != nil {
-												log.Warn(fmt.Sprintf("Error parsing template: %s", err))
-											}
+											resp := rules.renderTemplate(&rtm.Client, team, subTerm.Response, username, user, "", re)
 
 											log.Info(fmt.Sprintf("Sending sub-term response to search term '%s'/'%s' to %s (%s)", val["searchTerm"], subTermSearch, username, user))
 											rtm.PostMessage(channel, slack.MsgOptionText(resp, false))
@@ -259,9 +353,9 @@ func handleDM(rtm *slack.RTM, rules *RuleSet, msg, team, channel, user, username
 				}
 			}
 			// We always delete the state now
-			err := db.Del(redKey).Err()
+			err := db.Delete(redKey)
 			if err != nil {
-				log.Warn(fmt.Sprintf("Error deleting hash: %s", err))
+				log.Warn(fmt.Sprintf("Error deleting state: %s", err))
 			}
 		} else {
 			// We are assuming we're now in an interaction state
@@ -269,16 +363,23 @@ func handleDM(rtm *slack.RTM, rules *RuleSet, msg, team, channel, user, username
 			// If the message is the stop-word, kill the session and send the interaction
 			// cancelled message
 			if msg == val["stop_word"] {
-				err = db.Del(redKey).Err()
+				val, err = endState(db, redKey, "", "", FunnelCancelled)
 				if err != nil {
-					log.Warn(fmt.Sprintf("Error deleting hash: %s", err))
+					log.Warn(fmt.Sprintf("Error deleting state: %s", err))
+					return
 				}
-				log.Info(fmt.Sprintf("User %s (%s) has cancelled interaction %s", username, user, val["interaction"]))
+				if len(val) == 0 {
+					// it finished (or timed out) before we got to it
+					return
+				}
+				sub := recordSubmission(subs, rules, val, SubmissionCancelled)
+				log.Info(fmt.Sprintf("User %s has cancelled interaction %s, submission %s", logUser(isAnonymous(val), username, user), val["interaction"], sub.ID))
+				rules.runCancelHooks(db, val, sub, channel)
 				if len(rules.InteractionCancelledResponse) > 0 {
 					// We have a JSON rule to parse and respond with
 					resp := preParseTemplate(rules.InteractionCancelledResponse, re)
 
-					resp, err = parseTemplate(resp, username, user)
+					resp, err = parseTemplateWithArgs(resp, username, user, val["args"], rules.templateFuncs(&rtm.Client, team, user))
 					if err != nil {
 						log.Warn(fmt.Sprintf("Error parsing template: %s", err))
 					}
@@ -287,48 +388,59 @@ func handleDM(rtm *slack.RTM, rules *RuleSet, msg, team, channel, user, username
 				} else {
 					rtm.PostMessage(channel, slack.MsgOptionText("Interaction cancelled", false))
 				}
+			} else if rule, err := rules.findRuleByID(val["interaction"]); err == nil && !enforceAccess(&rtm.Client, rules, rule, team, channel, user, username, val["args"], re) {
+				// the allow and deny lists could have changed since the
+				// interactions were started, they can still use the stop word
+				return
 			} else {
-				// The message wasn't the stop-word, we're going to save the response into redis
-				err = db.HSet(redKey, fmt.Sprintf("response:%s", val["interaction"]), msg).Err()
-				if err != nil {
-					log.Fatal(fmt.Sprintf("Error saving response into hash: %s", err))
-				}
-
-				log.Info(fmt.Sprintf("User %s (%s) has responded to an interaction %s", username, user, val["interaction"]))
-
-				// Determine if this was the last interaction in the rule
+				// The message wasn't the stop-word, we're going to save the response into the state
+				// and move on to the next interaction (if there is one) in the one transaction
+				var nextinteraction *Interaction
 				if val["next_interaction"] != "end" {
 					// This was not the last interaction (because the next isn't 'end')
-					// Because there is another, we have to load it up, and then update the state
-					// and then send the interaction to the user
-
-					nextinteraction, err := rules.findInteractionByID(val["next_interaction"])
+					nextinteraction, err = rules.findInteractionByID(val["next_interaction"])
 					if err != nil {
 						log.Fatal(fmt.Sprintf("Error getting the next interaction: %s", err))
 					}
-					// We should probably throw a hard error above
-					err = updateState(db, redKey, nextinteraction)
-					if err != nil {
-						log.Fatal(fmt.Sprintf("Error updating the state: %s", err))
+				}
+
+				// the on_answer modules can reject the answer, in which case
+				// the question stays as it is for them to try again
+				if interaction, err := rules.findInteractionByID(val["interaction"]); err == nil {
+					if reason, ok := rules.checkAnswer(db, interaction, val, []string{msg}, 0); !ok {
+						rtm.PostMessage(channel, slack.MsgOptionText(reason, false))
+						return
 					}
+				}
 
-					// time to ask the next question
-					switch nextinteraction.Type {
-					case "text":
-						rtm.PostMessage(channel, slack.MsgOptionText(nextinteraction.Question, false))
-					case "attachment":
-						if len(nextinteraction.Question) > 0 {
-							rtm.PostMessage(channel, slack.MsgOptionText(nextinteraction.Question, false))
-						}
-						rtm.PostMessage(channel, slack.MsgOptionAttachments(nextinteraction.Attachment))
-					case "finaltext":
-						rtm.PostMessage(channel, slack.MsgOptionText(nextinteraction.Response, false))
-						finalizeInteraction(redKey, channel, username, user, db, rules, re, rtm)
+				finalval, finished, err := advanceState(db, redKey, val["interaction"], val["version"], []string{msg}, nextinteraction)
+				if err == errStaleState {
+					// a button click (or another message) got in first
+					log.Info(fmt.Sprintf("User %s has already responded to interaction %s", logUser(isAnonymous(val), username, user), val["interaction"]))
+					rtm.PostMessage(channel, slack.MsgOptionText("Looks like you've already answered that one", false))
+					return
+				}
+				if err != nil {
+					log.Fatal(fmt.Sprintf("Error saving response into state: %s", err))
+				}
+
+				log.Info(fmt.Sprintf("User %s has responded to an interaction %s", logUser(isAnonymous(val), username, user), val["interaction"]))
+
+				if !finished {
+					if rule, err := rules.findRuleByID(nextinteraction.InteractionID); err == nil {
+						rules.trackExpiry(db, rule, redKey, channel, finalval)
 					}
-				} else {
+				}
+
+				if nextinteraction != nil {
+					// time to ask the next question
+					askInteraction(&rtm.Client, db, rules, team, channel, nextinteraction, username, user, val["args"], re)
+				}
+
+				if finished {
 					// This is now after receiving text after the *final* interaction
-					// We will store the result, then clear the state and handle the response
-					finalizeInteraction(redKey, channel, username, user, db, rules, re, rtm)
+					// The state has been cleared, so handle the response
+					finalizeInteraction(finalval, team, channel, username, user, db, subs, rules, re, &rtm.Client)
 				}
 			}
 		}
@@ -337,6 +449,34 @@ func handleDM(rtm *slack.RTM, rules *RuleSet, msg, team, channel, user, username
 
 // StartBot starts the slack bot
 func StartBot(cfg *BotConfig) error {
+	err := loadPlugins(cfg)
+	if err != nil {
+		return err
+	}
+
+	db, err := NewStateStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	subs, err := NewSubmissionStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer subs.Close()
+
+	stopSweeper := startFunnelSweeper(db)
+	defer stopSweeper()
+
+	stopJobs := startJobWorkers(db, slack.New(cfg.SlackToken), cfg.JobWorkers, cfg.ModuleTimeout)
+	defer stopJobs()
+
+	return runBot(cfg, db, subs)
+}
+
+// runBot runs the slack bot until the RTM connection ends
+func runBot(cfg *BotConfig, db StateStore, subs SubmissionStore) error {
 	botUsername := ""
 	botID := ""
 
@@ -346,19 +486,19 @@ func StartBot(cfg *BotConfig) error {
 		return err
 	}
 
-	// compile the regular expression
-	re := regexp.MustCompile(TemplatePreParserRegex)
+	err = rules.setAnonymousSalt(cfg.AnonymousSalt)
+	if err != nil {
+		return err
+	}
 
-	// setup redis
-	db := redis.NewClient(&redis.Options{
-		Addr:     cfg.RedisAddr,
-		Password: cfg.RedisPwd,
-		DB:       cfg.RedisDB,
-	})
-	_, err = db.Ping().Result()
+	err = rules.validateModules()
 	if err != nil {
-		return fmt.Errorf("Redis error: %s", err)
+		return err
 	}
+	rules.moduleTimeout = cfg.ModuleTimeout
+
+	// compile the regular expression
+	re := regexp.MustCompile(TemplatePreParserRegex)
 
 	// configure the logger
 	log.SetOutput(os.Stdout)
@@ -380,18 +520,25 @@ func StartBot(cfg *BotConfig) error {
 	// start a new goroutine with the slack RTM API
 	go rtm.ManageConnection()
 
+	// DMs are handled by a pool of workers, so one slow user doesn't hold up
+	// everyone else
+	workers := newDMWorkers(cfg.BotWorkers, func(ev *slack.MessageEvent) {
+		u, err := rtm.GetUserInfo(ev.Msg.User)
+		if err != nil {
+			log.Error(fmt.Sprintf("*** MessageEvent - GetUserInfo error: %s", err))
+		} else {
+			handleDM(cfg, rtm, rules, ev.Msg.Text, ev.Msg.Team, ev.Msg.Channel, ev.Msg.User, u.RealName, re, db, subs)
+		}
+	})
+	defer workers.stop()
+
 	// handle incoming RTM messages
 	for msg := range rtm.IncomingEvents {
 		switch ev := msg.Data.(type) {
 
 		case *slack.MessageEvent:
 			if respondToDM(ev) {
-				u, err := rtm.GetUserInfo(ev.Msg.User)
-				if err != nil {
-					log.Error(fmt.Sprintf("*** MessageEvent - GetUserInfo error: %s", err))
-				} else {
-					handleDM(rtm, rules, ev.Msg.Text, ev.Msg.Team, ev.Msg.Channel, ev.Msg.User, u.RealName, re, db)
-				}
+				workers.dispatch(ev)
 			}
 
 		case *slack.HelloEvent:
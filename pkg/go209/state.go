@@ -1,15 +1,21 @@
 package go209
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
 )
 
 // RedisDefaultExpiration is the default period of time a redis state should last for
 // slack has a 30 min window for interactive messages and the response_url
 // even though we don't use the response_url, let's set the timeout slightly shorter
+// This applies to all the state backends, not just redis.
 //
 // @TODO: Should this be much much shorter, like, 5 minutes?
 // How long is an interaction meant to take?
@@ -18,89 +24,319 @@ const RedisDefaultExpiration = "29m"
 // RedisSubTermExpiration is the default period of time a redis state should last when handling sub-term matching
 const RedisSubTermExpiration = "5m"
 
-// newSubTermState takes the user and the search term, saving the state
-// This occurs at the start of a sub-term word search
-func newSubTermState(db *redis.Client, redKey, searchTerm string) error {
-	err := db.HSet(redKey, "searchTerm", searchTerm).Err()
-	if err != nil {
-		return fmt.Errorf("Error setting new hash: %s", err)
+// The state backends which can be set with BotConfig.StateBackend
+const (
+	StateBackendRedis  = "redis"
+	StateBackendMemory = "memory"
+	StateBackendBolt   = "bolt"
+)
+
+// ErrStateConflict is returned by StateStore.Update when the state kept
+// changing underneath it
+var ErrStateConflict = errors.New("State changed by someone else")
+
+// errStaleState is returned by a state transition when the state has already
+// moved on from what the caller expected, for instance when a button is
+// clicked twice, or a text reply races a button click
+var errStaleState = errors.New("State has already moved on")
+
+// errInteractionInProgress is returned when a user tries to start a rule while
+// they're already in the middle of a set of interactions
+var errInteractionInProgress = errors.New("Interaction already in progress")
+
+// StateStore is where go209 keeps the state of a conversation with a user,
+// keyed by team and channel. A state is a set of fields, just like a redis
+// hash, which expires if it isn't finished in time.
+type StateStore interface {
+	// Get returns all the fields of a state. If there is no state (or it has
+	// expired) an empty map is returned
+	Get(key string) (map[string]string, error)
+
+	// Set adds (or overwrites) fields of a state, creating it if it doesn't
+	// exist. If ttl is more than 0 the state will expire after ttl, otherwise
+	// the existing expiry is left as is
+	Set(key string, fields map[string]string, ttl time.Duration) error
+
+	// Update atomically replaces the fields of a state with those returned by
+	// fn, which is given the current fields (an empty map if there is no
+	// state). If fn returns no fields the state is deleted, if fn returns an
+	// error nothing is changed and the error is returned. ttl works as it does
+	// for Set. If the state keeps being changed by someone else while fn runs,
+	// ErrStateConflict is returned
+	Update(key string, ttl time.Duration, fn func(fields map[string]string) (map[string]string, error)) error
+
+	// Delete removes a state
+	Delete(key string) error
+
+	// Incr atomically adds by to a numeric field of a state, creating the
+	// state (and the field, from 0) if they don't exist, and returns the new
+	// value. The expiry is left as is. This is used for counters, which get
+	// updated too often to be read, changed and written back with Update
+	Incr(key, field string, by int64) (int64, error)
+
+	// ZAdd adds a member to a sorted set, or changes its score. Sorted sets
+	// are kept apart from the states, and never expire. They're used to keep
+	// things by when they're due, like sessions by when they expire, so only
+	// the ones which are due need to be looked at
+	ZAdd(key, member string, score int64) error
+
+	// ZRangeByScore returns the members of a sorted set with a score of at
+	// most max, lowest first. If limit is more than 0, only that many are
+	// returned
+	ZRangeByScore(key string, max int64, limit int) ([]string, error)
+
+	// ZCount counts the members of a sorted set with a score of more than min
+	ZCount(key string, min int64) (int64, error)
+
+	// ZRem removes a member from a sorted set, returning true if it was
+	// there. Only one caller can remove a member, so this is how something
+	// due is claimed when more than one process is looking
+	ZRem(key, member string) (bool, error)
+
+	// Lock locks a state, so a single session is only handled by one thing at
+	// a time. If it's already locked, Lock waits up to wait for it to be
+	// unlocked, then gives up with ErrLockTimeout. The lock is released by
+	// calling the returned func, or automatically after ttl if the backend
+	// is shared between processes
+	Lock(key string, ttl, wait time.Duration) (func(), error)
+
+	// Close releases any resources held by the store
+	Close() error
+}
+
+// NewStateStore creates the state store configured by cfg.StateBackend,
+// which defaults to redis
+func NewStateStore(cfg *BotConfig) (StateStore, error) {
+	switch cfg.StateBackend {
+	case "", StateBackendRedis:
+		if len(cfg.RedisAddr) == 0 {
+			return nil, fmt.Errorf("Missing REDIS_ADDR ENV variable. Check --help for options")
+		}
+		return newRedisStore(cfg.RedisAddr, cfg.RedisPwd, cfg.RedisDB)
+	case StateBackendMemory:
+		return newMemoryStore(), nil
+	case StateBackendBolt:
+		return newBoltStore(cfg.StatePath)
+	}
+	return nil, fmt.Errorf("Unknown state backend: %s", cfg.StateBackend)
+}
+
+// incrField adds by to a numeric field, for the backends which implement Incr
+// with Update, returning the new value
+func incrField(fields map[string]string, field string, by int64) int64 {
+	value, _ := strconv.ParseInt(fields[field], 10, 64)
+	value += by
+	fields[field] = strconv.FormatInt(value, 10)
+	return value
+}
+
+// dueMembers returns the members of a sorted set with a score of at most max,
+// lowest first (then by name), for the backends which keep sorted sets as a
+// map. If limit is more than 0, only that many are returned
+func dueMembers(scores map[string]int64, max int64, limit int) []string {
+	members := []string{}
+	for member, score := range scores {
+		if score <= max {
+			members = append(members, member)
+		}
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		if scores[members[i]] != scores[members[j]] {
+			return scores[members[i]] < scores[members[j]]
+		}
+		return members[i] < members[j]
+	})
+
+	if limit > 0 && len(members) > limit {
+		members = members[:limit]
 	}
+	return members
+}
 
+// newSubTermState takes the user and the search term, saving the state
+// This occurs at the start of a sub-term word search
+func newSubTermState(db StateStore, redKey, searchTerm string) error {
 	dur, err := time.ParseDuration(RedisSubTermExpiration)
 	if err != nil {
-		return fmt.Errorf("Couldn't parse duration for redis expiry: %s", err)
+		return fmt.Errorf("Couldn't parse duration for state expiry: %s", err)
 	}
 
-	err = db.Expire(redKey, dur).Err()
+	err = db.Set(redKey, map[string]string{"searchTerm": searchTerm}, dur)
 	if err != nil {
-		return fmt.Errorf("Error expiring hash: %s", err)
+		return fmt.Errorf("Error setting new state: %s", err)
 	}
 
 	return nil
 }
 
-// newState takes the user and interaction and saves the state
-// This occurs at the start of an interaction
-func newState(db *redis.Client, redKey, user, username string, interaction *Interaction) error {
-	err := db.HSet(redKey, "interaction", interaction.InteractionID).Err()
-	if err != nil {
-		return fmt.Errorf("Error setting new hash: %s", err)
-	}
+// nextVersion bumps the version of a state, which changes on every transition
+// so a stale caller can tell the state has moved on
+func nextVersion(fields map[string]string) string {
+	version, _ := strconv.Atoi(fields["version"])
+	return strconv.Itoa(version + 1)
+}
 
+// newState takes the user and interaction and saves the state, in one
+// transaction. This occurs at the start of an interaction. If there's already
+// a state, errInteractionInProgress is returned and the state is left alone.
+// If userHash is set the rule is anonymous, and the hash is kept instead of
+// the user's ID and name. If maxSessions is more than 0 and that many sessions
+// are already in progress, errTooManySessions is returned and no state is kept.
+// No state is kept either if the session can't be tracked
+func newState(db StateStore, redKey, user, username, args, userHash string, maxSessions int, interaction *Interaction) (map[string]string, error) {
 	dur, err := time.ParseDuration(RedisDefaultExpiration)
 	if err != nil {
-		return fmt.Errorf("Couldn't parse duration for redis expiry: %s", err)
+		return nil, fmt.Errorf("Couldn't parse duration for state expiry: %s", err)
 	}
 
-	err = db.Expire(redKey, dur).Err()
-	if err != nil {
-		return fmt.Errorf("Error expiring hash: %s", err)
-	}
+	var created map[string]string
+	err = db.Update(redKey, dur, func(fields map[string]string) (map[string]string, error) {
+		if len(fields) > 0 {
+			return nil, errInteractionInProgress
+		}
 
-	err = db.HSet(redKey, "stop_word", interaction.StopWord).Err()
-	if err != nil {
-		return fmt.Errorf("Error adding new key to hash: %s", err)
-	}
+		created = map[string]string{
+			"interaction":      interaction.InteractionID,
+			"stop_word":        interaction.StopWord,
+			"userid":           user,
+			"username":         username,
+			"type":             interaction.Type,
+			"next_interaction": interaction.NextInteraction,
+			"version":          nextVersion(fields),
+			"submission_id":    newSubmissionID(),
+			"started_at":       time.Now().UTC().Format(time.RFC3339),
+		}
+
+		if len(args) > 0 {
+			created["args"] = args
+		}
 
-	err = db.HSet(redKey, "userid", user).Err()
+		if len(userHash) > 0 {
+			delete(created, "userid")
+			delete(created, "username")
+			created["anonymous"] = "true"
+			created["user_hash"] = userHash
+		}
+
+		return created, nil
+	})
+	if err == errInteractionInProgress {
+		return nil, err
+	}
 	if err != nil {
-		return fmt.Errorf("Error adding new key to hash: %s", err)
+		return nil, fmt.Errorf("Error setting new state: %s", err)
 	}
 
-	err = db.HSet(redKey, "username", username).Err()
+	err = claimSession(db, redKey, interaction.InteractionID, time.Now().Add(dur), maxSessions)
 	if err != nil {
-		return fmt.Errorf("Error adding new key to hash: %s", err)
+		// nobody has seen the state yet, so it can just go
+		if err := db.Delete(redKey); err != nil {
+			log.Warn(fmt.Sprintf("Error deleting state: %s", err))
+		}
+		return nil, err
 	}
 
-	err = db.HSet(redKey, "type", interaction.Type).Err()
+	recordFunnel(db, interaction.InteractionID, FunnelStarted)
+	recordFunnel(db, interaction.InteractionID, FunnelEntered)
+
+	return created, nil
+}
+
+// advanceState saves the response to the current interaction and moves the
+// state on to the next interaction, in one transaction. A response with more
+// than one value (such as a multi-select menu) is also saved as a JSON list in
+// values:<interaction>. The state must still
+// be at interaction and version, otherwise errStaleState is returned and
+// nothing changes, so a double-click or a text reply racing a button click
+// can't answer the same question twice.
+//
+// If next is nil, or a "finaltext" interaction, the interactions are over and
+// the state is deleted. The final fields are returned along with true, ready
+// to be handed to finalizeInteraction
+func advanceState(db StateStore, redKey, interaction, version string, response []string, next *Interaction) (map[string]string, bool, error) {
+	var result map[string]string
+	finished := next == nil || next.Type == "finaltext"
+
+	err := db.Update(redKey, 0, func(fields map[string]string) (map[string]string, error) {
+		if len(fields) == 0 || fields["interaction"] != interaction || fields["version"] != version {
+			return nil, errStaleState
+		}
+
+		fields[fmt.Sprintf("response:%s", interaction)] = strings.Join(response, ", ")
+		if len(response) > 1 {
+			values, err := json.Marshal(response)
+			if err != nil {
+				return nil, fmt.Errorf("Error marshalling json: %s", err)
+			}
+			fields[fmt.Sprintf("values:%s", interaction)] = string(values)
+		}
+		if next != nil {
+			fields["interaction"] = next.InteractionID
+			fields["type"] = next.Type
+			fields["next_interaction"] = next.NextInteraction
+		}
+		fields["version"] = nextVersion(fields)
+
+		result = fields
+		if finished {
+			return nil, nil
+		}
+		return fields, nil
+	})
+	if err == errStaleState {
+		return nil, false, err
+	}
 	if err != nil {
-		return fmt.Errorf("Error adding new key to hash: %s", err)
+		return nil, false, fmt.Errorf("Error updating state: %s", err)
 	}
 
-	err = db.HSet(redKey, "next_interaction", interaction.NextInteraction).Err()
-	if err != nil {
-		return fmt.Errorf("Error adding new key to hash: %s", err)
+	recordFunnel(db, interaction, FunnelAnswered)
+	if finished {
+		recordFunnel(db, interaction, FunnelCompleted)
+		endSession(db, redKey)
+		completeAnonymous(db, result)
+	} else {
+		recordFunnel(db, next.InteractionID, FunnelEntered)
+		moveSession(db, redKey, next.InteractionID)
 	}
 
-	return nil
+	return result, finished, nil
 }
 
-// updateState occurs within a set of interactions, and updates the redis state
-func updateState(db *redis.Client, redKey string, interaction *Interaction) error {
-	err := db.HSet(redKey, "interaction", interaction.InteractionID).Err()
-	if err != nil {
-		return fmt.Errorf("Error updating hash: %s", err)
-	}
+// endState deletes the state in one transaction, returning the fields it had.
+// If interaction or version are set, the state is only deleted if it's still
+// at them, otherwise errStaleState is returned. If there was no state, the
+// returned fields are empty. event is the funnel event recorded against the
+// interaction the state was at (FunnelCancelled or FunnelCompleted)
+func endState(db StateStore, redKey, interaction, version, event string) (map[string]string, error) {
+	var ended map[string]string
 
-	err = db.HSet(redKey, "type", interaction.Type).Err()
+	err := db.Update(redKey, 0, func(fields map[string]string) (map[string]string, error) {
+		if len(fields) > 0 && len(interaction) > 0 && fields["interaction"] != interaction {
+			return nil, errStaleState
+		}
+		if len(fields) > 0 && len(version) > 0 && fields["version"] != version {
+			return nil, errStaleState
+		}
+		ended = fields
+		return nil, nil
+	})
+	if err == errStaleState {
+		return nil, err
+	}
 	if err != nil {
-		return fmt.Errorf("Error updating hash: %s", err)
+		return nil, fmt.Errorf("Error deleting state: %s", err)
 	}
 
-	err = db.HSet(redKey, "next_interaction", interaction.NextInteraction).Err()
-	if err != nil {
-		return fmt.Errorf("Error updating hash: %s", err)
+	if len(ended) > 0 {
+		recordFunnel(db, ended["interaction"], event)
+		endSession(db, redKey)
+		if event == FunnelCompleted {
+			completeAnonymous(db, ended)
+		}
+		delete(ended, "user_hash")
 	}
 
-	return nil
+	return ended, nil
 }
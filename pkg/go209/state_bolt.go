@@ -0,0 +1,311 @@
+package go209
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// DefaultStatePath is where the bolt state backend keeps its database
+const DefaultStatePath = "go209.db"
+
+// boltStateBucket is the bolt bucket states are kept in
+var boltStateBucket = []byte("state")
+
+// boltSetsBucket is the bolt bucket sorted sets are kept in, with a bucket for
+// each set, holding each member's score
+var boltSetsBucket = []byte("sets")
+
+// boltState is how a single state is kept in bolt
+type boltState struct {
+	Fields  map[string]string `json:"fields"`
+	Expires time.Time         `json:"expires,omitempty"`
+}
+
+// expired returns true if the state has an expiry which has passed
+func (b *boltState) expired(now time.Time) bool {
+	return !b.Expires.IsZero() && now.After(b.Expires)
+}
+
+// boltStore keeps state in an embedded bolt database on disk, so state
+// survives restarts without needing redis. Only one process can have the
+// database open at a time, so the slack bot and web server need to be run in
+// the one process (go209 run)
+type boltStore struct {
+	db    *bolt.DB
+	done  chan struct{}
+	locks *keyedMutex
+}
+
+// boltSweepInterval is how often expired states are cleared out of bolt
+const boltSweepInterval = time.Minute
+
+// newBoltStore opens (or creates) the bolt database, clearing out any
+// states which expired while go209 wasn't running
+func newBoltStore(path string) (*boltStore, error) {
+	if len(path) == 0 {
+		path = DefaultStatePath
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Error opening bolt database %s: %s", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltStateBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(boltSetsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Error preparing bolt database %s: %s", path, err)
+	}
+
+	s := &boltStore{db: db, done: make(chan struct{}), locks: newKeyedMutex()}
+
+	err = s.sweep()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Error clearing expired state: %s", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(boltSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.sweep(); err != nil {
+					log.Warn(fmt.Sprintf("Error clearing expired state: %s", err))
+				}
+			case <-s.done:
+				return
+			}
+		}
+	}()
+
+	return s, nil
+}
+
+// sweep deletes all the expired states
+func (s *boltStore) sweep() error {
+	now := time.Now()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltStateBucket)
+
+		var expired [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var state boltState
+			if err := json.Unmarshal(v, &state); err != nil || state.expired(now) {
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Get returns the fields of the state
+func (s *boltStore) Get(key string) (map[string]string, error) {
+	fields := make(map[string]string)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltStateBucket).Get([]byte(key))
+		if v == nil {
+			return nil
+		}
+
+		var state boltState
+		if err := json.Unmarshal(v, &state); err != nil {
+			return fmt.Errorf("Error decoding json: %s", err)
+		}
+		if state.expired(time.Now()) {
+			return nil
+		}
+
+		fields = state.Fields
+		return nil
+	})
+
+	return fields, err
+}
+
+// Set sets fields on the state, and its expiry if ttl is more than 0
+func (s *boltStore) Set(key string, fields map[string]string, ttl time.Duration) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltStateBucket)
+		now := time.Now()
+
+		state := boltState{Fields: make(map[string]string)}
+		if v := b.Get([]byte(key)); v != nil {
+			if err := json.Unmarshal(v, &state); err != nil || state.expired(now) {
+				state = boltState{Fields: make(map[string]string)}
+			}
+		}
+
+		for k, v := range fields {
+			state.Fields[k] = v
+		}
+		if ttl > 0 {
+			state.Expires = now.Add(ttl)
+		}
+
+		v, err := json.Marshal(state)
+		if err != nil {
+			return fmt.Errorf("Error marshalling json: %s", err)
+		}
+		return b.Put([]byte(key), v)
+	})
+}
+
+// Update replaces the fields of the state with those returned by fn, within
+// a bolt read-write transaction
+func (s *boltStore) Update(key string, ttl time.Duration, fn func(fields map[string]string) (map[string]string, error)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltStateBucket)
+		now := time.Now()
+
+		state := boltState{Fields: make(map[string]string)}
+		if v := b.Get([]byte(key)); v != nil {
+			if err := json.Unmarshal(v, &state); err != nil || state.expired(now) {
+				state = boltState{Fields: make(map[string]string)}
+			}
+		}
+
+		updated, err := fn(state.Fields)
+		if err != nil {
+			return err
+		}
+
+		if len(updated) == 0 {
+			return b.Delete([]byte(key))
+		}
+
+		state.Fields = updated
+		if ttl > 0 {
+			state.Expires = now.Add(ttl)
+		}
+
+		v, err := json.Marshal(state)
+		if err != nil {
+			return fmt.Errorf("Error marshalling json: %s", err)
+		}
+		return b.Put([]byte(key), v)
+	})
+}
+
+// Delete removes the state
+func (s *boltStore) Delete(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltStateBucket).Delete([]byte(key))
+	})
+}
+
+// Incr increments a field of the state, within a bolt read-write transaction
+func (s *boltStore) Incr(key, field string, by int64) (int64, error) {
+	var value int64
+	err := s.Update(key, 0, func(fields map[string]string) (map[string]string, error) {
+		value = incrField(fields, field, by)
+		return fields, nil
+	})
+	return value, err
+}
+
+// ZAdd adds a member to the sorted set's bucket
+func (s *boltStore) ZAdd(key, member string, score int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(boltSetsBucket).CreateBucketIfNotExists([]byte(key))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(member), []byte(strconv.FormatInt(score, 10)))
+	})
+}
+
+// setScores reads all the scores in a sorted set's bucket
+func (s *boltStore) setScores(key string) (map[string]int64, error) {
+	scores := make(map[string]int64)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltSetsBucket).Bucket([]byte(key))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			score, err := strconv.ParseInt(string(v), 10, 64)
+			if err != nil {
+				return fmt.Errorf("Error decoding score of %s: %s", k, err)
+			}
+			scores[string(k)] = score
+			return nil
+		})
+	})
+	return scores, err
+}
+
+// ZRangeByScore returns the members of the sorted set due by max
+func (s *boltStore) ZRangeByScore(key string, max int64, limit int) ([]string, error) {
+	scores, err := s.setScores(key)
+	if err != nil {
+		return nil, err
+	}
+	return dueMembers(scores, max, limit), nil
+}
+
+// ZCount counts the members of the sorted set with a score of more than min
+func (s *boltStore) ZCount(key string, min int64) (int64, error) {
+	scores, err := s.setScores(key)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	for _, score := range scores {
+		if score > min {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// ZRem removes a member from the sorted set's bucket
+func (s *boltStore) ZRem(key, member string) (bool, error) {
+	removed := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltSetsBucket).Bucket([]byte(key))
+		if b == nil || b.Get([]byte(member)) == nil {
+			return nil
+		}
+		removed = true
+		return b.Delete([]byte(member))
+	})
+	return removed, err
+}
+
+// Lock locks the state within this process. Only one process can have the
+// database open, so there's no need to keep locks in it
+func (s *boltStore) Lock(key string, ttl, wait time.Duration) (func(), error) {
+	return s.locks.Lock(key, wait)
+}
+
+// Close stops the sweeper and closes the bolt database
+func (s *boltStore) Close() error {
+	close(s.done)
+	return s.db.Close()
+}
@@ -0,0 +1,92 @@
+package go209
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// StateLockTTL is how long a session lock is held before it's released
+// automatically, in case whoever held it crashed
+const StateLockTTL = 30 * time.Second
+
+// StateLockWait is how long we'll wait for someone else to release a session
+// lock before giving up
+const StateLockWait = 10 * time.Second
+
+// ErrLockTimeout is returned by StateStore.Lock when the lock couldn't be
+// acquired in time
+var ErrLockTimeout = errors.New("Timed out waiting for the session lock")
+
+// lockState locks a session (a state key) so only one message or callback is
+// handled for it at a time. The returned func releases the lock
+func lockState(db StateStore, redKey string) (func(), error) {
+	unlock, err := db.Lock(redKey, StateLockTTL, StateLockWait)
+	if err != nil {
+		return nil, fmt.Errorf("Error locking session %s: %s", redKey, err)
+	}
+	return unlock, nil
+}
+
+// keyedLock is a lock for a single key, held by keyedMutex
+type keyedLock struct {
+	ch   chan struct{}
+	refs int
+}
+
+// keyedMutex is a set of in-process locks, one per key. Locks are created
+// when they're first needed, and removed again once no-one is holding or
+// waiting on them. This is used by the state backends which only work in a
+// single process
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+// newKeyedMutex creates an empty keyedMutex
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{
+		locks: make(map[string]*keyedLock),
+	}
+}
+
+// release drops a reference to a key's lock, removing it if it's unused
+func (k *keyedMutex) release(key string, l *keyedLock) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	l.refs--
+	if l.refs == 0 {
+		delete(k.locks, key)
+	}
+}
+
+// Lock locks a key, waiting up to wait for it to be released by someone else
+func (k *keyedMutex) Lock(key string, wait time.Duration) (func(), error) {
+	k.mu.Lock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{ch: make(chan struct{}, 1)}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case l.ch <- struct{}{}:
+		var once sync.Once
+		return func() {
+			once.Do(func() {
+				<-l.ch
+				k.release(key, l)
+			})
+		}, nil
+	case <-timer.C:
+		k.release(key, l)
+		return nil, ErrLockTimeout
+	}
+}
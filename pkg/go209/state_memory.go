@@ -0,0 +1,205 @@
+package go209
+
+import (
+	"sync"
+	"time"
+)
+
+// memoryState is a single state held by the memoryStore
+type memoryState struct {
+	fields  map[string]string
+	expires time.Time
+}
+
+// expired returns true if the state has an expiry which has passed
+func (m *memoryState) expired(now time.Time) bool {
+	return !m.expires.IsZero() && now.After(m.expires)
+}
+
+// memoryStore keeps state in memory. State is lost when go209 stops, and
+// isn't shared between processes, so this is only useful for testing, or when
+// running the slack bot and web server in the one process (go209 run)
+type memoryStore struct {
+	mu     sync.Mutex
+	states map[string]*memoryState
+	sets   map[string]map[string]int64
+	locks  *keyedMutex
+}
+
+// newMemoryStore creates an empty memoryStore
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		states: make(map[string]*memoryState),
+		sets:   make(map[string]map[string]int64),
+		locks:  newKeyedMutex(),
+	}
+}
+
+// Get returns a copy of the fields of the state
+func (s *memoryStore) Get(key string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fields := make(map[string]string)
+	state, ok := s.states[key]
+	if !ok {
+		return fields, nil
+	}
+
+	if state.expired(time.Now()) {
+		delete(s.states, key)
+		return fields, nil
+	}
+
+	for k, v := range state.fields {
+		fields[k] = v
+	}
+	return fields, nil
+}
+
+// Set sets fields on the state, and its expiry if ttl is more than 0
+func (s *memoryStore) Set(key string, fields map[string]string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	state, ok := s.states[key]
+	if !ok || state.expired(now) {
+		state = &memoryState{fields: make(map[string]string)}
+		s.states[key] = state
+	}
+
+	for k, v := range fields {
+		state.fields[k] = v
+	}
+	if ttl > 0 {
+		state.expires = now.Add(ttl)
+	}
+
+	// sweep any other expired states while we're here
+	for k, other := range s.states {
+		if other.expired(now) {
+			delete(s.states, k)
+		}
+	}
+
+	return nil
+}
+
+// Update replaces the fields of the state with those returned by fn, while
+// holding the lock
+func (s *memoryStore) Update(key string, ttl time.Duration, fn func(fields map[string]string) (map[string]string, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	state, ok := s.states[key]
+	if !ok || state.expired(now) {
+		state = &memoryState{fields: make(map[string]string)}
+	}
+
+	fields := make(map[string]string, len(state.fields))
+	for k, v := range state.fields {
+		fields[k] = v
+	}
+
+	updated, err := fn(fields)
+	if err != nil {
+		return err
+	}
+
+	if len(updated) == 0 {
+		delete(s.states, key)
+		return nil
+	}
+
+	state.fields = updated
+	if ttl > 0 {
+		state.expires = now.Add(ttl)
+	}
+	s.states[key] = state
+
+	return nil
+}
+
+// Delete removes the state
+func (s *memoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.states, key)
+	return nil
+}
+
+// Incr increments a field of the state, while holding the lock
+func (s *memoryStore) Incr(key, field string, by int64) (int64, error) {
+	var value int64
+	err := s.Update(key, 0, func(fields map[string]string) (map[string]string, error) {
+		value = incrField(fields, field, by)
+		return fields, nil
+	})
+	return value, err
+}
+
+// ZAdd adds a member to the sorted set
+func (s *memoryStore) ZAdd(key, member string, score int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	set, ok := s.sets[key]
+	if !ok {
+		set = make(map[string]int64)
+		s.sets[key] = set
+	}
+	set[member] = score
+	return nil
+}
+
+// ZRangeByScore returns the members of the sorted set due by max
+func (s *memoryStore) ZRangeByScore(key string, max int64, limit int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return dueMembers(s.sets[key], max, limit), nil
+}
+
+// ZCount counts the members of the sorted set with a score of more than min
+func (s *memoryStore) ZCount(key string, min int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+	for _, score := range s.sets[key] {
+		if score > min {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// ZRem removes a member from the sorted set
+func (s *memoryStore) ZRem(key, member string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	set := s.sets[key]
+	if _, ok := set[member]; !ok {
+		return false, nil
+	}
+	delete(set, member)
+	if len(set) == 0 {
+		delete(s.sets, key)
+	}
+	return true, nil
+}
+
+// Lock locks the state within this process. The lock can't outlive the
+// process, so ttl isn't needed
+func (s *memoryStore) Lock(key string, ttl, wait time.Duration) (func(), error) {
+	return s.locks.Lock(key, wait)
+}
+
+// Close does nothing, there's nothing to release
+func (s *memoryStore) Close() error {
+	return nil
+}
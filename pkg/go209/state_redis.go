@@ -0,0 +1,207 @@
+package go209
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/go-redis/redis"
+)
+
+// redisStore keeps state in redis hashes. This lets the slack bot and web
+// server share state, even when they're running in different processes (or
+// on different hosts)
+type redisStore struct {
+	db *redis.Client
+}
+
+// newRedisStore connects to redis, making sure it's reachable
+func newRedisStore(addr, pwd string, db int) (*redisStore, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: pwd,
+		DB:       db,
+	})
+	_, err := client.Ping().Result()
+	if err != nil {
+		return nil, fmt.Errorf("Redis error: %s", err)
+	}
+
+	return &redisStore{db: client}, nil
+}
+
+// Get returns all the fields of the hash
+func (s *redisStore) Get(key string) (map[string]string, error) {
+	return s.db.HGetAll(key).Result()
+}
+
+// Set sets fields on the hash, and its expiry if ttl is more than 0
+func (s *redisStore) Set(key string, fields map[string]string, ttl time.Duration) error {
+	values := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		values[k] = v
+	}
+
+	_, err := s.db.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HMSet(key, values)
+		if ttl > 0 {
+			pipe.Expire(key, ttl)
+		}
+		return nil
+	})
+	return err
+}
+
+// redisUpdateRetries is how many times an Update is retried when the hash
+// changes between WATCH and EXEC
+const redisUpdateRetries = 5
+
+// Update WATCHes the hash, then writes the fields returned by fn in a
+// MULTI/EXEC transaction. If the hash changes before the EXEC, fn is run again
+// against the new fields
+func (s *redisStore) Update(key string, ttl time.Duration, fn func(fields map[string]string) (map[string]string, error)) error {
+	for i := 0; i < redisUpdateRetries; i++ {
+		err := s.db.Watch(func(tx *redis.Tx) error {
+			current, err := tx.HGetAll(key).Result()
+			if err != nil {
+				return err
+			}
+
+			// fn gets its own copy, so we can work out which fields went away
+			fields := make(map[string]string, len(current))
+			for k, v := range current {
+				fields[k] = v
+			}
+
+			updated, err := fn(fields)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+				if len(updated) == 0 {
+					pipe.Del(key)
+					return nil
+				}
+
+				var removed []string
+				for k := range current {
+					if _, ok := updated[k]; !ok {
+						removed = append(removed, k)
+					}
+				}
+				if len(removed) > 0 {
+					pipe.HDel(key, removed...)
+				}
+
+				values := make(map[string]interface{}, len(updated))
+				for k, v := range updated {
+					values[k] = v
+				}
+				pipe.HMSet(key, values)
+				if ttl > 0 {
+					pipe.Expire(key, ttl)
+				}
+				return nil
+			})
+			return err
+		}, key)
+
+		if err == redis.TxFailedErr {
+			continue
+		}
+		return err
+	}
+
+	return ErrStateConflict
+}
+
+// Delete removes the hash
+func (s *redisStore) Delete(key string) error {
+	return s.db.Del(key).Err()
+}
+
+// Incr increments a field of the hash with HINCRBY
+func (s *redisStore) Incr(key, field string, by int64) (int64, error) {
+	return s.db.HIncrBy(key, field, by).Result()
+}
+
+// ZAdd adds a member to the sorted set with ZADD
+func (s *redisStore) ZAdd(key, member string, score int64) error {
+	return s.db.ZAdd(key, redis.Z{Score: float64(score), Member: member}).Err()
+}
+
+// ZRangeByScore returns the members due by max with ZRANGEBYSCORE
+func (s *redisStore) ZRangeByScore(key string, max int64, limit int) ([]string, error) {
+	return s.db.ZRangeByScore(key, redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(max, 10),
+		Count: int64(limit),
+	}).Result()
+}
+
+// ZCount counts the members with a score of more than min with ZCOUNT
+func (s *redisStore) ZCount(key string, min int64) (int64, error) {
+	return s.db.ZCount(key, fmt.Sprintf("(%d", min), "+inf").Result()
+}
+
+// ZRem removes a member from the sorted set with ZREM
+func (s *redisStore) ZRem(key, member string) (bool, error) {
+	n, err := s.db.ZRem(key, member).Result()
+	return n > 0, err
+}
+
+// redisLockRetry is how often we try to take a lock someone else is holding
+const redisLockRetry = 50 * time.Millisecond
+
+// redisUnlockScript only deletes a lock if we still hold it, so we don't
+// release a lock which expired and was taken by someone else
+var redisUnlockScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0
+`)
+
+// Lock takes a lock with SET NX and an expiry, so a crashed process can't
+// hold a lock forever. The lock is keyed by lock:<key>, and holds a random
+// token so only the holder can release it
+func (s *redisStore) Lock(key string, ttl, wait time.Duration) (func(), error) {
+	lockKey := fmt.Sprintf("lock:%s", key)
+
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, fmt.Errorf("Error generating lock token: %s", err)
+	}
+	token := hex.EncodeToString(b)
+
+	deadline := time.Now().Add(wait)
+	for {
+		ok, err := s.db.SetNX(lockKey, token, ttl).Result()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return func() {
+				err := redisUnlockScript.Run(s.db, []string{lockKey}, token).Err()
+				if err != nil && err != redis.Nil {
+					log.Warn(fmt.Sprintf("Error releasing lock %s: %s", lockKey, err))
+				}
+			}, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, ErrLockTimeout
+		}
+		time.Sleep(redisLockRetry)
+	}
+}
+
+// Close closes the redis client
+func (s *redisStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,489 @@
+package go209
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStores returns each of the state backends which don't need a server,
+// empty, with a func to clean them up
+func testStores(t *testing.T) (map[string]StateStore, func()) {
+	dir, err := ioutil.TempDir("", "go209")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bolt, err := newBoltStore(filepath.Join(dir, "state.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	stores := map[string]StateStore{
+		StateBackendMemory: newMemoryStore(),
+		StateBackendBolt:   bolt,
+	}
+	return stores, func() {
+		for _, db := range stores {
+			db.Close()
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestStateStoreGetSet(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+
+	for name, db := range stores {
+		fields, err := db.Get("missing")
+		if err != nil || fields == nil || len(fields) != 0 {
+			t.Errorf("%s: Get of a missing state = %v, %v, want an empty map", name, fields, err)
+		}
+
+		err = db.Set("k", map[string]string{"a": "1", "b": "2"}, 0)
+		if err != nil {
+			t.Fatalf("%s: Set: %s", name, err)
+		}
+		err = db.Set("k", map[string]string{"b": "3", "c": "4"}, 0)
+		if err != nil {
+			t.Fatalf("%s: Set: %s", name, err)
+		}
+
+		fields, err = db.Get("k")
+		if err != nil {
+			t.Fatalf("%s: Get: %s", name, err)
+		}
+		want := map[string]string{"a": "1", "b": "3", "c": "4"}
+		if !equalFields(fields, want) {
+			t.Errorf("%s: Get = %v, want %v", name, fields, want)
+		}
+
+		// changing what Get returned mustn't change the state
+		fields["a"] = "changed"
+		fields, _ = db.Get("k")
+		if fields["a"] != "1" {
+			t.Errorf("%s: Get returned the stored map, not a copy", name)
+		}
+	}
+}
+
+func TestStateStoreUpdate(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+
+	for name, db := range stores {
+		err := db.Update("k", 0, func(fields map[string]string) (map[string]string, error) {
+			if len(fields) != 0 {
+				t.Errorf("%s: Update of a missing state was given %v", name, fields)
+			}
+			return map[string]string{"n": "1"}, nil
+		})
+		if err != nil {
+			t.Fatalf("%s: Update: %s", name, err)
+		}
+
+		// an error leaves the state alone
+		err = db.Update("k", 0, func(fields map[string]string) (map[string]string, error) {
+			fields["n"] = "2"
+			return fields, errStaleState
+		})
+		if err != errStaleState {
+			t.Errorf("%s: Update returned %v, want errStaleState", name, err)
+		}
+		fields, _ := db.Get("k")
+		if fields["n"] != "1" {
+			t.Errorf("%s: Update changed the state when fn failed: %v", name, fields)
+		}
+
+		// returning no fields deletes the state
+		err = db.Update("k", 0, func(fields map[string]string) (map[string]string, error) {
+			return nil, nil
+		})
+		if err != nil {
+			t.Fatalf("%s: Update: %s", name, err)
+		}
+		fields, _ = db.Get("k")
+		if len(fields) != 0 {
+			t.Errorf("%s: Update didn't delete the state: %v", name, fields)
+		}
+	}
+}
+
+func TestStateStoreUpdateConcurrent(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+
+	for name, db := range stores {
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := db.Update("counter", 0, func(fields map[string]string) (map[string]string, error) {
+					fields["n"] = nextVersion(map[string]string{"version": fields["n"]})
+					return fields, nil
+				})
+				if err != nil {
+					t.Errorf("%s: Update: %s", name, err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		fields, _ := db.Get("counter")
+		if fields["n"] != "20" {
+			t.Errorf("%s: 20 concurrent updates gave %s", name, fields["n"])
+		}
+	}
+}
+
+func TestStateStoreDelete(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+
+	for name, db := range stores {
+		db.Set("k", map[string]string{"a": "1"}, 0)
+		err := db.Delete("k")
+		if err != nil {
+			t.Fatalf("%s: Delete: %s", name, err)
+		}
+		fields, _ := db.Get("k")
+		if len(fields) != 0 {
+			t.Errorf("%s: state still there after Delete: %v", name, fields)
+		}
+
+		err = db.Delete("missing")
+		if err != nil {
+			t.Errorf("%s: Delete of a missing state: %s", name, err)
+		}
+	}
+}
+
+func TestStateStoreTTL(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+
+	for name, db := range stores {
+		db.Set("short", map[string]string{"a": "1"}, 50*time.Millisecond)
+		db.Set("long", map[string]string{"a": "1"}, time.Hour)
+
+		// a ttl of 0 keeps the expiry
+		db.Set("short", map[string]string{"b": "2"}, 0)
+
+		// so does an Update
+		db.Update("short", 0, func(fields map[string]string) (map[string]string, error) {
+			fields["c"] = "3"
+			return fields, nil
+		})
+
+		time.Sleep(100 * time.Millisecond)
+
+		fields, _ := db.Get("short")
+		if len(fields) != 0 {
+			t.Errorf("%s: state didn't expire: %v", name, fields)
+		}
+		fields, _ = db.Get("long")
+		if fields["a"] != "1" {
+			t.Errorf("%s: state expired early: %v", name, fields)
+		}
+
+		// an expired state is empty when it's updated
+		db.Set("gone", map[string]string{"a": "1"}, 10*time.Millisecond)
+		time.Sleep(20 * time.Millisecond)
+		db.Update("gone", 0, func(fields map[string]string) (map[string]string, error) {
+			if len(fields) != 0 {
+				t.Errorf("%s: Update was given an expired state: %v", name, fields)
+			}
+			return nil, nil
+		})
+	}
+}
+
+func TestStateStoreLock(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+
+	for name, db := range stores {
+		unlock, err := db.Lock("k", time.Second, 10*time.Millisecond)
+		if err != nil {
+			t.Fatalf("%s: Lock: %s", name, err)
+		}
+
+		_, err = db.Lock("k", time.Second, 20*time.Millisecond)
+		if err != ErrLockTimeout {
+			t.Errorf("%s: second Lock returned %v, want ErrLockTimeout", name, err)
+		}
+
+		// other keys aren't locked
+		other, err := db.Lock("other", time.Second, 10*time.Millisecond)
+		if err != nil {
+			t.Errorf("%s: Lock of another key: %s", name, err)
+		} else {
+			other()
+		}
+
+		// a waiter gets the lock once it's released
+		got := make(chan error)
+		go func() {
+			unlock, err := db.Lock("k", time.Second, time.Second)
+			if err == nil {
+				unlock()
+			}
+			got <- err
+		}()
+		time.Sleep(20 * time.Millisecond)
+		unlock()
+		// unlocking twice is harmless
+		unlock()
+
+		if err := <-got; err != nil {
+			t.Errorf("%s: waiting Lock: %s", name, err)
+		}
+	}
+}
+
+// equalFields returns true if two states have the same fields
+func equalFields(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+func TestStateTransitions(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+
+	first := &Interaction{InteractionID: "q1", Type: "text", NextInteraction: "q2", StopWord: "stop"}
+	second := &Interaction{InteractionID: "q2", Type: "text", NextInteraction: "q3"}
+	final := &Interaction{InteractionID: "q3", Type: "finaltext"}
+
+	for name, db := range stores {
+		val, err := newState(db, "T:D1", "U1", "bob", "", "", 0, first)
+		if err != nil {
+			t.Fatalf("%s: newState: %s", name, err)
+		}
+		if val["interaction"] != "q1" || val["userid"] != "U1" || val["version"] != "1" || len(val["submission_id"]) == 0 {
+			t.Errorf("%s: newState = %v", name, val)
+		}
+
+		_, err = newState(db, "T:D1", "U1", "bob", "", "", 0, first)
+		if err != errInteractionInProgress {
+			t.Errorf("%s: second newState returned %v, want errInteractionInProgress", name, err)
+		}
+
+		fields, finished, err := advanceState(db, "T:D1", "q1", "1", []string{"yes"}, second)
+		if err != nil || finished {
+			t.Fatalf("%s: advanceState = %v, %v", name, finished, err)
+		}
+		if fields["interaction"] != "q2" || fields["response:q1"] != "yes" || fields["version"] != "2" {
+			t.Errorf("%s: advanceState = %v", name, fields)
+		}
+
+		// answering the same question again is stale
+		_, _, err = advanceState(db, "T:D1", "q1", "1", []string{"no"}, second)
+		if err != errStaleState {
+			t.Errorf("%s: repeated advanceState returned %v, want errStaleState", name, err)
+		}
+
+		fields, finished, err = advanceState(db, "T:D1", "q2", "2", []string{"a", "b"}, final)
+		if err != nil || !finished {
+			t.Fatalf("%s: final advanceState = %v, %v", name, finished, err)
+		}
+		if fields["response:q2"] != "a, b" || fields["values:q2"] != `["a","b"]` {
+			t.Errorf("%s: final advanceState = %v", name, fields)
+		}
+
+		left, _ := db.Get("T:D1")
+		if len(left) != 0 {
+			t.Errorf("%s: state left after finishing: %v", name, left)
+		}
+	}
+}
+
+func TestStateTransitionRaces(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+
+	first := &Interaction{InteractionID: "q1", Type: "attachment", NextInteraction: "q2"}
+	second := &Interaction{InteractionID: "q2", Type: "text"}
+
+	for name, db := range stores {
+		// only one of a set of racing answers (a double-click, or a text
+		// reply racing a button) moves the state on
+		val, err := newState(db, "T:D2", "U1", "bob", "", "", 0, first)
+		if err != nil {
+			t.Fatalf("%s: newState: %s", name, err)
+		}
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		won := 0
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, _, err := advanceState(db, "T:D2", "q1", val["version"], []string{"yes"}, second)
+				if err == errStaleState {
+					return
+				}
+				if err != nil {
+					t.Errorf("%s: advanceState: %s", name, err)
+					return
+				}
+				mu.Lock()
+				won++
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+		if won != 1 {
+			t.Errorf("%s: %d racing answers were saved, want 1", name, won)
+		}
+
+		// a stop word racing an answer: whichever goes second is stale
+		current, _ := db.Get("T:D2")
+		_, _, err = advanceState(db, "T:D2", "q2", current["version"], []string{"done"}, nil)
+		if err != nil {
+			t.Fatalf("%s: advanceState: %s", name, err)
+		}
+		ended, err := endState(db, "T:D2", "", current["version"], FunnelCancelled)
+		if err != nil || len(ended) != 0 {
+			t.Errorf("%s: endState after finishing = %v, %v, want nothing to end", name, ended, err)
+		}
+
+		// an endState racing newer answers is stale
+		val, err = newState(db, "T:D2", "U1", "bob", "", "", 0, first)
+		if err != nil {
+			t.Fatalf("%s: newState: %s", name, err)
+		}
+		_, _, err = advanceState(db, "T:D2", "q1", val["version"], []string{"yes"}, second)
+		if err != nil {
+			t.Fatalf("%s: advanceState: %s", name, err)
+		}
+		_, err = endState(db, "T:D2", "", val["version"], FunnelCancelled)
+		if err != errStaleState {
+			t.Errorf("%s: stale endState returned %v, want errStaleState", name, err)
+		}
+
+		// as is one for another interaction, at the same version
+		current, _ = db.Get("T:D2")
+		_, err = endState(db, "T:D2", "q1", current["version"], FunnelCancelled)
+		if err != errStaleState {
+			t.Errorf("%s: endState of another interaction returned %v, want errStaleState", name, err)
+		}
+
+		// without an interaction or version, it always ends
+		ended, err = endState(db, "T:D2", "", "", FunnelCancelled)
+		if err != nil || ended["interaction"] != "q2" {
+			t.Errorf("%s: endState = %v, %v", name, ended, err)
+		}
+		left, _ := db.Get("T:D2")
+		if len(left) != 0 {
+			t.Errorf("%s: state left after endState: %v", name, left)
+		}
+	}
+}
+
+func TestStateStoreIncr(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+
+	for name, db := range stores {
+		db.Set("counters", map[string]string{"other": "x"}, 0)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := db.Incr("counters", "n", 1); err != nil {
+					t.Errorf("%s: Incr: %s", name, err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		n, err := db.Incr("counters", "n", -10)
+		if err != nil || n != 40 {
+			t.Errorf("%s: Incr = %d, %v, want 40", name, n, err)
+		}
+		fields, _ := db.Get("counters")
+		if fields["n"] != "40" || fields["other"] != "x" {
+			t.Errorf("%s: counters = %v", name, fields)
+		}
+	}
+}
+
+func TestStateStoreSortedSet(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+
+	for name, db := range stores {
+		members, err := db.ZRangeByScore("missing", 100, 0)
+		if err != nil || len(members) != 0 {
+			t.Errorf("%s: ZRangeByScore of a missing set = %v, %v", name, members, err)
+		}
+
+		db.ZAdd("set", "c", 30)
+		db.ZAdd("set", "a", 10)
+		db.ZAdd("set", "b", 20)
+		db.ZAdd("set", "d", 40)
+		// changing the score moves it
+		db.ZAdd("set", "d", 5)
+
+		members, err = db.ZRangeByScore("set", 20, 0)
+		if err != nil || len(members) != 3 || members[0] != "d" || members[1] != "a" || members[2] != "b" {
+			t.Errorf("%s: ZRangeByScore = %v, %v, want [d a b]", name, members, err)
+		}
+		members, _ = db.ZRangeByScore("set", 100, 2)
+		if len(members) != 2 || members[0] != "d" || members[1] != "a" {
+			t.Errorf("%s: limited ZRangeByScore = %v, want [d a]", name, members)
+		}
+
+		n, err := db.ZCount("set", 10)
+		if err != nil || n != 2 {
+			t.Errorf("%s: ZCount = %d, %v, want 2", name, n, err)
+		}
+
+		// only one of a set of racing callers removes a member
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		removed := 0
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ok, err := db.ZRem("set", "a")
+				if err != nil {
+					t.Errorf("%s: ZRem: %s", name, err)
+				}
+				if ok {
+					mu.Lock()
+					removed++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if removed != 1 {
+			t.Errorf("%s: %d callers removed the member, want 1", name, removed)
+		}
+
+		// sorted sets are apart from the states
+		fields, _ := db.Get("set")
+		if len(fields) != 0 {
+			t.Errorf("%s: sorted set showed up as a state: %v", name, fields)
+		}
+	}
+}
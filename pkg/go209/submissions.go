@@ -0,0 +1,300 @@
+package go209
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultSubmissionsFile is where completed interactions are kept
+const DefaultSubmissionsFile = "submissions.jsonl"
+
+// The statuses of a Submission. Only completed and cancelled submissions are
+// kept, modules can also be given expired and in_progress ones
+const (
+	SubmissionCompleted  = "completed"
+	SubmissionCancelled  = "cancelled"
+	SubmissionExpired    = "expired"
+	SubmissionInProgress = "in_progress"
+)
+
+// Answer is a user's response to a single interaction. If more than one value
+// was picked (from a multi-select menu), they're all in Values, and Value has
+// them joined together
+type Answer struct {
+	InteractionID string   `json:"interaction_id"`
+	Question      string   `json:"question,omitempty"`
+	Type          string   `json:"type"`
+	Value         string   `json:"value"`
+	Values        []string `json:"values,omitempty"`
+}
+
+// Submission is the record of a set of interactions a user went through, and
+// their answers, kept once the interactions are over
+type Submission struct {
+	ID         string    `json:"id"`
+	Rule       string    `json:"rule"`
+	UserID     string    `json:"userid"`
+	Username   string    `json:"username"`
+	Status     string    `json:"status"`
+	Anonymous  bool      `json:"anonymous,omitempty"`
+	Args       string    `json:"args,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Answers    []Answer  `json:"answers"`
+}
+
+// Answer returns the answer to an interaction, if there is one
+func (s *Submission) Answer(interactionID string) (*Answer, bool) {
+	for i := range s.Answers {
+		if s.Answers[i].InteractionID == interactionID {
+			return &s.Answers[i], true
+		}
+	}
+	return nil, false
+}
+
+// SubmissionFilter selects which submissions are listed. Empty fields match
+// everything, and rules are matched ignoring case
+type SubmissionFilter struct {
+	Rule   string
+	Status string
+	Since  time.Time
+}
+
+// matches returns true if the submission passes the filter
+func (f *SubmissionFilter) matches(s *Submission) bool {
+	if len(f.Rule) > 0 && !strings.EqualFold(f.Rule, s.Rule) {
+		return false
+	}
+	if len(f.Status) > 0 && f.Status != s.Status {
+		return false
+	}
+	if !f.Since.IsZero() && s.FinishedAt.Before(f.Since) {
+		return false
+	}
+	return true
+}
+
+// SubmissionStore is where submissions are kept once their interactions are
+// over, so the answers aren't lost if an end module fails
+type SubmissionStore interface {
+	// Save records a submission. Cancelled submissions are only kept if the
+	// store was configured to keep them
+	Save(s *Submission) error
+
+	// List returns the submissions matching the filter, oldest first
+	List(filter SubmissionFilter) ([]*Submission, error)
+
+	// Close releases any resources held by the store
+	Close() error
+}
+
+// submissionsPath is the submissions file configured by cfg.SubmissionsFile
+func submissionsPath(cfg *BotConfig) string {
+	if len(cfg.SubmissionsFile) == 0 {
+		return DefaultSubmissionsFile
+	}
+	return cfg.SubmissionsFile
+}
+
+// NewSubmissionStore creates the submission store configured by
+// cfg.SubmissionsFile
+func NewSubmissionStore(cfg *BotConfig) (SubmissionStore, error) {
+	return newJSONLSubmissionStore(submissionsPath(cfg), cfg.SubmissionsKeepCancelled)
+}
+
+// readSubmissionStore opens the submission store configured by
+// cfg.SubmissionsFile to list submissions, without creating the file if it
+// isn't there, for the commands which only read it
+func readSubmissionStore(cfg *BotConfig) SubmissionStore {
+	return &jsonlSubmissionStore{
+		path:          submissionsPath(cfg),
+		keepCancelled: cfg.SubmissionsKeepCancelled,
+	}
+}
+
+// jsonlSubmissionStore appends each submission to a file as a line of JSON.
+// Each submission is written with a single write to a file opened for
+// appending, so the slack bot and web server can share the one file. A store
+// without a file (see readSubmissionStore) can only list submissions
+type jsonlSubmissionStore struct {
+	mu            sync.Mutex
+	path          string
+	keepCancelled bool
+	file          *os.File
+}
+
+// newJSONLSubmissionStore opens (or creates) the submissions file
+func newJSONLSubmissionStore(path string, keepCancelled bool) (*jsonlSubmissionStore, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening submissions file %s: %s", path, err)
+	}
+
+	return &jsonlSubmissionStore{
+		path:          path,
+		keepCancelled: keepCancelled,
+		file:          file,
+	}, nil
+}
+
+// Save appends the submission to the file, and syncs it to disk
+func (s *jsonlSubmissionStore) Save(sub *Submission) error {
+	if sub.Status == SubmissionCancelled && !s.keepCancelled {
+		log.Debug(fmt.Sprintf("Not keeping cancelled submission %s", sub.ID))
+		return nil
+	}
+
+	line, err := json.Marshal(sub)
+	if err != nil {
+		return fmt.Errorf("Error marshalling json: %s", err)
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return fmt.Errorf("Submissions file %s is only open for reading", s.path)
+	}
+	_, err = s.file.Write(line)
+	if err != nil {
+		return fmt.Errorf("Error writing submission: %s", err)
+	}
+	return s.file.Sync()
+}
+
+// List reads through the file, returning the matching submissions
+func (s *jsonlSubmissionStore) List(filter SubmissionFilter) ([]*Submission, error) {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("Submissions file %s doesn't exist. Check SUBMISSIONS_FILE, it's created when the bot or web server starts", s.path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error opening submissions file %s: %s", s.path, err)
+	}
+	defer file.Close()
+
+	var subs []*Submission
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var sub Submission
+		if err := json.Unmarshal(scanner.Bytes(), &sub); err != nil {
+			// a partly written line (from a crash) shouldn't stop us reading the rest
+			log.Warn(fmt.Sprintf("Skipping bad submission on line %d of %s: %s", lineNo, s.path, err))
+			continue
+		}
+		if filter.matches(&sub) {
+			subs = append(subs, &sub)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading submissions file %s: %s", s.path, err)
+	}
+
+	return subs, nil
+}
+
+// Close closes the file
+func (s *jsonlSubmissionStore) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
+
+// newSubmissionID creates a random ID for a submission
+func newSubmissionID() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		// fall back to the time, which is unique enough
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// newSubmission builds a submission from the final state of a set of
+// interactions. The answers are in the order the rule's interactions are
+// defined in
+func newSubmission(rules *RuleSet, val map[string]string, status string) *Submission {
+	sub := &Submission{
+		ID:         val["submission_id"],
+		UserID:     val["userid"],
+		Username:   val["username"],
+		Status:     status,
+		Anonymous:  isAnonymous(val),
+		Args:       val["args"],
+		FinishedAt: time.Now().UTC(),
+		Answers:    []Answer{},
+	}
+	if len(sub.ID) == 0 {
+		sub.ID = newSubmissionID()
+	}
+	if status == SubmissionInProgress {
+		sub.FinishedAt = time.Time{}
+	}
+	if startedAt, err := time.Parse(time.RFC3339, val["started_at"]); err == nil {
+		sub.StartedAt = startedAt
+	}
+
+	rule, err := rules.findRuleByID(val["interaction"])
+	if err != nil {
+		sub.Rule = val["interaction"]
+		return sub
+	}
+	sub.Rule = rule.title()
+
+	for _, interaction := range rule.Interactions {
+		value, ok := val[fmt.Sprintf("response:%s", interaction.InteractionID)]
+		if !ok {
+			continue
+		}
+		answer := Answer{
+			InteractionID: interaction.InteractionID,
+			Question:      interaction.Question,
+			Type:          interaction.Type,
+			Value:         value,
+		}
+		if values, ok := val[fmt.Sprintf("values:%s", interaction.InteractionID)]; ok {
+			err = json.Unmarshal([]byte(values), &answer.Values)
+			if err != nil {
+				log.Warn(fmt.Sprintf("Error decoding json: %s", err))
+			}
+		}
+		sub.Answers = append(sub.Answers, answer)
+	}
+
+	return sub
+}
+
+// recordSubmission saves the final state of a set of interactions as a
+// submission, logging any errors
+func recordSubmission(subs SubmissionStore, rules *RuleSet, val map[string]string, status string) *Submission {
+	sub := newSubmission(rules, val, status)
+
+	err := subs.Save(sub)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error saving submission %s: %s", sub.ID, err))
+	} else {
+		log.Debug(fmt.Sprintf("Submission %s for rule '%s' is %s", sub.ID, sub.Rule, status))
+	}
+
+	return sub
+}
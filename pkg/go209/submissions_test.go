@@ -0,0 +1,165 @@
+package go209
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubmissionStoreSaveList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go209")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := &BotConfig{SubmissionsFile: filepath.Join(dir, "submissions.jsonl")}
+
+	march := func(day int) time.Time {
+		return time.Date(2026, 3, day, 12, 0, 0, 0, time.UTC)
+	}
+	saved := []*Submission{
+		{ID: "s1", Rule: "Pizza survey", UserID: "U1", Username: "alice", Status: SubmissionCompleted, StartedAt: march(1), FinishedAt: march(1), Answers: []Answer{{InteractionID: "p1", Type: "attachment", Value: "ham, pineapple", Values: []string{"ham", "pineapple"}}}},
+		{ID: "s2", Rule: "Pizza survey", UserID: "U2", Username: "bob", Status: SubmissionCancelled, StartedAt: march(2), FinishedAt: march(2), Answers: []Answer{}},
+		{ID: "s3", Rule: "Expenses", Status: SubmissionCompleted, Anonymous: true, Args: "travel", StartedAt: march(3), FinishedAt: march(3), Answers: []Answer{{InteractionID: "e1", Type: "text", Value: "12"}}},
+	}
+
+	// cancelled submissions are only kept if the store was set up to
+	for _, keepCancelled := range []bool{false, true} {
+		os.Remove(cfg.SubmissionsFile)
+		cfg.SubmissionsKeepCancelled = keepCancelled
+		store, err := NewSubmissionStore(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, sub := range saved {
+			err = store.Save(sub)
+			if err != nil {
+				t.Fatalf("Save error: %s", err)
+			}
+		}
+
+		subs, err := store.List(SubmissionFilter{})
+		if err != nil {
+			t.Fatalf("List error: %s", err)
+		}
+		want := []*Submission{saved[0], saved[2]}
+		if keepCancelled {
+			want = saved
+		}
+		if !reflect.DeepEqual(subs, want) {
+			t.Errorf("keep cancelled %v: List = %+v, want %+v", keepCancelled, subs, want)
+		}
+		store.Close()
+	}
+
+	// the filters, through a store which only reads
+	tests := []struct {
+		name   string
+		filter SubmissionFilter
+		want   []string
+	}{
+		{"everything", SubmissionFilter{}, []string{"s1", "s2", "s3"}},
+		{"rule ignoring case", SubmissionFilter{Rule: "pizza SURVEY"}, []string{"s1", "s2"}},
+		{"status", SubmissionFilter{Status: SubmissionCompleted}, []string{"s1", "s3"}},
+		{"since", SubmissionFilter{Since: march(2)}, []string{"s2", "s3"}},
+		{"nothing matches", SubmissionFilter{Rule: "Holidays"}, nil},
+	}
+	store := readSubmissionStore(cfg)
+	defer store.Close()
+	for _, test := range tests {
+		subs, err := store.List(test.filter)
+		if err != nil {
+			t.Errorf("%s: List error: %s", test.name, err)
+			continue
+		}
+		var ids []string
+		for _, sub := range subs {
+			ids = append(ids, sub.ID)
+		}
+		if !reflect.DeepEqual(ids, test.want) {
+			t.Errorf("%s: List = %v, want %v", test.name, ids, test.want)
+		}
+	}
+
+	err = store.Save(saved[0])
+	if err == nil || !strings.Contains(err.Error(), "only open for reading") {
+		t.Errorf("Save to a store which only reads = %v, want an error", err)
+	}
+}
+
+func TestSubmissionStoreAppends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go209")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "submissions.jsonl")
+
+	// a partly written line from a crash is skipped, and what's already there
+	// is kept when the store is opened again
+	err = ioutil.WriteFile(path, []byte(`{"id": "s1", "status": "completed"}`+"\n"+`{"id": "s2", "sta`+"\n\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := newJSONLSubmissionStore(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := newJSONLSubmissionStore(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	defer second.Close()
+
+	first.Save(&Submission{ID: "s3", Status: SubmissionCompleted})
+	second.Save(&Submission{ID: "s4", Status: SubmissionCompleted})
+	first.Save(&Submission{ID: "s5", Status: SubmissionCompleted})
+
+	subs, err := second.List(SubmissionFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, sub := range subs {
+		ids = append(ids, sub.ID)
+	}
+	if want := []string{"s1", "s3", "s4", "s5"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("List = %v, want %v", ids, want)
+	}
+}
+
+func TestReadSubmissionStoreMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go209")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "submissions.jsonl")
+
+	store := readSubmissionStore(&BotConfig{SubmissionsFile: path})
+	_, err = store.List(SubmissionFilter{})
+	if err == nil || !strings.Contains(err.Error(), "Submissions file "+path+" doesn't exist") {
+		t.Errorf("List of a missing file = %v, want it to say the file doesn't exist", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Errorf("Close error: %s", err)
+	}
+
+	// export and report don't create it either
+	cfg := &BotConfig{RulesFileLocation: filepath.Join("testdata", "export_rules.json"), SubmissionsFile: path}
+	if err := ExportSubmissions(cfg, ExportOptions{}, ioutil.Discard); err == nil {
+		t.Error("export of a missing submissions file didn't fail")
+	}
+	if err := ReportSubmissions(cfg, ReportOptions{}, ioutil.Discard); err == nil {
+		t.Error("report of a missing submissions file didn't fail")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("reading the submissions created the file: %v", err)
+	}
+}
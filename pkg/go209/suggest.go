@@ -0,0 +1,160 @@
+package go209
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/nlopes/slack"
+)
+
+// DefaultSuggestionThreshold is the similarity (between 0 and 1) a message
+// needs to have with a search term before we suggest it
+const DefaultSuggestionThreshold = 0.75
+
+// SuggestionCallbackID is the callback_id of the "Did you mean" attachment
+const SuggestionCallbackID = "go209_suggestion"
+
+// tokenize lowercases a string and splits it into words
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// levenshtein calculates the edit distance between two strings
+func levenshtein(a, b string) int {
+	ar := []rune(a)
+	br := []rune(b)
+
+	prev := make([]int, len(br)+1)
+	curr := make([]int, len(br)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ar); i++ {
+		curr[0] = i
+		for j := 1; j <= len(br); j++ {
+			cost := 1
+			if ar[i-1] == br[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(prev[j]+1, minInt(curr[j-1]+1, prev[j-1]+cost))
+		}
+		prev, curr = curr, prev
+	}
+
+	return prev[len(br)]
+}
+
+// minInt returns the smaller of two ints
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// editSimilarity turns the edit distance between two strings into a score
+// between 0 (nothing in common) and 1 (identical)
+func editSimilarity(a, b string) float64 {
+	longest := len([]rune(a))
+	if l := len([]rune(b)); l > longest {
+		longest = l
+	}
+	if longest == 0 {
+		return 1
+	}
+	return 1 - float64(levenshtein(a, b))/float64(longest)
+}
+
+// tokenOverlap scores how well the words of a term are covered by the words of
+// a message. Each word of the term is matched to its most similar word in the
+// message, so small typos still count towards the overlap
+func tokenOverlap(msgTokens, termTokens []string) float64 {
+	if len(termTokens) == 0 || len(msgTokens) == 0 {
+		return 0
+	}
+
+	total := 0.0
+	for _, termToken := range termTokens {
+		best := 0.0
+		for _, msgToken := range msgTokens {
+			if sim := editSimilarity(msgToken, termToken); sim > best {
+				best = sim
+			}
+		}
+		total += best
+	}
+
+	return total / float64(len(termTokens))
+}
+
+// termSimilarity scores how close a message is to a search term, using both
+// the edit distance of the whole message, and the overlap of their words
+func termSimilarity(msg, term string) float64 {
+	msgTokens := tokenize(msg)
+	termTokens := tokenize(term)
+
+	edit := editSimilarity(strings.Join(msgTokens, " "), strings.Join(termTokens, " "))
+	overlap := tokenOverlap(msgTokens, termTokens)
+
+	if overlap > edit {
+		return overlap
+	}
+	return edit
+}
+
+// suggestionThreshold returns the configured suggestion threshold
+func (r *RuleSet) suggestionThreshold() float64 {
+	if r.SuggestionThreshold > 0 {
+		return r.SuggestionThreshold
+	}
+	return DefaultSuggestionThreshold
+}
+
+// suggestRule looks for the visible rule with the search term most similar to
+// the message, leaving out the ones the user isn't permitted to use. If
+// nothing is similar enough, an error is returned
+func (r *RuleSet) suggestRule(dir slackDirectory, team, user, msg string) (*Rule, string, error) {
+	var bestRule *Rule
+	bestTerm := ""
+	bestScore := 0.0
+
+	for i, rule := range r.Rules {
+		if rule.Hidden || !r.permitted(dir, &r.Rules[i], team, user) {
+			continue
+		}
+		for _, term := range rule.SearchTerms {
+			if score := termSimilarity(msg, term); score > bestScore {
+				bestRule = &r.Rules[i]
+				bestTerm = term
+				bestScore = score
+			}
+		}
+	}
+
+	if bestRule == nil || bestScore < r.suggestionThreshold() {
+		return nil, "", fmt.Errorf("No rule similar enough to: '%s'", msg)
+	}
+
+	return bestRule, bestTerm, nil
+}
+
+// suggestionAttachment is the attachment we send with a "Did you mean"
+// suggestion, with a button to run the suggested rule
+func suggestionAttachment(rule *Rule, term string) slack.Attachment {
+	return slack.Attachment{
+		Fallback:   fmt.Sprintf("Did you mean '%s'?", term),
+		CallbackID: SuggestionCallbackID,
+		Actions: []slack.AttachmentAction{
+			{
+				Name:  "suggestion",
+				Text:  fmt.Sprintf("Yes, %s", term),
+				Type:  "button",
+				Value: rule.title(),
+			},
+		},
+	}
+}
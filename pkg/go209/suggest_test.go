@@ -0,0 +1,140 @@
+package go209
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+func TestLevenshtein(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"expenses", "expenses", 0},
+		{"expenses", "expnses", 1},
+		{"expenses", "expsenes", 2},
+		{"leave", "", 5},
+		{"kitten", "sitting", 3},
+	}
+
+	for _, test := range tests {
+		if got := levenshtein(test.a, test.b); got != test.want {
+			t.Errorf("levenshtein(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestTermSimilarity(t *testing.T) {
+	tests := []struct {
+		msg  string
+		term string
+		min  float64
+		max  float64
+	}{
+		{"expenses", "expenses", 1, 1},
+		{"expnses", "expenses", 0.85, 0.9},
+		{"I need to do my expnses", "expenses", 0.85, 0.9},
+		{"Annual-Leave", "annual leave", 1, 1},
+		{"pizza", "expenses", 0, 0.3},
+		{"", "expenses", 0, 0},
+	}
+
+	for _, test := range tests {
+		got := termSimilarity(test.msg, test.term)
+		if got < test.min || got > test.max {
+			t.Errorf("termSimilarity(%q, %q) = %.3f, want between %.3f and %.3f", test.msg, test.term, got, test.min, test.max)
+		}
+	}
+}
+
+func TestSuggestRule(t *testing.T) {
+	rules := &RuleSet{
+		Rules: []Rule{
+			{Name: "expenses", SearchTerms: []string{"expenses", "receipt"}},
+			{Name: "leave", SearchTerms: []string{"annual leave"}},
+			{Name: "secret", SearchTerms: []string{"password reset"}, Hidden: true},
+		},
+	}
+
+	tests := []struct {
+		msg       string
+		threshold float64
+		wantRule  string
+		wantTerm  string
+	}{
+		{"expnses", 0, "expenses", "expenses"},
+		{"recipt", 0, "expenses", "receipt"},
+		{"reciept", 0, "", ""},
+		{"reciept", 0.7, "expenses", "receipt"},
+		{"anual leve", 0, "leave", "annual leave"},
+		{"book some annual leave please", 0, "leave", "annual leave"},
+		{"pasword reset", 0, "", ""},
+		{"pizza", 0, "", ""},
+		{"exp", 0, "", ""},
+		{"expnses", 0.9, "", ""},
+		{"exenpses", 0, "expenses", "expenses"},
+		{"exenpses", 0.8, "", ""},
+	}
+
+	for _, test := range tests {
+		rules.SuggestionThreshold = test.threshold
+		rule, term, err := rules.suggestRule(&testDirectory{}, "T1", "U1", test.msg)
+		if len(test.wantRule) == 0 {
+			if err == nil {
+				t.Errorf("suggestRule(%q) at %.2f = %s/%q, want no rule", test.msg, rules.suggestionThreshold(), rule.title(), term)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("suggestRule(%q) at %.2f returned an error: %s", test.msg, rules.suggestionThreshold(), err)
+			continue
+		}
+		if rule.title() != test.wantRule || term != test.wantTerm {
+			t.Errorf("suggestRule(%q) at %.2f = %s/%q, want %s/%q", test.msg, rules.suggestionThreshold(), rule.title(), term, test.wantRule, test.wantTerm)
+		}
+	}
+}
+
+func TestSuggestPermittedRule(t *testing.T) {
+	rules := &RuleSet{
+		access: newAccessCache(time.Minute),
+		Rules: []Rule{
+			{Name: "incident", SearchTerms: []string{"incident"}, Allow: &AccessList{Groups: []string{"@security"}}},
+			{Name: "expenses", SearchTerms: []string{"expenses"}},
+			{Name: "holiday", SearchTerms: []string{"holiday"}, Deny: &AccessList{Users: []string{"U1"}}},
+		},
+	}
+	dir := &testDirectory{groups: []slack.UserGroup{{ID: "S1", Handle: "security", Users: []string{"U1"}}}}
+
+	tests := []struct {
+		user string
+		msg  string
+		want string
+	}{
+		{"U1", "incidnt", "incident"},
+		{"U2", "incidnt", ""},
+		{"U2", "expnses", "expenses"},
+		{"U1", "holiay", ""},
+		{"U2", "holiay", "holiday"},
+	}
+
+	for _, test := range tests {
+		rule, _, err := rules.suggestRule(dir, "T1", test.user, test.msg)
+		if len(test.want) == 0 {
+			if err == nil {
+				t.Errorf("suggestRule(%q) for %s = %s, want no rule", test.msg, test.user, rule.title())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("suggestRule(%q) for %s returned an error: %s", test.msg, test.user, err)
+			continue
+		}
+		if rule.title() != test.want {
+			t.Errorf("suggestRule(%q) for %s = %s, want %s", test.msg, test.user, rule.title(), test.want)
+		}
+	}
+}
@@ -17,6 +17,7 @@ const TemplatePreParserRegex = `\[\[[\w+\|\|]+\w+\]\]`
 type SlackUser struct {
 	Username string
 	UserID   string
+	Args     string
 }
 
 // preParseTemplate parses strings looking for:
@@ -56,9 +57,25 @@ func preParseTemplate(templatetext string, re *regexp.Regexp) string {
 // Therefore the only template items you should include in your rules are:
 // {{.Username}} or {{.UserID}}
 func parseTemplate(templatetext, username, userid string) (string, error) {
-	u := SlackUser{username, userid}
+	return parseTemplateWithArgs(templatetext, username, userid, "", nil)
+}
+
+// parseTemplateWithArgs is identical to parseTemplate except it also exposes
+// the text passed to a slash command as {{.Args}}, and any template functions
+// such as {{help}} (see RuleSet.templateFuncs)
+func parseTemplateWithArgs(templatetext, username, userid, args string, funcs template.FuncMap) (string, error) {
+	u := SlackUser{username, userid, args}
+
+	// help is always defined, so a template using it still parses where the
+	// rules aren't available
+	allFuncs := template.FuncMap{
+		"help": func() string { return "" },
+	}
+	for name, fn := range funcs {
+		allFuncs[name] = fn
+	}
 
-	templ := template.New("dmtemplate")
+	templ := template.New("dmtemplate").Funcs(allFuncs)
 	templ, err := templ.Parse(templatetext)
 	if err != nil {
 		return "", err
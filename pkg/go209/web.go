@@ -5,11 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	stdlog "log"
 	"net/http"
 	"os"
+	"regexp"
 	"strings"
+	"time"
 
-	"github.com/go-redis/redis"
 	"github.com/nlopes/slack"
 	log "github.com/sirupsen/logrus"
 )
@@ -59,6 +61,24 @@ func slackRespond(w http.ResponseWriter, replace bool, message string) error {
 	return nil
 }
 
+// slackRespondEphemeral responds to a slash command with a message only the
+// invoking user can see
+func slackRespondEphemeral(w http.ResponseWriter, message string) error {
+	responseMsg := slack.Msg{
+		Text:         message,
+		ResponseType: "ephemeral",
+	}
+	responseJSON, err := json.Marshal(responseMsg)
+	if err != nil {
+		return fmt.Errorf("Error marshalling json: %s", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseJSON)
+	return nil
+}
+
 // slackRespondWithAttachment is identical to slackRespond except it can handle
 // a slack Attachment (button, menu drop down) as well
 func slackRespondWithAttachment(w http.ResponseWriter, replace bool, message string, attachment slack.Attachment) error {
@@ -79,14 +99,14 @@ func slackRespondWithAttachment(w http.ResponseWriter, replace bool, message str
 	return nil
 }
 
-func finalizeWebInteraction(db *redis.Client, redKey, username, userid, cbID, selected, finaltext string, rules *RuleSet, w http.ResponseWriter) {
-	finalval, err := db.HGetAll(redKey).Result()
-	log.Info(fmt.Sprintf("User %s (%s) has completed all interactions, final step %s", username, userid, cbID))
+// finalizeWebInteraction is called with the final state, which has already
+// been cleared, when the last interaction was answered with a button or menu
+func finalizeWebInteraction(finalval map[string]string, username, userid, cbID, selected, finaltext, channel string, db StateStore, subs SubmissionStore, rules *RuleSet, w http.ResponseWriter) {
+	var err error
+	sub := recordSubmission(subs, rules, finalval, SubmissionCompleted)
+	finalval["submission_id"] = sub.ID
+	log.Info(fmt.Sprintf("User %s has completed all interactions, final step %s, submission %s", logUser(isAnonymous(finalval), username, userid), cbID, sub.ID))
 	log.Info(fmt.Sprintf("Interaction RESULT:\n%v", finalval))
-	err = db.Del(redKey).Err()
-	if err != nil {
-		log.Warn(fmt.Sprintf("Error deleting hash: %s", err))
-	}
 	if len(finaltext) == 0 {
 		err = slackRespond(w, true, fmt.Sprintf("You selected: %s\nThanks! We'll get back to you soon", selected))
 		if err != nil {
@@ -105,92 +125,156 @@ func finalizeWebInteraction(db *redis.Client, redKey, username, userid, cbID, se
 	if err != nil {
 		log.Warn(fmt.Sprintf("Couldn't find rule: %s", err))
 	} else {
+		err = rules.recordCompletion(db, thisRule, userid)
+		if err != nil {
+			log.Warn(fmt.Sprintf("Error recording completion: %s", err))
+		}
+
 		// we have the rule, and therefore can check for end mods
-		if len(thisRule.InteractionEndMods) > 0 {
-			log.Debug(fmt.Sprintf("We found %d modules to run", len(thisRule.InteractionEndMods)))
-
-			for _, endModName := range thisRule.InteractionEndMods {
-				foundMod := false
-				for _, mod := range modules.Modules {
-					if endModName == mod.Name() {
-						foundMod = true
-						log.Debug(fmt.Sprintf("We found %s module to run", mod.Name()))
-
-						// Fetch the modules ENV VARs
-						evSet := make(map[string]string)
-						for _, ev := range mod.EnvVars() {
-							adjusted := strings.ToUpper(fmt.Sprintf("%s_%s", mod.Name(), ev))
-							evSet[adjusted] = os.Getenv(adjusted)
-						}
-
-						// Set the interactions
-						interactions := make(map[string]string)
-						for _, i := range thisRule.Interactions {
-							interactions[i.InteractionID] = i.Question
-						}
-
-						// Running the module
-						err = mod.Run(finalval, evSet, interactions)
-						if err != nil {
-							log.Warn(fmt.Sprintf("Error running module: %s", err))
-						}
-					}
-				}
+		enqueueEndMods(db, thisRule, finalval, sub, channel)
+	}
+}
 
-				if foundMod == false {
-					log.Warn(fmt.Sprintf("Referenced module not found: %s", endModName))
-				}
-			}
-		}
+// validSlackRequest validates the signature of an incoming Slack web hook.
+// If the request isn't valid, an error status is written and false returned
+func validSlackRequest(cfg *BotConfig, w http.ResponseWriter, r *http.Request) bool {
+	// We split the body in half because we need it for signature validation
+	// then later to read it for JSON parsing
+	rawBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error reading Body: %s", err))
+		w.WriteHeader(http.StatusBadRequest)
+		return false
 	}
+
+	// Clone the body
+	rdr1 := ioutil.NopCloser(bytes.NewBuffer(rawBody))
+	rdr2 := ioutil.NopCloser(bytes.NewBuffer(rawBody))
+	// reset r.Body to the first clone
+	r.Body = rdr1
+	// now set the bodyData for sig validation from the second clone
+	bodyData, err := ioutil.ReadAll(rdr2)
+
+	//Validating sig
+	// the verifier fails if the headers are missing, or the timestamp is too
+	// old, so the request isn't from slack (or is being replayed)
+	sv, err := slack.NewSecretsVerifier(r.Header, cfg.SlackSigningSecret)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error generating new secrets verifier: %s", err))
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+
+	_, err = sv.Write(bodyData)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error writing body to hmac: %s", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+
+	err = sv.Ensure()
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error validating HMAC!"))
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+
+	return true
 }
 
-// messageHandler handles all the incoming Slack web hooks
-func messageHandler(cfg *BotConfig, db *redis.Client, rules *RuleSet) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+// handleSuggestion handles a click on a "Did you mean" suggestion, by running
+// the suggested rule, just as if the user had sent its search term
+func handleSuggestion(w http.ResponseWriter, api *slack.Client, db StateStore, subs SubmissionStore, rules *RuleSet, re *regexp.Regexp, redKey string, interactioncb *myCallbackType) {
+	if len(interactioncb.ActionCallback.Actions) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	title := interactioncb.ActionCallback.Actions[0].Value
 
-		// We split the body in half because we need it for signature validation
-		// then later to read it for JSON parsing
-		rawBody, err := ioutil.ReadAll(r.Body)
+	rule, err := rules.findRuleByTitle(title)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Suggestion error: %s", err))
+		err = slackRespond(w, true, "Sorry, I can't find that any more")
 		if err != nil {
-			log.Warn(fmt.Sprintf("Error reading Body: %s", err))
-			w.WriteHeader(http.StatusBadRequest)
-			return
+			log.Warn(fmt.Sprintf("Error responding to slack message: %s", err))
 		}
+		return
+	}
 
-		// Clone the body
-		rdr1 := ioutil.NopCloser(bytes.NewBuffer(rawBody))
-		rdr2 := ioutil.NopCloser(bytes.NewBuffer(rawBody))
-		// reset r.Body to the first clone
-		r.Body = rdr1
-		// now set the bodyData for sig validation from the second clone
-		bodyData, err := ioutil.ReadAll(rdr2)
+	err = slackRespond(w, true, fmt.Sprintf("You selected: %s", title))
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error responding to slack message: %s", err))
+	}
 
-		//Validating sig
-		sv, err := slack.NewSecretsVerifier(r.Header, cfg.SlackSigningSecret)
-		if err != nil {
-			log.Warn(fmt.Sprintf("Error generating new secrets verifier: %s", err))
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+	// slack only gets the response once we return, so the rule is run
+	// afterwards
+	go runSuggestion(api, db, subs, rules, rule, re, redKey, interactioncb)
+}
 
-		_, err = sv.Write(bodyData)
-		if err != nil {
-			log.Warn(fmt.Sprintf("Error writing body to hmac: %s", err))
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+// runSuggestion runs the rule from a "Did you mean" suggestion, unless the
+// user has started something else since it was suggested
+func runSuggestion(api *slack.Client, db StateStore, subs SubmissionStore, rules *RuleSet, rule *Rule, re *regexp.Regexp, redKey string, interactioncb *myCallbackType) {
+	channel := interactioncb.Channel.ID
 
-		err = sv.Ensure()
-		if err != nil {
-			log.Warn(fmt.Sprintf("Error validating HMAC!"))
-			w.WriteHeader(http.StatusUnauthorized)
+	unlock, err := lockState(db, redKey)
+	if err != nil {
+		log.Warn(err.Error())
+		api.PostMessage(channel, slack.MsgOptionText("Sorry, I'm still working on your last message, try again in a moment", false))
+		return
+	}
+	defer unlock()
+
+	val, err := db.Get(redKey)
+	if err != nil {
+		log.Warn(fmt.Sprintf("State error: %s", err))
+		return
+	}
+
+	if len(val) > 0 {
+		api.PostMessage(channel, slack.MsgOptionText("You're already in the middle of something with me, finish that first (or send me the stop word)", false))
+		return
+	}
+
+	user := interactioncb.User.ID
+	username := interactioncb.User.Name
+	u, err := api.GetUserInfo(user)
+	if err != nil {
+		log.Warn(fmt.Sprintf("GetUserInfo error: %s", err))
+	} else {
+		username = u.RealName
+	}
+
+	// the suggested rule could have been changed since, so this doesn't rely
+	// on it still having search terms
+	term := rule.intentTerm(rule.title())
+	err = runRule(api, db, subs, rules, rule, redKey, interactioncb.Team.ID, channel, user, username, term, term, re)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error running rule: %s", err))
+	}
+}
+
+// messageHandler handles all the incoming Slack web hooks
+func messageHandler(cfg *BotConfig, api *slack.Client, db StateStore, subs SubmissionStore, rules *RuleSet, re *regexp.Regexp) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !validSlackRequest(cfg, w, r) {
 			return
 		}
 
 		// Now we parse the body for conversion into a slack struct
 		r.ParseForm()
 
+		// Buttons on the App Home tab send block actions, which look different
+		// to the attachment callbacks
+		var blockcb myBlockActionCallback
+		err := json.Unmarshal([]byte(r.Form.Get("payload")), &blockcb)
+		if err == nil && blockcb.Type == "block_actions" {
+			// slack only gets the response once we return, so the action is
+			// handled afterwards
+			go handleHomeAction(cfg, api, db, subs, rules, re, &blockcb)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
 		var interactioncb myCallbackType
 
 		err = json.Unmarshal([]byte(r.Form.Get("payload")), &interactioncb)
@@ -201,20 +285,40 @@ func messageHandler(cfg *BotConfig, db *redis.Client, rules *RuleSet) http.Handl
 
 		redKey := fmt.Sprintf("%s:%s", interactioncb.Team.ID, interactioncb.Channel.ID)
 		cbID := interactioncb.CallbackID
-		selected := ""
+
+		if cbID == SuggestionCallbackID {
+			handleSuggestion(w, api, db, subs, rules, re, redKey, &interactioncb)
+			return
+		}
+
+		if len(interactioncb.ActionCallback.Actions) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		unlock, err := lockState(db, redKey)
+		if err != nil {
+			log.Warn(err.Error())
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		defer unlock()
+
+		var selectedValues []string
 		if interactioncb.ActionCallback.Actions[0].Type == "select" {
-			// The user has submitted a select menu item
-			if len(interactioncb.ActionCallback.Actions[0].SelectedOptions) == 1 {
-				selected = interactioncb.ActionCallback.Actions[0].SelectedOptions[0].Value
+			// The user has submitted a select menu item (or a few)
+			for _, option := range interactioncb.ActionCallback.Actions[0].SelectedOptions {
+				selectedValues = append(selectedValues, option.Value)
 			}
 		} else {
 			// The user has simply clicked a button
-			selected = interactioncb.ActionCallback.Actions[0].Value
+			selectedValues = append(selectedValues, interactioncb.ActionCallback.Actions[0].Value)
 		}
+		selected := strings.Join(selectedValues, ", ")
 
-		val, err := db.HGetAll(redKey).Result()
+		val, err := db.Get(redKey)
 		if err != nil {
-			log.Warn(fmt.Sprintf("Redis error: %s", err))
+			log.Warn(fmt.Sprintf("State error: %s", err))
 		}
 
 		if len(val) == 0 {
@@ -227,12 +331,14 @@ func messageHandler(cfg *BotConfig, db *redis.Client, rules *RuleSet) http.Handl
 			// Found a previous state, therefore we're going to carry on
 			// We are in an active interaction now!
 			// spew.Dump(val)
-			log.Info(fmt.Sprintf("User %s (%s) has responded to interaction %s", val["username"], val["userid"], cbID))
-
-			err = db.HSet(redKey, fmt.Sprintf("response:%s", cbID), selected).Err()
-			if err != nil {
-				log.Fatal(fmt.Sprintf("Error saving response into hash: %s", err))
+			username, userid := val["username"], val["userid"]
+			if isAnonymous(val) {
+				// anonymous rules don't keep the user in the state, but the
+				// templates can still address them
+				username, userid = interactioncb.User.Name, interactioncb.User.ID
 			}
+			who := logUser(isAnonymous(val), username, userid)
+			log.Info(fmt.Sprintf("User %s has responded to interaction %s", who, cbID))
 
 			// Handle dynamic next interaction
 			// Get current rule
@@ -243,6 +349,17 @@ func messageHandler(cfg *BotConfig, db *redis.Client, rules *RuleSet) http.Handl
 				log.Fatal(fmt.Sprintf("Error current the current interaction: %s", err))
 			}
 
+			// the allow and deny lists could have changed since the
+			// interactions were started
+			if rule, err := rules.findRuleByID(cbID); err == nil && !rules.permitted(api, rule, interactioncb.Team.ID, interactioncb.User.ID) {
+				log.Info(fmt.Sprintf("User %s isn't permitted to use rule '%s'", who, rule.title()))
+				err = slackRespond(w, false, rules.renderTemplate(api, interactioncb.Team.ID, rule.notPermittedResponse(), username, userid, val["args"], re))
+				if err != nil {
+					log.Warn(fmt.Sprintf("Error responding to slack message: %s", err))
+				}
+				return
+			}
+
 			// dynamic determine the next step, based on the dynamic sellection
 			if len(currinteraction.NextInteractionDynamic) > 0 {
 				for _, dynamicNext := range currinteraction.NextInteractionDynamic {
@@ -252,68 +369,290 @@ func messageHandler(cfg *BotConfig, db *redis.Client, rules *RuleSet) http.Handl
 				}
 			}
 
+			var nextinteraction *Interaction
 			if nextInteraction != "end" {
 				// Get the next interaction
-				nextinteraction, err := rules.findInteractionByID(nextInteraction)
+				nextinteraction, err = rules.findInteractionByID(nextInteraction)
 				if err != nil {
 					log.Fatal(fmt.Sprintf("Error getting the next interaction: %s", err))
 				}
-				err = updateState(db, redKey, nextinteraction)
+			}
+
+			// the on_answer modules can reject the answer, in which case the
+			// buttons are left for them to try again. Slack is waiting on
+			// this, so they and the next interaction's data providers only
+			// have WebModuleTimeout between them
+			deadline := time.Now().Add(WebModuleTimeout)
+			if reason, ok := rules.checkAnswer(db, currinteraction, val, selectedValues, WebModuleTimeout); !ok {
+				err = slackRespond(w, false, reason)
 				if err != nil {
-					log.Fatal(fmt.Sprintf("Error updating the state: %s", err))
+					log.Warn(fmt.Sprintf("Error responding to slack message: %s", err))
 				}
+				return
+			}
 
-				log.Info(fmt.Sprintf("Sending interaction %s to user %s (%s)", nextinteraction.InteractionID, val["username"], val["userid"]))
+			// save the response and move on, in the one transaction. If the
+			// state isn't at this interaction any more, the button was clicked
+			// twice or a text reply beat it
+			finalval, finished, err := advanceState(db, redKey, cbID, val["version"], selectedValues, nextinteraction)
+			if err == errStaleState {
+				log.Info(fmt.Sprintf("User %s has already responded to interaction %s", who, cbID))
+				err = slackRespond(w, false, "Looks like you've already answered that one")
+				if err != nil {
+					log.Warn(fmt.Sprintf("Error responding to slack message: %s", err))
+				}
+				return
+			}
+			if err != nil {
+				log.Fatal(fmt.Sprintf("Error saving response into state: %s", err))
+			}
 
-				// time to ask the next question
-				switch nextinteraction.Type {
-				case "text":
-					err = slackRespond(w, true, fmt.Sprintf("You selected: %s\n%s", selected, nextinteraction.Question))
-					if err != nil {
-						log.Warn(fmt.Sprintf("Error responding to slack message: %s", err))
-					}
-				case "attachment":
-					err = slackRespondWithAttachment(w, true, fmt.Sprintf("You selected: %s\n%s", selected, nextinteraction.Question), nextinteraction.Attachment)
-					if err != nil {
-						log.Warn(fmt.Sprintf("Error responding to slack message: %s", err))
-					}
-				case "finaltext":
-					finalizeWebInteraction(db, redKey, val["username"], val["userid"], cbID, selected, nextinteraction.Response, rules, w)
+			if finished {
+				finaltext := ""
+				if nextinteraction != nil {
+					finaltext = rules.resolveInteraction(db, nextinteraction, userid, username, val["args"], deadline).Response
+				}
+				finalizeWebInteraction(finalval, username, userid, cbID, selected, finaltext, interactioncb.Channel.ID, db, subs, rules, w)
+				return
+			}
+
+			if rule, err := rules.findRuleByID(nextinteraction.InteractionID); err == nil {
+				rules.trackExpiry(db, rule, redKey, interactioncb.Channel.ID, finalval)
+			}
+
+			log.Info(fmt.Sprintf("Sending interaction %s to user %s", nextinteraction.InteractionID, who))
+			nextinteraction = rules.resolveInteraction(db, nextinteraction, userid, username, val["args"], deadline)
+
+			// time to ask the next question
+			switch nextinteraction.Type {
+			case "text":
+				question := rules.renderTemplate(api, interactioncb.Team.ID, nextinteraction.Question, username, userid, val["args"], re)
+				err = slackRespond(w, true, fmt.Sprintf("You selected: %s\n%s", selected, question))
+				if err != nil {
+					log.Warn(fmt.Sprintf("Error responding to slack message: %s", err))
+				}
+			case "attachment":
+				question := rules.renderTemplate(api, interactioncb.Team.ID, nextinteraction.Question, username, userid, val["args"], re)
+				err = slackRespondWithAttachment(w, true, fmt.Sprintf("You selected: %s\n%s", selected, question), nextinteraction.Attachment)
+				if err != nil {
+					log.Warn(fmt.Sprintf("Error responding to slack message: %s", err))
 				}
-			} else {
-				// This is the last interaction
-				finalizeWebInteraction(db, redKey, val["username"], val["userid"], cbID, selected, "", rules, w)
 			}
 		}
 	})
 }
 
+// startRuleInDM starts a rule's interactions in the user's DM with the bot.
+// This is used when a rule is started from outside of a DM, such as a slash
+// command or the App Home tab
+func startRuleInDM(api *slack.Client, db StateStore, subs SubmissionStore, rules *RuleSet, rule *Rule, team, user, username, args string, re *regexp.Regexp) error {
+	_, _, channel, err := api.OpenIMChannel(user)
+	if err != nil {
+		return fmt.Errorf("Error opening DM with %s: %s", user, err)
+	}
+
+	redKey := fmt.Sprintf("%s:%s", team, channel)
+
+	unlock, err := lockState(db, redKey)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	val, err := db.Get(redKey)
+	if err != nil {
+		return fmt.Errorf("State error: %s", err)
+	}
+
+	if len(val) > 0 {
+		// We don't trample over an existing interaction
+		return errInteractionInProgress
+	}
+
+	u, err := api.GetUserInfo(user)
+	if err != nil {
+		log.Warn(fmt.Sprintf("GetUserInfo error: %s", err))
+	} else {
+		username = u.RealName
+	}
+
+	if !enforceAccess(api, rules, rule, team, channel, user, username, args, re) {
+		return nil
+	}
+
+	ok, err := enforceLimits(api, db, rules, rule, team, channel, user, username, args, re)
+	if err != nil || !ok {
+		return err
+	}
+
+	if len(rule.Response) > 0 {
+		api.PostMessage(channel, slack.MsgOptionText(rules.renderTemplate(api, team, rule.Response, username, user, args, re), false))
+	}
+
+	return startInteraction(api, db, subs, rules, rule, redKey, team, channel, user, username, args, re)
+}
+
+// slashCommandHandler handles incoming Slack slash commands. The rule
+// configured for the command is started in the invoking user's DM with the bot
+func slashCommandHandler(cfg *BotConfig, api *slack.Client, db StateStore, subs SubmissionStore, rules *RuleSet, re *regexp.Regexp) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !validSlackRequest(cfg, w, r) {
+			return
+		}
+
+		s, err := slack.SlashCommandParse(r)
+		if err != nil {
+			log.Warn(fmt.Sprintf("Error parsing slash command: %s", err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		rule, err := rules.findRuleBySlashCommand(s.Command)
+		if err != nil {
+			log.Warn(fmt.Sprintf("Slash command error: %s", err))
+			err = slackRespondEphemeral(w, fmt.Sprintf("Sorry, I don't know what to do with %s", s.Command))
+			if err != nil {
+				log.Warn(fmt.Sprintf("Error responding to slack message: %s", err))
+			}
+			return
+		}
+
+		err = slackRespondEphemeral(w, "Check your DMs, I've sent you a message")
+		if err != nil {
+			log.Warn(fmt.Sprintf("Error responding to slack message: %s", err))
+		}
+
+		// slack drops slash commands which aren't answered within 3 seconds,
+		// so the rule is started once we've responded
+		go startSlashCommand(api, db, subs, rules, rule, &s, re)
+	})
+}
+
+// startSlashCommand starts the rule for a slash command in the user's DM. If
+// they're already in the middle of something, they're told where they ran the
+// command
+func startSlashCommand(api *slack.Client, db StateStore, subs SubmissionStore, rules *RuleSet, rule *Rule, s *slack.SlashCommand, re *regexp.Regexp) {
+	err := startRuleInDM(api, db, subs, rules, rule, s.TeamID, s.UserID, s.UserName, s.Text, re)
+	if err == errInteractionInProgress {
+		err = slack.PostWebhook(s.ResponseURL, &slack.WebhookMessage{
+			Text: "You're already in the middle of something with me, finish that first (or send me the stop word)",
+		})
+		if err != nil {
+			log.Warn(fmt.Sprintf("Error responding to slack message: %s", err))
+		}
+		return
+	}
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error starting interaction: %s", err))
+		return
+	}
+
+	log.Info(fmt.Sprintf("Initiating interaction from slash command '%s %s' to %s", s.Command, s.Text, s.UserID))
+}
+
 // StartWeb starts the web server
 func StartWeb(cfg *BotConfig) error {
-	db := redis.NewClient(&redis.Options{
-		Addr:     cfg.RedisAddr,
-		Password: cfg.RedisPwd,
-		DB:       cfg.RedisDB,
-	})
-	_, err := db.Ping().Result()
+	err := loadPlugins(cfg)
+	if err != nil {
+		return err
+	}
+
+	db, err := NewStateStore(cfg)
 	if err != nil {
-		return fmt.Errorf("Redis error: %s", err)
+		return err
 	}
+	defer db.Close()
 
+	subs, err := NewSubmissionStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer subs.Close()
+
+	stopSweeper := startFunnelSweeper(db)
+	defer stopSweeper()
+
+	stopJobs := startJobWorkers(db, slack.New(cfg.SlackToken), cfg.JobWorkers, cfg.ModuleTimeout)
+	defer stopJobs()
+
+	return runWeb(cfg, db, subs)
+}
+
+// runWeb runs the web server until it fails
+func runWeb(cfg *BotConfig, db StateStore, subs SubmissionStore) error {
 	rules, err := parseRuleFile(cfg.RulesFileLocation)
 	if err != nil {
 		return err
 	}
 
+	err = rules.setAnonymousSalt(cfg.AnonymousSalt)
+	if err != nil {
+		return err
+	}
+
+	err = rules.validateModules()
+	if err != nil {
+		return err
+	}
+	rules.moduleTimeout = cfg.ModuleTimeout
+
 	log.SetOutput(os.Stdout)
 	if cfg.Debug {
 		log.SetLevel(log.DebugLevel)
 	}
 
-	http.Handle("/slack/message_handler", messageHandler(cfg, db, rules))
+	// compile the regular expression
+	re := regexp.MustCompile(TemplatePreParserRegex)
+
+	// connect to the slack API, used to start interactions from slash commands
+	// and the App Home tab
+	api := slack.New(cfg.SlackToken,
+		slack.OptionDebug(cfg.Debug),
+		slack.OptionLog(stdlog.New(os.Stdout, "Debug-slackAPI: ", stdlog.Lshortfile|stdlog.LstdFlags)),
+	)
+
+	http.Handle("/slack/message_handler", messageHandler(cfg, api, db, subs, rules, re))
+	http.Handle("/slack/slash_command", slashCommandHandler(cfg, api, db, subs, rules, re))
+	http.Handle("/slack/events", eventsHandler(cfg, api, db, rules))
+	http.Handle("/metrics", metricsHandler(db, rules))
 
 	log.Info(fmt.Sprintf("Starting web server on '%s'....", cfg.WebListen))
-	log.Fatal(http.ListenAndServe(cfg.WebListen, nil))
+	return http.ListenAndServe(cfg.WebListen, nil)
+}
 
-	return nil
+// StartAll starts the slack bot and the web server in the one process, sharing
+// the one state store. This is needed for the memory and bolt state backends
+func StartAll(cfg *BotConfig) error {
+	err := loadPlugins(cfg)
+	if err != nil {
+		return err
+	}
+
+	db, err := NewStateStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	subs, err := NewSubmissionStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer subs.Close()
+
+	stopSweeper := startFunnelSweeper(db)
+	defer stopSweeper()
+
+	stopJobs := startJobWorkers(db, slack.New(cfg.SlackToken), cfg.JobWorkers, cfg.ModuleTimeout)
+	defer stopJobs()
+
+	errc := make(chan error, 2)
+	go func() {
+		errc <- runWeb(cfg, db, subs)
+	}()
+	go func() {
+		errc <- runBot(cfg, db, subs)
+	}()
+
+	return <-errc
 }
@@ -0,0 +1,257 @@
+package go209
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// testSigningSecret is what the test requests are signed with
+const testSigningSecret = "s3cret"
+
+// signedRequest is a request from slack, signed at the given time
+func signedRequest(path, secret, body string, at time.Time) *http.Request {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:%s", timestamp, body)
+
+	r := httptest.NewRequest("POST", path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-Slack-Request-Timestamp", timestamp)
+	r.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+	return r
+}
+
+// testSlackAPI is a fake slack API. Every method works, opens the DM D1 and
+// finds the user Bob. The methods called with their (unescaped) parameters,
+// and anything sent to /response (a slash command's response_url), are sent to
+// calls. If block is set, every request waits for it to be closed
+func testSlackAPI(block chan struct{}) (*httptest.Server, chan string) {
+	calls := make(chan string, 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if block != nil {
+			<-block
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path == "/response" {
+			calls <- "response " + string(body)
+			return
+		}
+		params, _ := url.QueryUnescape(string(body))
+		calls <- strings.TrimPrefix(r.URL.Path, "/") + " " + params
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ok": true, "channel": {"id": "D1"}, "user": {"id": "U1", "real_name": "Bob"}}`))
+	}))
+	return srv, calls
+}
+
+// testSlashRules has a rule with a slash command, which starts at q2 if it's
+// given "toppings"
+func testSlashRules() *RuleSet {
+	return &RuleSet{
+		access: newAccessCache(time.Minute),
+		Rules: []Rule{
+			{
+				Name:         "Pizza survey",
+				SearchTerms:  []string{"pizza"},
+				SlashCommand: "/pizza",
+				Interactions: []Interaction{
+					{InteractionID: "q1", Type: "text", Question: "What size?", NextInteraction: "q2"},
+					{InteractionID: "q2", Type: "text", Question: "What toppings?", NextInteraction: "end"},
+				},
+				InteractionStart:        "q1",
+				InteractionStartDynamic: []DynamicNext{{Response: "toppings", NextInteraction: "q2"}},
+			},
+		},
+	}
+}
+
+// waitForState waits for the state to be at an interaction, as the slash
+// command starts the rule after it has responded
+func waitForState(t *testing.T, db StateStore, redKey, interaction string) {
+	for i := 0; i < 200; i++ {
+		val, _ := db.Get(redKey)
+		if val["interaction"] == interaction {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	val, _ := db.Get(redKey)
+	t.Fatalf("state is %v, want it at %s", val, interaction)
+}
+
+func TestValidSlackRequest(t *testing.T) {
+	cfg := &BotConfig{SlackSigningSecret: testSigningSecret}
+	body := "command=%2Fpizza&text="
+
+	tests := []struct {
+		name    string
+		request *http.Request
+		want    int
+	}{
+		{"valid", signedRequest("/", testSigningSecret, body, time.Now()), http.StatusOK},
+		{"wrong secret", signedRequest("/", "guess", body, time.Now()), http.StatusUnauthorized},
+		{"stale timestamp", signedRequest("/", testSigningSecret, body, time.Now().Add(-10*time.Minute)), http.StatusUnauthorized},
+		{"future timestamp", signedRequest("/", testSigningSecret, body, time.Now().Add(10*time.Minute)), http.StatusUnauthorized},
+		{"no signature", httptest.NewRequest("POST", "/", strings.NewReader(body)), http.StatusUnauthorized},
+	}
+
+	// a body changed after it was signed
+	tampered := signedRequest("/", testSigningSecret, body, time.Now())
+	tampered.Body = ioutil.NopCloser(strings.NewReader(body + "toppings"))
+	tests = append(tests, struct {
+		name    string
+		request *http.Request
+		want    int
+	}{"tampered body", tampered, http.StatusUnauthorized})
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		valid := validSlackRequest(cfg, w, test.request)
+		if valid != (test.want == http.StatusOK) || w.Code != test.want {
+			t.Errorf("%s: validSlackRequest = %v with %d, want %d", test.name, valid, w.Code, test.want)
+			continue
+		}
+
+		// the body can still be read once it's been checked
+		if valid {
+			b, _ := ioutil.ReadAll(test.request.Body)
+			if string(b) != body {
+				t.Errorf("%s: body after validSlackRequest = %q, want %q", test.name, b, body)
+			}
+		}
+	}
+}
+
+func TestSlashCommand(t *testing.T) {
+	srv, calls := testSlackAPI(nil)
+	defer srv.Close()
+	api := slack.New("xoxb-test", slack.OptionAPIURL(srv.URL+"/"))
+	cfg := &BotConfig{SlackSigningSecret: testSigningSecret}
+	re := regexp.MustCompile(TemplatePreParserRegex)
+
+	tests := []struct {
+		name    string
+		command string
+		text    string
+		want    string
+		start   string
+	}{
+		{"no args", "/pizza", "", "Check your DMs", "q1"},
+		{"args pick the starting interaction", "/pizza", "Toppings", "Check your DMs", "q2"},
+		{"other args", "/pizza", "large", "Check your DMs", "q1"},
+		{"unknown command", "/nope", "", "I don't know what to do with /nope", ""},
+	}
+
+	for _, test := range tests {
+		db := newMemoryStore()
+		handler := slashCommandHandler(cfg, api, db, nil, testSlashRules(), re)
+
+		form := url.Values{"team_id": {"T1"}, "user_id": {"U1"}, "user_name": {"bob"}, "command": {test.command}, "text": {test.text}}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, signedRequest("/slack/slash_command", testSigningSecret, form.Encode(), time.Now()))
+
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), test.want) || !strings.Contains(w.Body.String(), `"ephemeral"`) {
+			t.Errorf("%s: response %d %s, want an ephemeral %q", test.name, w.Code, w.Body.String(), test.want)
+		}
+		if len(test.start) > 0 {
+			waitForState(t, db, "T1:D1", test.start)
+		}
+	}
+
+	// an unsigned slash command doesn't start anything
+	db := newMemoryStore()
+	form := url.Values{"team_id": {"T1"}, "user_id": {"U1"}, "command": {"/pizza"}}
+	w := httptest.NewRecorder()
+	slashCommandHandler(cfg, api, db, nil, testSlashRules(), re).ServeHTTP(w, signedRequest("/slack/slash_command", "guess", form.Encode(), time.Now()))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("unsigned slash command got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if val, _ := db.Get("T1:D1"); len(val) > 0 {
+		t.Errorf("unsigned slash command started %v", val)
+	}
+
+	// someone already in the middle of something is told with the response_url
+	for len(calls) > 0 {
+		<-calls
+	}
+	_, err := newState(db, "T1:D1", "U1", "bob", "", "", 0, &testSlashRules().Rules[0].Interactions[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	form = url.Values{"team_id": {"T1"}, "user_id": {"U1"}, "command": {"/pizza"}, "response_url": {srv.URL + "/response"}}
+	w = httptest.NewRecorder()
+	slashCommandHandler(cfg, api, db, nil, testSlashRules(), re).ServeHTTP(w, signedRequest("/slack/slash_command", testSigningSecret, form.Encode(), time.Now()))
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case call := <-calls:
+			if strings.HasPrefix(call, "chat.postMessage") {
+				t.Errorf("posted a message to the DM while an interaction was in progress")
+			}
+			if !strings.HasPrefix(call, "response ") {
+				continue
+			}
+			if !strings.Contains(call, "already in the middle of something") {
+				t.Errorf("response_url got %s", call)
+			}
+		case <-timeout:
+			t.Fatal("nothing was sent to the response_url")
+		}
+		break
+	}
+}
+
+func TestSlashCommandRespondsFirst(t *testing.T) {
+	// slack doesn't answer until the test is over, so the rule can only be
+	// started after the response
+	block := make(chan struct{})
+	srv, _ := testSlackAPI(block)
+	defer srv.Close()
+	defer close(block)
+	api := slack.New("xoxb-test", slack.OptionAPIURL(srv.URL+"/"))
+	cfg := &BotConfig{SlackSigningSecret: testSigningSecret}
+	handler := slashCommandHandler(cfg, api, newMemoryStore(), nil, testSlashRules(), regexp.MustCompile(TemplatePreParserRegex))
+
+	form := url.Values{"team_id": {"T1"}, "user_id": {"U1"}, "command": {"/pizza"}}
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, signedRequest("/slack/slash_command", testSigningSecret, form.Encode(), time.Now()))
+		done <- w
+	}()
+
+	select {
+	case w := <-done:
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Check your DMs") {
+			t.Errorf("response %d %s, want the acknowledgement", w.Code, w.Body.String())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the slash command waited for slack before responding")
+	}
+}
+
+func TestMessageHandlerWithoutActions(t *testing.T) {
+	cfg := &BotConfig{SlackSigningSecret: testSigningSecret}
+	handler := messageHandler(cfg, slack.New("xoxb-test"), newMemoryStore(), nil, testSlashRules(), regexp.MustCompile(TemplatePreParserRegex))
+
+	form := url.Values{"payload": {`{"type": "interactive_message", "callback_id": "q1", "team": {"id": "T1"}, "channel": {"id": "D1"}, "actions": []}`}}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, signedRequest("/slack/message_handler", testSigningSecret, form.Encode(), time.Now()))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("callback without actions got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
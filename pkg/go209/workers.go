@@ -0,0 +1,70 @@
+package go209
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/nlopes/slack"
+)
+
+// DefaultBotWorkers is how many DMs the slack bot handles at once
+const DefaultBotWorkers = 8
+
+// botWorkerQueue is how many DMs can be waiting for each worker, before the
+// RTM event loop waits for them to catch up
+const botWorkerQueue = 100
+
+// dmWorkers hands DMs to a fixed pool of workers. Every DM from a session
+// (team and channel) goes to the same worker, so they're handled in the order
+// they arrived, while a slow module run for one user only holds up the few
+// sessions which share its worker
+type dmWorkers struct {
+	queues []chan *slack.MessageEvent
+	wg     sync.WaitGroup
+}
+
+// newDMWorkers starts n workers, each calling handle for the DMs sent to it
+func newDMWorkers(n int, handle func(ev *slack.MessageEvent)) *dmWorkers {
+	if n < 1 {
+		n = DefaultBotWorkers
+	}
+
+	d := &dmWorkers{}
+	for i := 0; i < n; i++ {
+		queue := make(chan *slack.MessageEvent, botWorkerQueue)
+		d.queues = append(d.queues, queue)
+
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			for ev := range queue {
+				handle(ev)
+			}
+		}()
+	}
+
+	return d
+}
+
+// worker is the worker which handles a session's DMs
+func (d *dmWorkers) worker(team, channel string) int {
+	h := fnv.New32a()
+	h.Write([]byte(team))
+	h.Write([]byte(":"))
+	h.Write([]byte(channel))
+
+	return int(h.Sum32() % uint32(len(d.queues)))
+}
+
+// dispatch queues a DM for the worker which handles its session
+func (d *dmWorkers) dispatch(ev *slack.MessageEvent) {
+	d.queues[d.worker(ev.Msg.Team, ev.Msg.Channel)] <- ev
+}
+
+// stop waits for the workers to finish the DMs they've been given
+func (d *dmWorkers) stop() {
+	for _, queue := range d.queues {
+		close(queue)
+	}
+	d.wg.Wait()
+}
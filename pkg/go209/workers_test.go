@@ -0,0 +1,141 @@
+package go209
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// testDM is a DM in a session
+func testDM(channel, text string) *slack.MessageEvent {
+	ev := &slack.MessageEvent{}
+	ev.Msg.Team = "T1"
+	ev.Msg.Channel = channel
+	ev.Msg.Text = text
+	return ev
+}
+
+func TestDMWorkersOrder(t *testing.T) {
+	var mu sync.Mutex
+	handling := make(map[string]bool)
+	handled := make(map[string][]string)
+
+	d := newDMWorkers(4, func(ev *slack.MessageEvent) {
+		mu.Lock()
+		if handling[ev.Msg.Channel] {
+			t.Errorf("two DMs from %s handled at once", ev.Msg.Channel)
+		}
+		handling[ev.Msg.Channel] = true
+		mu.Unlock()
+
+		time.Sleep(100 * time.Microsecond)
+
+		mu.Lock()
+		handling[ev.Msg.Channel] = false
+		handled[ev.Msg.Channel] = append(handled[ev.Msg.Channel], ev.Msg.Text)
+		mu.Unlock()
+	})
+
+	// the sessions' DMs arrive mixed up together
+	var want []string
+	for i := 0; i < 50; i++ {
+		want = append(want, strconv.Itoa(i))
+		for s := 0; s < 10; s++ {
+			d.dispatch(testDM(fmt.Sprintf("D%d", s), strconv.Itoa(i)))
+		}
+	}
+	d.stop()
+
+	for s := 0; s < 10; s++ {
+		channel := fmt.Sprintf("D%d", s)
+		if !reflect.DeepEqual(handled[channel], want) {
+			t.Errorf("%s handled %v, want them in order", channel, handled[channel])
+		}
+		if worker := d.worker("T1", channel); worker < 0 || worker >= 4 {
+			t.Errorf("%s went to worker %d", channel, worker)
+		}
+	}
+}
+
+func TestDMWorkersSlowSession(t *testing.T) {
+	release := make(chan struct{})
+	handled := make(chan string, 10)
+
+	d := newDMWorkers(4, func(ev *slack.MessageEvent) {
+		if ev.Msg.Text == "slow" {
+			<-release
+		}
+		handled <- ev.Msg.Channel + " " + ev.Msg.Text
+	})
+
+	// find a session on another worker to the slow one
+	other := ""
+	for s := 0; len(other) == 0; s++ {
+		if channel := fmt.Sprintf("D%d", s); d.worker("T1", channel) != d.worker("T1", "D0") {
+			other = channel
+		}
+	}
+
+	d.dispatch(testDM("D0", "slow"))
+	d.dispatch(testDM("D0", "next"))
+	d.dispatch(testDM(other, "hello"))
+
+	// the other session isn't held up, but the slow one's next DM waits
+	select {
+	case got := <-handled:
+		if got != other+" hello" {
+			t.Errorf("handled %s while D0 was slow, want %s hello", got, other)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("a slow session held up another worker")
+	}
+	select {
+	case got := <-handled:
+		t.Errorf("handled %s before D0's slow DM finished", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	d.stop()
+	if got := <-handled; got != "D0 slow" {
+		t.Errorf("handled %s, want D0 slow", got)
+	}
+	if got := <-handled; got != "D0 next" {
+		t.Errorf("handled %s, want D0 next", got)
+	}
+}
+
+func TestDMWorkersStopDrains(t *testing.T) {
+	var mu sync.Mutex
+	count := 0
+
+	d := newDMWorkers(3, func(ev *slack.MessageEvent) {
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		count++
+		mu.Unlock()
+	})
+	for i := 0; i < 200; i++ {
+		d.dispatch(testDM(fmt.Sprintf("D%d", i%7), strconv.Itoa(i)))
+	}
+
+	// everything queued is handled before stop returns
+	d.stop()
+	mu.Lock()
+	defer mu.Unlock()
+	if count != 200 {
+		t.Errorf("%d DMs handled by the time stop returned, want 200", count)
+	}
+
+	// with no size, the default pool is started
+	d = newDMWorkers(0, func(ev *slack.MessageEvent) {})
+	if len(d.queues) != DefaultBotWorkers {
+		t.Errorf("newDMWorkers(0) started %d workers, want %d", len(d.queues), DefaultBotWorkers)
+	}
+	d.stop()
+}